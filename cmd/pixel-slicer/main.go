@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 
@@ -54,6 +55,8 @@ func main() {
 				viper.Set("Workers", workers)
 			}
 			if s3Enabled := c.Bool("enable-s3"); s3Enabled {
+				viper.Set("S3.Enabled", s3Enabled)
+			}
 			if debugFilenames := c.Bool("debug-filenames"); debugFilenames {
 				viper.Set("DebugFilenames", debugFilenames)
 			}
@@ -4,8 +4,9 @@ go 1.13
 
 require (
 	github.com/aws/aws-sdk-go v1.33.7
+	github.com/buckket/go-blurhash v1.1.0
 	github.com/davecgh/go-spew v1.1.1
-	github.com/davidbyttow/govips/v2 v2.9.0
+	github.com/davidbyttow/govips/v2 v2.16.0
 	github.com/disintegration/imaging v1.6.2
 	github.com/floostack/transcoder v1.1.1
 	github.com/hashicorp/go-multierror v1.1.0
@@ -15,8 +16,5 @@ require (
 	github.com/spf13/viper v1.7.0
 	github.com/urfave/cli v1.22.4
 	github.com/xfrr/goffmpeg v0.0.0-20200624145540-fb3f88b1924e
-	golang.org/x/crypto v0.0.0-20211209193657-4570a0811e8b // indirect
-	golang.org/x/sys v0.0.0-20211209171907-798191bca915 // indirect
-	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211 // indirect
 	gopkg.in/yaml.v2 v2.2.5 // indirect
 )
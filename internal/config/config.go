@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"path/filepath"
 	"regexp"
+	"text/template"
 
 	"github.com/willdollman/pixel-slicer/internal/mediaprocessor"
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
 	"github.com/willdollman/pixel-slicer/internal/s3"
 )
 
@@ -23,20 +25,55 @@ type ReadableConfig struct {
 	Watch               bool
 	Workers             int
 	DebugFilenames      bool
+	TypeDetection       pixelio.DetectionMode
+	Manifest            bool
+	RunManifest         string
+	HTML                bool
+	HTMLBaseURL         string
+	HTMLSizes           string
+	PictureTemplate     string
+	VideoTemplate       string
+	FFmpegPath          string
+	FFprobePath         string
+	ButteraugliPath     string
+	CjxlPath            string
+	DcrawPath           string
+	ChunkDuration       int
 	S3Config            s3.S3Config `mapstructure:"S3"`
 	ImageConfigurations []*mediaprocessor.ImageConfiguration
 	VideoConfigurations []*mediaprocessor.VideoConfiguration
+	RawDecoder          mediaprocessor.RawDecoder
+	Upscale             mediaprocessor.UpscalePolicy
+	Placeholders        bool
+	HLS                 *mediaprocessor.HLSConfiguration
+
+	snippetTemplates map[mediaprocessor.MediaType]*template.Template // Parsed by ValidateConfig
 }
 
 func (c *ReadableConfig) GetFSConfig() *mediaprocessor.FSConfig {
 	return &mediaprocessor.FSConfig{
-		InputDir:       c.InputDir,
-		OutputDir:      c.OutputDir,
-		MoveProcessed:  c.MoveProcessed,
-		ProcessedDir:   c.ProcessedDir,
-		Watch:          c.Watch,
-		Workers:        c.Workers,
-		DebugFilenames: c.DebugFilenames,
+		InputDir:         c.InputDir,
+		OutputDir:        c.OutputDir,
+		MoveProcessed:    c.MoveProcessed,
+		ProcessedDir:     c.ProcessedDir,
+		Watch:            c.Watch,
+		Workers:          c.Workers,
+		DebugFilenames:   c.DebugFilenames,
+		TypeDetection:    c.TypeDetection,
+		Manifest:         c.Manifest,
+		RunManifest:      c.RunManifest,
+		HTML:             c.HTML,
+		HTMLBaseURL:      c.HTMLBaseURL,
+		HTMLSizes:        c.HTMLSizes,
+		PictureTemplate:  c.PictureTemplate,
+		VideoTemplate:    c.VideoTemplate,
+		SnippetTemplates: c.snippetTemplates,
+		FFmpegPath:       c.FFmpegPath,
+		FFprobePath:      c.FFprobePath,
+		ButteraugliPath:  c.ButteraugliPath,
+		CjxlPath:         c.CjxlPath,
+		DcrawPath:        c.DcrawPath,
+		ChunkDuration:    c.ChunkDuration,
 	}
 }
 
@@ -44,6 +81,10 @@ func (c *ReadableConfig) GetMediaConfig() *mediaprocessor.MediaConfig {
 	return &mediaprocessor.MediaConfig{
 		ImageConfigurations: c.ImageConfigurations,
 		VideoConfigurations: c.VideoConfigurations,
+		RawDecoder:          c.RawDecoder,
+		Upscale:             c.Upscale,
+		Placeholders:        c.Placeholders,
+		HLS:                 c.HLS,
 	}
 }
 
@@ -78,7 +119,102 @@ func (c *ReadableConfig) ValidateConfig() (err error) {
 		return fmt.Errorf("--watch requires --move-processed to be enabled, to avoid files being processed multiple times")
 	}
 
+	if err := c.TypeDetection.Validate(); err != nil {
+		return err
+	}
+
+	if c.RunManifest != "" && !c.Manifest {
+		return fmt.Errorf("runManifest requires manifest to be enabled")
+	}
+
+	// Parse snippet templates once, before processing any files
+	c.snippetTemplates = make(map[mediaprocessor.MediaType]*template.Template)
+	if c.snippetTemplates[mediaprocessor.Image], err = mediaprocessor.ParseSnippetTemplate(mediaprocessor.Image, c.PictureTemplate); err != nil {
+		return err
+	}
+	if c.snippetTemplates[mediaprocessor.Video], err = mediaprocessor.ParseSnippetTemplate(mediaprocessor.Video, c.VideoTemplate); err != nil {
+		return err
+	}
+
+	if c.ChunkDuration < 0 {
+		return fmt.Errorf("chunkDuration should be positive, or 0 to disable chunking")
+	}
+
+	if err := c.validateFFmpeg(); err != nil {
+		return err
+	}
+	if err := c.validateImageTools(); err != nil {
+		return err
+	}
+
 	return
 }
 
+// validateFFmpeg resolves the paths of ffmpeg and ffprobe, and checks that the ffmpeg build can
+// encode every video configuration. They're only required if videos are output; otherwise
+// ffprobe is still used if it's found, to detect and probe videos.
+func (c *ReadableConfig) validateFFmpeg() error {
+	videoConfigs := c.VideoConfigurations
+	if c.HLS != nil {
+		videoConfigs = append(append([]*mediaprocessor.VideoConfiguration{}, videoConfigs...), c.HLS.Renditions...)
+	}
+
+	ffprobePath, err := mediaprocessor.FindBinary(c.FFprobePath, "ffprobe")
+	if err != nil {
+		if len(videoConfigs) > 0 {
+			return err
+		}
+		ffprobePath = "ffprobe"
+	}
+	c.FFprobePath = ffprobePath
+
+	if len(videoConfigs) == 0 {
+		return nil
+	}
+	if c.FFmpegPath, err = mediaprocessor.FindBinary(c.FFmpegPath, "ffmpeg"); err != nil {
+		return err
+	}
+	return mediaprocessor.CheckVideoEncoders(c.FFmpegPath, videoConfigs)
+}
+
 // Read from config file with Viper?
+
+// validateImageTools resolves the paths of the external tools used by image configurations.
+// Each is required if a configuration uses it; otherwise it's still used if it's found, as
+// sidecars may add configurations which need it.
+func (c *ReadableConfig) validateImageTools() (err error) {
+	var usesButteraugli, usesCjxl bool
+	for _, imageConfig := range c.ImageConfigurations {
+		if imageConfig.TargetQuality != nil && imageConfig.TargetQuality.Metric == mediaprocessor.MetricButteraugli {
+			usesButteraugli = true
+		}
+		if imageConfig.LosslessJPEG {
+			usesCjxl = true
+		}
+	}
+	if c.ButteraugliPath, err = findTool(c.ButteraugliPath, "butteraugli_main", usesButteraugli); err != nil {
+		return err
+	}
+	if c.CjxlPath, err = findTool(c.CjxlPath, "cjxl", usesCjxl); err != nil {
+		return err
+	}
+	// RAW input files aren't known until they're processed, so dcraw is never required
+	if c.DcrawPath, err = findTool(c.DcrawPath, "dcraw", false); err != nil {
+		return err
+	}
+
+	return
+}
+
+// findTool resolves the path of an external tool using FindBinary. If the tool isn't found and
+// isn't needed, its name is returned, so that it's reported missing if it's ever run.
+func findTool(path string, name string, needed bool) (string, error) {
+	found, err := mediaprocessor.FindBinary(path, name)
+	if err != nil {
+		if needed {
+			return "", err
+		}
+		return name, nil
+	}
+	return found, nil
+}
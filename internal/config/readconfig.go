@@ -7,6 +7,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"github.com/willdollman/pixel-slicer/internal/mediaprocessor"
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
 )
 
 func GetConfig(configPath string) (*ReadableConfig, error) {
@@ -17,6 +18,20 @@ func GetConfig(configPath string) (*ReadableConfig, error) {
 	viper.SetDefault("MoveProcessed", false)
 	viper.SetDefault("Watch", false)
 	viper.SetDefault("Workers", runtime.NumCPU()/2) // Base worker threads on number of CPU cores available
+	viper.SetDefault("TypeDetection", pixelio.DetectExtension)
+	viper.SetDefault("Manifest", false)
+	viper.SetDefault("RunManifest", "")
+	viper.SetDefault("HTML", false)
+	viper.SetDefault("HTMLBaseURL", "")
+	viper.SetDefault("HTMLSizes", "100vw")
+	viper.SetDefault("PictureTemplate", "")
+	viper.SetDefault("VideoTemplate", "")
+	viper.SetDefault("FFmpegPath", "") // Found on the PATH by default
+	viper.SetDefault("FFprobePath", "")
+	viper.SetDefault("ButteraugliPath", "")
+	viper.SetDefault("CjxlPath", "")
+	viper.SetDefault("DcrawPath", "")
+	viper.SetDefault("ChunkDuration", 0)
 	// Default S3 configurations
 	viper.SetDefault("S3Enabled", false)
 	viper.SetDefault("S3", map[string]string{"Endoint": "", "Region": "", "Bucket": "pixelslicer"})
@@ -31,6 +46,9 @@ func GetConfig(configPath string) (*ReadableConfig, error) {
 		{MaxWidth: 480, Quality: 23, FileType: mediaprocessor.FileOutputType("mp4")},
 		{MaxWidth: 720, Quality: 23, FileType: mediaprocessor.FileOutputType("mp4")},
 	})
+	viper.SetDefault("RawDecoder", mediaprocessor.RawPreview)
+	viper.SetDefault("Upscale", mediaprocessor.UpscaleAllow)
+	viper.SetDefault("Placeholders", false)
 
 	// Config location
 	if configPath != "" {
@@ -54,20 +72,32 @@ func GetConfig(configPath string) (*ReadableConfig, error) {
 
 	var appConfig ReadableConfig
 
+	if err := mediaprocessor.CheckBooleanKeys(viper.AllSettings()); err != nil {
+		return nil, errors.Wrap(err, "invalid config file")
+	}
 	if err := viper.Unmarshal(&appConfig); err != nil {
 		log.Fatal("Error unmarshalling config")
 		return nil, err
 	}
 
 	// Validate media configs
-	for _, c := range appConfig.ImageConfigurations {
-		if err := c.Validate(); err != nil {
-			return nil, errors.Wrap(err, "invalid image configuration")
-		}
+	imageConfigs, err := mediaprocessor.ExpandImageConfigurations(appConfig.ImageConfigurations)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid image configuration")
+	}
+	appConfig.ImageConfigurations = imageConfigs
+	if err := mediaprocessor.ValidateVideoConfigurations(appConfig.VideoConfigurations); err != nil {
+		return nil, errors.Wrap(err, "invalid video configuration")
+	}
+	if err := appConfig.RawDecoder.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid raw decoder")
+	}
+	if err := appConfig.Upscale.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid upscale policy")
 	}
-	for _, c := range appConfig.VideoConfigurations {
-		if err := c.Validate(); err != nil {
-			return nil, errors.Wrap(err, "invalid video configuration")
+	if appConfig.HLS != nil {
+		if err := appConfig.HLS.Validate(); err != nil {
+			return nil, errors.Wrap(err, "invalid HLS configuration")
 		}
 	}
 
@@ -1,22 +1,50 @@
 package mediaprocessor
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"text/template"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
 
 // FSConfig contains the filesystem-related parameters used when processing media
 type FSConfig struct {
-	InputDir       string
-	OutputDir      string
-	MoveProcessed  bool
-	ProcessedDir   string
-	Watch          bool
-	Workers        int
-	DebugFilenames bool
+	InputDir        string
+	OutputDir       string
+	MoveProcessed   bool
+	ProcessedDir    string
+	Watch           bool
+	Workers         int
+	DebugFilenames  bool
+	TypeDetection   pixelio.DetectionMode
+	Manifest        bool   // Write a SourceManifest of the output for each input file
+	RunManifest     string // Path of a RunManifest aggregating every input file, relative to the output dir
+	HTML            bool   // Write an HTML snippet displaying the output for each input file
+	HTMLBaseURL     string // URL prefixed to output paths in HTML snippets, e.g. https://cdn.example.com/media
+	HTMLSizes       string // sizes attribute of image snippets, e.g. (max-width: 600px) 100vw, 50vw
+	PictureTemplate string // Path of a text/template overriding the default image snippet
+	VideoTemplate   string // Path of a text/template overriding the default video snippet
+
+	SnippetTemplates map[MediaType]*template.Template // Parsed snippet templates, for each MediaType
+	FFmpegPath       string                           // Path of the ffmpeg binary, resolved by FindBinary
+	FFprobePath      string                           // Path of the ffprobe binary, resolved by FindBinary
+	ButteraugliPath  string                           // Path of libjxl's butteraugli_main binary, resolved by FindBinary
+	CjxlPath         string                           // Path of libjxl's cjxl binary, resolved by FindBinary
+	DcrawPath        string                           // Path of the dcraw binary, resolved by FindBinary
+	ChunkDuration    int                              // Target length in seconds of the chunks long videos are split into, to encode them in parallel. 0 disables chunking
 }
 
 // MediaConfig contains the image and video output parameters used when encoding media
 type MediaConfig struct {
 	ImageConfigurations []*ImageConfiguration
 	VideoConfigurations []*VideoConfiguration
+	RawDecoder          RawDecoder
+	Upscale             UpscalePolicy
+	Placeholders        bool              // Generate placeholders for images, written to each image's SourceManifest
+	HLS                 *HLSConfiguration // Output an HLS adaptive streaming ladder for videos, if set
 }
 
 type MediaConfiguration interface {
@@ -26,13 +54,44 @@ type MediaConfiguration interface {
 
 // ImageConfiguration describes output size, quality, and format for an output image file
 type ImageConfiguration struct {
-	MaxWidth int
-	Quality  int
-	FileType FileOutputType
+	MaxWidth          int
+	Quality           int
+	FileType          FileOutputType
+	Speed             int               // AVIF encoder speed, 1 (slowest) to 9 (fastest). 0 uses the encoder default
+	ChromaSubsampling ChromaSubsampling // Chroma subsampling mode, for formats which support it
+	Effort            int               // JPEG XL encoder effort, 1 (fastest) to 9 (slowest). 0 uses the encoder default
+	Distance          float64           // JPEG XL Butteraugli distance, 1.0 is visually lossless. 0 derives it from Quality
+	LosslessJPEG      bool              // Losslessly recompress JPEG sources to JPEG XL when they aren't resized
+	Lossless          bool              // Encode WebP, AVIF or JPEG XL losslessly. Quality is ignored
+	Palette           bool              // Quantise PNG output to an 8-bit palette, using Quality
+	Compression       int               // PNG compression level, 1 (fastest) to 9 (smallest). 0 uses the encoder default
+	Width             int               // Exact output width. Used with Height or AspectRatio to crop the image
+	Height            int               // Exact output height, cropping the image to Width x Height
+	AspectRatio       string            // Output aspect ratio, e.g. 16:9, cropping the image. Sets Height from Width
+	Crop              CropMode          // How to choose the area kept when cropping
+	FocalPoint        *FocalPoint       // Point to centre crops on, used by the focal crop mode. Defaults to the centre
+	CropBox           *CropBox          // Area of the source image to keep, before resizing and cropping
+	DPR               []float64         // Device pixel ratios to output. Treats the width as a display width, e.g. [1, 2, 3]
+	Metadata          MetadataPolicy    // Which EXIF, XMP and IPTC metadata to keep from the source image
+	ColourProfile     ColourPolicy      // How to handle the source image's ICC colour profile
+	ICCProfile        string            // Path to an ICC profile to convert to and embed, with the embed colour policy. Defaults to sRGB
+
+	// Choose Quality by searching for the lowest setting whose output meets an SSIM or butteraugli target
+	TargetQuality *TargetQualityConfiguration
+
+	// Set on the ImageConfigurations expanded from a DPR list
+	density       float64
+	displayWidth  int
+	displayHeight int
+
+	duplicate bool // Set on expanded ImageConfigurations with the same output as an earlier one, which jobs skip
+
+	measured *QualityScore // Set on the copy of a target-quality ImageConfiguration with the Quality chosen
 }
 
 func (i *ImageConfiguration) Validate() error {
-	if i.Quality > 100 || i.Quality <= 0 {
+	// Quality is unused by lossless encoders, and chosen by target-quality searches, so may be omitted
+	if i.Quality > 100 || i.Quality < 0 || (i.Quality == 0 && !i.IsLossless() && i.TargetQuality == nil) {
 		return fmt.Errorf("image quality should be between 0 and 100 (%d)", i.Quality)
 	}
 
@@ -46,6 +105,179 @@ func (i *ImageConfiguration) Validate() error {
 	if i.FileType.GetMediaType() == Unknown {
 		return fmt.Errorf("unknown media type '%s'", i.FileType)
 	}
+	if i.FileType == GIF {
+		return fmt.Errorf("gif can only be used for animated video previews")
+	}
+
+	if err := i.validateCrop(); err != nil {
+		return err
+	}
+
+	for _, dpr := range i.DPR {
+		if dpr <= 0 {
+			return fmt.Errorf("device pixel ratios should be greater than 0 (%g)", dpr)
+		}
+	}
+
+	// Validate and apply defaults for format-specific encoder settings
+	switch i.FileType {
+	case AVIF:
+		if i.Speed == 0 {
+			i.Speed = defaultAvifSpeed
+		}
+		if i.Speed < 0 || i.Speed > 9 {
+			return fmt.Errorf("avif speed should be between 1 and 9 (%d)", i.Speed)
+		}
+	case JXL:
+		if i.Effort == 0 {
+			i.Effort = defaultJxlEffort
+		}
+		if i.Effort < 0 || i.Effort > 9 {
+			return fmt.Errorf("jxl effort should be between 1 and 9 (%d)", i.Effort)
+		}
+		// Target-quality searches derive the distance from each Quality they try
+		if i.Distance == 0 && !i.Lossless && i.TargetQuality == nil {
+			i.Distance = jxlDistanceFromQuality(i.Quality)
+		}
+		if i.Distance < 0 || i.Distance > 25 {
+			return fmt.Errorf("jxl distance should be between 0 and 25 (%g)", i.Distance)
+		}
+	case PNG:
+		if i.Compression == 0 {
+			i.Compression = defaultPngCompression
+		}
+		if i.Compression < 0 || i.Compression > 9 {
+			return fmt.Errorf("png compression should be between 1 and 9 (%d)", i.Compression)
+		}
+	}
+	if i.Speed != 0 && i.FileType != AVIF {
+		return fmt.Errorf("speed can only be set for avif images (%s)", i.FileType)
+	}
+	if (i.Effort != 0 || i.Distance != 0 || i.LosslessJPEG) && i.FileType != JXL {
+		return fmt.Errorf("effort, distance and losslessjpeg can only be set for jxl images (%s)", i.FileType)
+	}
+	if (i.Palette || i.Compression != 0) && i.FileType != PNG {
+		return fmt.Errorf("palette and compression can only be set for png images (%s)", i.FileType)
+	}
+	if i.Lossless && i.FileType != WebP && i.FileType != AVIF && i.FileType != JXL {
+		return fmt.Errorf("lossless can only be set for webp, avif and jxl images (%s)", i.FileType)
+	}
+
+	if i.TargetQuality != nil {
+		if i.IsLossless() || i.FileType == PNG {
+			return fmt.Errorf("targetquality can only be set for lossy jpg, webp, avif and jxl images (%s)", i.FileType)
+		}
+		if i.Distance != 0 {
+			return fmt.Errorf("distance and targetquality cannot both be set")
+		}
+		if err := i.TargetQuality.Validate(Image); err != nil {
+			return err
+		}
+	}
+
+	// Apply default metadata policy
+	if i.Metadata == "" {
+		i.Metadata = MetadataStrip
+	}
+	if err := i.Metadata.Validate(); err != nil {
+		return err
+	}
+
+	// Apply default colour policy
+	if i.ColourProfile == "" {
+		i.ColourProfile = ColourSRGB
+	}
+	if err := i.ColourProfile.Validate(); err != nil {
+		return err
+	}
+	if i.ICCProfile != "" {
+		if i.ColourProfile != ColourEmbed {
+			return fmt.Errorf("iccprofile can only be used with the '%s' colour profile policy", ColourEmbed)
+		}
+		if _, err := os.Stat(i.ICCProfile); err != nil {
+			return fmt.Errorf("unable to read icc profile: %s", err)
+		}
+	}
+
+	// Apply default chroma subsampling
+	if i.ChromaSubsampling == "" {
+		i.ChromaSubsampling = SubsampleAuto
+	}
+	if err := i.ChromaSubsampling.Validate(); err != nil {
+		return err
+	}
+	// Lossy WebP is always 4:2:0, and lossless images are never subsampled
+	if i.ChromaSubsampling != SubsampleAuto && i.FileType != JPG && i.FileType != AVIF {
+		return fmt.Errorf("chroma subsampling '%s' cannot be forced for %s; use '%s'", i.ChromaSubsampling, i.FileType, SubsampleAuto)
+	}
+	if i.ChromaSubsampling == Subsample420 && i.Lossless {
+		return fmt.Errorf("chroma subsampling '%s' cannot be used for lossless images", i.ChromaSubsampling)
+	}
+
+	return nil
+}
+
+// validateCrop validates the crop geometry of an ImageConfiguration, and resolves it to an exact
+// Width and Height. MaxWidth may be used in place of Width.
+func (i *ImageConfiguration) validateCrop() error {
+	if i.Width != 0 {
+		if i.MaxWidth != 0 && i.MaxWidth != i.Width {
+			return fmt.Errorf("width (%d) and maxwidth (%d) cannot both be set", i.Width, i.MaxWidth)
+		}
+		i.MaxWidth = i.Width
+	}
+
+	if i.AspectRatio != "" {
+		var w, h int
+		if _, err := fmt.Sscanf(i.AspectRatio, "%d:%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+			return fmt.Errorf("aspect ratio should be in the form 16:9 (%s)", i.AspectRatio)
+		}
+		if i.MaxWidth <= 0 {
+			return fmt.Errorf("aspectratio requires a width")
+		}
+		height := int(math.Round(float64(i.MaxWidth) * float64(h) / float64(w)))
+		if i.Height != 0 && i.Height != height {
+			return fmt.Errorf("height and aspectratio cannot both be set")
+		}
+		i.Height = height
+	}
+
+	if i.CropBox != nil {
+		if err := i.CropBox.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if i.Height == 0 {
+		if i.Crop != "" || i.FocalPoint != nil {
+			return fmt.Errorf("crop and focalpoint require height or aspectratio to be set")
+		}
+		return nil
+	}
+
+	i.Width = i.MaxWidth
+	if i.Width <= 0 || i.Height <= 0 {
+		return fmt.Errorf("cropped images require a width and height (%dx%d)", i.Width, i.Height)
+	}
+
+	// Apply default crop mode
+	if i.Crop == "" {
+		i.Crop = CropCentre
+	}
+	if err := i.Crop.Validate(); err != nil {
+		return err
+	}
+	if i.Crop == CropFocal {
+		// Focal points may be set per-image by sidecar files, so fall back to the centre
+		if i.FocalPoint == nil {
+			i.FocalPoint = &FocalPoint{X: 0.5, Y: 0.5}
+		}
+		if err := i.FocalPoint.Validate(); err != nil {
+			return err
+		}
+	} else if i.FocalPoint != nil {
+		return fmt.Errorf("focalpoint can only be used with the '%s' crop mode", CropFocal)
+	}
 
 	return nil
 }
@@ -53,27 +285,194 @@ func (i *ImageConfiguration) Validate() error {
 func (i *ImageConfiguration) OutputFileSuffix(debugFilename bool) string {
 	if debugFilename {
 		return fmt.Sprintf(
-			"-%d-q%d.%s",
-			i.MaxWidth, i.Quality, string(i.FileType),
+			"-%s%s.%s",
+			i.dimensions(), i.encoderSettings(), string(i.FileType),
 		)
 	}
 
-	return fmt.Sprintf("x%d.%s", i.MaxWidth, string(i.FileType))
+	return fmt.Sprintf("x%s.%s", i.dimensions(), string(i.FileType))
+}
+
+// Density returns the device pixel ratio an ImageConfiguration was expanded for, or 0 if it
+// wasn't expanded from a DPR list
+func (i *ImageConfiguration) Density() float64 {
+	return i.density
+}
+
+// IsCropped returns true if an ImageConfiguration crops images to a fixed size
+func (i *ImageConfiguration) IsCropped() bool {
+	return i.Height != 0
+}
+
+// cropFocalPoint returns the FocalPoint relative to the area of the image left by the CropBox
+func (i *ImageConfiguration) cropFocalPoint() *FocalPoint {
+	if i.CropBox == nil {
+		return i.FocalPoint
+	}
+	return i.CropBox.relativeFocalPoint(i.FocalPoint)
+}
+
+// dimensions describes the output size of an ImageConfiguration, for filenames.
+// e.g. 500, or 400x300-attention for cropped images. Expanded DPR variants use their display
+// size and density, e.g. 400w@2x or 400x300-attention@2x
+func (i *ImageConfiguration) dimensions() string {
+	if i.density != 0 && i.IsCropped() {
+		return fmt.Sprintf("%dx%d-%s@%gx", i.displayWidth, i.displayHeight, i.Crop, i.density)
+	}
+	if i.density != 0 {
+		return fmt.Sprintf("%dw@%gx", i.displayWidth, i.density)
+	}
+	if i.IsCropped() {
+		return fmt.Sprintf("%dx%d-%s", i.Width, i.Height, i.Crop)
+	}
+	return fmt.Sprintf("%d", i.MaxWidth)
+}
+
+// IsLossless returns true if an ImageConfiguration produces lossless output.
+// Palette PNGs are lossy, as they're quantised using Quality.
+func (i *ImageConfiguration) IsLossless() bool {
+	return i.Lossless || (i.FileType == PNG && !i.Palette)
+}
+
+// encoderSettings summarises the encoder settings of an ImageConfiguration, for debug filenames.
+// e.g. -q80-s5
+func (i *ImageConfiguration) encoderSettings() (settings string) {
+	switch {
+	case i.FileType == PNG && i.Palette:
+		settings = fmt.Sprintf("-q%d-palette", i.Quality)
+	case i.FileType == PNG:
+	case i.Lossless:
+		settings = "-lossless"
+	case i.TargetQuality != nil:
+		settings = "-" + i.TargetQuality.String()
+	default:
+		settings = fmt.Sprintf("-q%d", i.Quality)
+	}
+
+	switch i.FileType {
+	case PNG:
+		settings += fmt.Sprintf("-c%d", i.Compression)
+	case AVIF:
+		settings += fmt.Sprintf("-s%d", i.Speed)
+	case JXL:
+		settings += fmt.Sprintf("-e%d", i.Effort)
+		if !i.Lossless && i.TargetQuality == nil {
+			settings += fmt.Sprintf("-d%g", i.Distance)
+		}
+	}
+
+	return settings
+}
+
+// ExpandImageConfigurations validates a list of ImageConfigurations, and expands any with a DPR
+// list into one ImageConfiguration per density. Configurations which would produce the same
+// output as an earlier one are marked as duplicates, so that jobs record them as skipped.
+func ExpandImageConfigurations(imageConfigs []*ImageConfiguration) (expanded []*ImageConfiguration, err error) {
+	seen := make(map[string]bool)
+
+	for _, c := range imageConfigs {
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+
+		for _, variant := range c.expandDPR() {
+			if err := variant.Validate(); err != nil {
+				return nil, err
+			}
+
+			key := variant.outputKey()
+			if seen[key] {
+				fmt.Printf("Skipping image configuration %s, which duplicates an earlier configuration\n", variant.OutputFileSuffix(false))
+				variant.duplicate = true
+			}
+			seen[key] = true
+
+			expanded = append(expanded, variant)
+		}
+	}
+
+	return expanded, nil
+}
+
+// expandDPR returns a copy of an ImageConfiguration for each of its device pixel ratios, with
+// its width and height scaled to match
+func (i *ImageConfiguration) expandDPR() (variants []*ImageConfiguration) {
+	if len(i.DPR) == 0 {
+		return []*ImageConfiguration{i}
+	}
+
+	for _, dpr := range i.DPR {
+		variant := *i
+		variant.DPR = nil
+		variant.density = dpr
+		variant.displayWidth = i.MaxWidth
+		variant.displayHeight = i.Height
+
+		variant.MaxWidth = int(math.Round(float64(i.MaxWidth) * dpr))
+		if i.Width != 0 {
+			variant.Width = variant.MaxWidth
+		}
+		if i.AspectRatio != "" {
+			variant.Height = 0 // Recalculated from the aspect ratio by Validate
+		} else {
+			variant.Height = int(math.Round(float64(i.Height) * dpr))
+		}
+
+		variants = append(variants, &variant)
+	}
+
+	return
+}
+
+// outputKey identifies the output of an ImageConfiguration, ignoring its filename, so that
+// duplicate configurations can be detected
+func (i *ImageConfiguration) outputKey() string {
+	key := fmt.Sprintf("%s-%d-%d-%s%s-%s-%t-%s-%s%s", i.FileType, i.MaxWidth, i.Height, i.Crop, i.encoderSettings(), i.ChromaSubsampling, i.LosslessJPEG, i.Metadata, i.ColourProfile, i.ICCProfile)
+	if i.FocalPoint != nil {
+		key += fmt.Sprintf("-focal%+v", *i.FocalPoint)
+	}
+	if i.CropBox != nil {
+		key += fmt.Sprintf("-box%+v", *i.CropBox)
+	}
+	return key
 }
 
 // VideoConfiguration describes output size, quality, format, and other information for an encoded
 // output video file
 type VideoConfiguration struct {
-	MaxWidth int
-	Quality  int
-	Preset   string
-	FileType FileOutputType
-	Codec    VideoCodec
+	MaxWidth        int
+	Quality         int
+	Preset          string // Encoder speed preset, e.g. 'slow' for x264 and x265, or 0-13 for svtav1. See defaultEncoderPreset
+	FileType        FileOutputType
+	Codec           VideoCodec
+	Encoder         VideoEncoder            // Encoder, or x265 settings profile, used for the codec. Defaults to the codec's usual encoder
+	FilmGrain       int                     // SVT-AV1 film grain synthesis level, 1 to 50. 0 disables it
+	SegmentDuration int                     // Target segment length in seconds, for cmaf output. Defaults to 6
+	Audio           *AudioConfiguration     // How the video's audio is encoded. Defaults to the container's usual codec
+	Thumbnail       *ThumbnailConfiguration // Which frames are output, for image outputs. Defaults to the first frame
+	Preview         *PreviewConfiguration   // Output an animated preview rather than a thumbnail, for webp, avif and gif outputs
+	Sprite          *SpriteConfiguration    // Output scrubbing sprite sheets and a WebVTT track rather than a thumbnail
+
+	// Choose Quality, the CRF, by searching for the highest whose output meets a VMAF target
+	TargetQuality *TargetQualityConfiguration
+
+	measured *QualityScore // Set on the copy of a target-quality VideoConfiguration with the CRF chosen
 }
 
 // Validate validates a VideoConfiguration
 func (v *VideoConfiguration) Validate() error {
-	if v.Quality <= 0 || v.Quality > 100 {
+	switch v.FileType {
+	case M3U8, MPD:
+		return fmt.Errorf("'%s' manifests are written by HLS and cmaf output, and can't be configured directly", v.FileType)
+	}
+	return v.validate()
+}
+
+// validate validates a VideoConfiguration, including HLS renditions, which are given the m3u8
+// FileType by their HLSConfiguration
+func (v *VideoConfiguration) validate() error {
+	// Quality may be omitted when it's chosen by a target-quality search
+	if v.Quality > 100 || v.Quality < 0 || (v.Quality == 0 && v.TargetQuality == nil) {
 		return fmt.Errorf("video quality should be between 0 and 100")
 	}
 
@@ -82,12 +481,64 @@ func (v *VideoConfiguration) Validate() error {
 		v.FileType = validCodecContainer[v.Codec]
 	}
 
+	if v.FileType == CMAF {
+		if v.SegmentDuration == 0 {
+			v.SegmentDuration = 6
+		}
+		if v.SegmentDuration < 0 {
+			return fmt.Errorf("segment duration should be positive")
+		}
+	}
+
 	switch v.FileType.GetMediaType() {
 	case Unknown:
 		return fmt.Errorf("unknown media filetype '%s'", v.FileType)
 	case Image:
 		// TODO: Validate as an ImageConfiguration
+		if v.TargetQuality != nil {
+			return fmt.Errorf("targetquality can only be used with video outputs, not '%s'", v.FileType)
+		}
+		outputKinds := 0
+		for _, set := range []bool{v.Thumbnail != nil, v.Preview != nil, v.Sprite != nil} {
+			if set {
+				outputKinds++
+			}
+		}
+		if outputKinds > 1 {
+			return fmt.Errorf("video outputs can only have one of thumbnail, preview or sprite settings")
+		}
+		if v.FileType == GIF && v.Sprite == nil && v.Preview == nil {
+			v.Preview = &PreviewConfiguration{}
+		}
+
+		switch {
+		case v.Preview != nil:
+			if !previewFileTypes[v.FileType] {
+				return fmt.Errorf("animated previews can only be output as webp, avif or gif, not '%s'", v.FileType)
+			}
+			if err := v.Preview.Validate(); err != nil {
+				return err
+			}
+		case v.Sprite != nil:
+			if v.FileType == GIF {
+				return fmt.Errorf("sprite sheets can't be output as gif")
+			}
+			if err := v.Sprite.Validate(); err != nil {
+				return err
+			}
+		default:
+			if v.Thumbnail == nil {
+				v.Thumbnail = &ThumbnailConfiguration{}
+			}
+			if err := v.Thumbnail.Validate(); err != nil {
+				return err
+			}
+		}
 	case Video:
+		if v.Thumbnail != nil || v.Preview != nil || v.Sprite != nil {
+			return fmt.Errorf("thumbnail, preview and sprite settings can only be used with image outputs, not '%s'", v.FileType)
+		}
+
 		// Apply default codec
 		if v.Codec == "" {
 			v.Codec = defaultFiletypeCodec[v.FileType]
@@ -98,13 +549,35 @@ func (v *VideoConfiguration) Validate() error {
 			return err
 		}
 
-		// Validate codec-container pairing
-		if validCodecContainer[v.Codec] != v.FileType {
-			return fmt.Errorf("codec '%s' cannot be used with container '%s' (use %s)", v.Codec, v.FileType, validCodecContainer[v.Codec])
+		// Validate codec-container pairing. HLS renditions' codecs depend on their segment type,
+		// which is checked by their HLSConfiguration
+		if v.FileType != M3U8 && validCodecContainer[v.Codec] != v.FileType && validCodecSegmentedContainer[v.Codec] != v.FileType {
+			return fmt.Errorf(
+				"codec '%s' cannot be used with container '%s' (use %s, or %s for segmented output)",
+				v.Codec, v.FileType, validCodecContainer[v.Codec], validCodecSegmentedContainer[v.Codec],
+			)
+		}
+
+		if err := v.validateEncoder(); err != nil {
+			return err
 		}
 
-		if v.Codec == H264 && v.Preset == "" {
-			v.Preset = "slow"
+		if v.Audio == nil {
+			v.Audio = &AudioConfiguration{}
+		}
+		if err := v.Audio.Validate(v.FileType); err != nil {
+			return err
+		}
+
+		if v.TargetQuality != nil {
+			// The renditions of a cmaf ladder are encoded together, and HLS renditions are segmented
+			// as they're encoded, so neither can be searched separately
+			if v.FileType == CMAF || v.FileType == M3U8 {
+				return fmt.Errorf("targetquality cannot be used with cmaf or HLS output")
+			}
+			if err := v.TargetQuality.Validate(Video); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -116,20 +589,130 @@ func (v *VideoConfiguration) Validate() error {
 	return nil
 }
 
+// ValidateVideoConfigurations validates a list of VideoConfigurations. The cmaf configurations
+// are output together as a single ladder, so must share a segment duration and audio settings,
+// and differ in width or codec.
+func ValidateVideoConfigurations(configs []*VideoConfiguration) error {
+	segmentDuration := 0
+	var audio *AudioConfiguration
+	renditions := make(map[string]bool)
+	for _, c := range configs {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+		if c.FileType != CMAF {
+			continue
+		}
+
+		if segmentDuration != 0 && c.SegmentDuration != segmentDuration {
+			return fmt.Errorf("cmaf configurations should have the same segment duration")
+		}
+		segmentDuration = c.SegmentDuration
+
+		// The audio track is shared by every rendition
+		if audio != nil && *c.Audio != *audio {
+			return fmt.Errorf("cmaf configurations should have the same audio settings")
+		}
+		audio = c.Audio
+
+		if renditions[c.outputKey()] {
+			return fmt.Errorf("cmaf configurations should differ in width or codec")
+		}
+		renditions[c.outputKey()] = true
+	}
+
+	return nil
+}
+
+// HLSConfiguration describes an HLS adaptive streaming ladder. Each rendition is segmented
+// separately, with keyframes aligned across renditions, and listed in a master playlist.
+type HLSConfiguration struct {
+	SegmentType     HLSSegmentType
+	SegmentDuration int                   // Target segment length in seconds. Shorter segments start playing sooner
+	Renditions      []*VideoConfiguration // FileType is ignored; renditions are always segmented
+}
+
+// Validate validates an HLSConfiguration, applying defaults
+func (h *HLSConfiguration) Validate() error {
+	if h.SegmentType == "" {
+		h.SegmentType = HLSfMP4
+	}
+	if err := h.SegmentType.Validate(); err != nil {
+		return err
+	}
+
+	if h.SegmentDuration == 0 {
+		h.SegmentDuration = 6
+	}
+	if h.SegmentDuration < 0 {
+		return fmt.Errorf("HLS segment duration should be positive")
+	}
+
+	if len(h.Renditions) == 0 {
+		return fmt.Errorf("HLS requires at least one rendition")
+	}
+	renditions := make(map[string]bool)
+	for _, r := range h.Renditions {
+		r.FileType = M3U8
+		if err := r.validate(); err != nil {
+			return err
+		}
+		if r.MaxWidth <= 0 {
+			return fmt.Errorf("HLS renditions should have a positive width (%d)", r.MaxWidth)
+		}
+		if !h.SegmentType.SupportsCodec(r.Codec) {
+			return fmt.Errorf("codec '%s' cannot be used with HLS segment type '%s'", r.Codec, h.SegmentType)
+		}
+
+		if renditions[r.outputKey()] {
+			return fmt.Errorf("HLS renditions should differ in width or codec")
+		}
+		renditions[r.outputKey()] = true
+	}
+
+	return nil
+}
+
 func (v *VideoConfiguration) OutputFileSuffix(debugFilename bool) string {
+	if v.Preview != nil {
+		return fmt.Sprintf("-preview.%s", v.FileType)
+	}
+	if v.Sprite != nil {
+		return fmt.Sprintf("-sprite.%s", v.FileType)
+	}
 	if v.FileType.GetMediaType() == Image {
 		return fmt.Sprintf(".%s", v.FileType)
 	}
 
 	if debugFilename {
+		var filmGrain string
+		if v.FilmGrain != 0 {
+			filmGrain = fmt.Sprintf("-g%d", v.FilmGrain)
+		}
+		var audio string
+		if v.Audio != nil {
+			audio = fmt.Sprintf("-a%s", v.Audio.Codec)
+			if v.Audio.Codec != AudioNone {
+				audio += fmt.Sprintf("%d", v.Audio.Bitrate)
+			}
+		}
 		return fmt.Sprintf(
-			"-%d-q%d-p%s.%s.%s",
-			v.MaxWidth, v.Quality, v.Preset, v.Codec, v.FileType,
+			"-%d-%s-p%s%s%s-%s.%s.%s",
+			v.MaxWidth, v.qualitySetting(), v.Preset, filmGrain, audio, v.Encoder, v.Codec, v.FileType,
 		)
 	}
 	return fmt.Sprintf("-%d.%s", v.MaxWidth, string(v.FileType))
 }
 
+// qualitySetting describes the quality of a VideoConfiguration, for debug filenames. e.g. q23,
+// or vmaf93 for target-quality searches, so that the chosen CRF doesn't change the filename
+func (v *VideoConfiguration) qualitySetting() string {
+	if v.TargetQuality != nil {
+		return v.TargetQuality.String()
+	}
+	return fmt.Sprintf("q%d", v.Quality)
+}
+
 // FileOutputType is the file extension of the output media file.
 // For images, this represents the image format.
 // For videos, this represents the container format.
@@ -137,9 +720,17 @@ type FileOutputType string
 
 const (
 	JPG  FileOutputType = "jpg"
+	PNG  FileOutputType = "png"
 	WebP FileOutputType = "webp"
+	AVIF FileOutputType = "avif"
+	JXL  FileOutputType = "jxl"
+	GIF  FileOutputType = "gif" // Only used for animated video previews
+	VTT  FileOutputType = "vtt" // WebVTT thumbnail track, written with sprite sheets
 	MP4  FileOutputType = "mp4"
 	WebM FileOutputType = "webm"
+	CMAF FileOutputType = "cmaf" // Segmented video, listed in DASH and HLS manifests
+	M3U8 FileOutputType = "m3u8" // HLS master playlist
+	MPD  FileOutputType = "mpd"  // DASH manifest
 )
 
 // This *works*, but is a bit ugly. What if a new FileOutputType is added which doesn't have a type?
@@ -147,15 +738,245 @@ const (
 // GetMediaType returns the MediaType of a given FileOutputType
 func (f FileOutputType) GetMediaType() MediaType {
 	switch f {
-	case JPG, WebP:
+	case JPG, PNG, WebP, AVIF, JXL, GIF:
 		return Image
-	case MP4, WebM:
+	case MP4, WebM, CMAF, M3U8, MPD:
 		return Video
 	default:
 		return Unknown
 	}
 }
 
+// ChromaSubsampling is the chroma subsampling mode used when encoding an image
+type ChromaSubsampling string
+
+const (
+	SubsampleAuto ChromaSubsampling = "auto" // Let the encoder decide
+	Subsample420  ChromaSubsampling = "420"  // Always subsample chroma (4:2:0)
+	Subsample444  ChromaSubsampling = "444"  // Never subsample chroma (4:4:4)
+)
+
+func (c ChromaSubsampling) Validate() error {
+	switch c {
+	case SubsampleAuto, Subsample420, Subsample444:
+		return nil
+	default:
+		return fmt.Errorf("unknown chroma subsampling mode '%s'", c)
+	}
+}
+
+// CropMode selects which area of an image is kept when cropping it to a fixed aspect ratio
+type CropMode string
+
+const (
+	CropCentre    CropMode = "centre"    // Keep the centre of the image
+	CropAttention CropMode = "attention" // Keep the area most likely to draw attention - skin tones, saturated colours, edges
+	CropEntropy   CropMode = "entropy"   // Keep the area with the most detail
+	CropFocal     CropMode = "focal"     // Centre the crop on a FocalPoint, as far as the image bounds allow
+)
+
+func (c CropMode) Validate() error {
+	switch c {
+	case CropCentre, CropAttention, CropEntropy, CropFocal:
+		return nil
+	default:
+		return fmt.Errorf("unknown crop mode '%s'", c)
+	}
+}
+
+// FocalPoint is a point of interest in an image, as fractions of its width and height measured
+// from the top left corner. {0.5, 0.5} is the centre of the image.
+type FocalPoint struct {
+	X float64
+	Y float64
+}
+
+func (f *FocalPoint) Validate() error {
+	if f.X < 0 || f.X > 1 || f.Y < 0 || f.Y > 1 {
+		return fmt.Errorf("focal point coordinates should be between 0 and 1 (%g, %g)", f.X, f.Y)
+	}
+	return nil
+}
+
+// CropBox is an area of an image, as fractions of its width and height measured from the top
+// left corner. {0, 0, 1, 1} is the whole image.
+type CropBox struct {
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+}
+
+func (b *CropBox) Validate() error {
+	if b.X < 0 || b.Y < 0 || b.Width <= 0 || b.Height <= 0 || b.X+b.Width > 1 || b.Y+b.Height > 1 {
+		return fmt.Errorf("crop box should lie within the image, with coordinates between 0 and 1 (%+v)", *b)
+	}
+	return nil
+}
+
+// Rect returns the pixel bounds of the CropBox, within an image of the given size
+func (b *CropBox) Rect(imgWidth int, imgHeight int) (left int, top int, width int, height int) {
+	left = int(math.Round(b.X * float64(imgWidth)))
+	top = int(math.Round(b.Y * float64(imgHeight)))
+	width = int(math.Min(math.Round(b.Width*float64(imgWidth)), float64(imgWidth-left)))
+	height = int(math.Min(math.Round(b.Height*float64(imgHeight)), float64(imgHeight-top)))
+	return
+}
+
+// relativeFocalPoint converts a focal point within the whole image to one within the CropBox
+func (b *CropBox) relativeFocalPoint(f *FocalPoint) *FocalPoint {
+	return &FocalPoint{
+		X: math.Max(0, math.Min(1, (f.X-b.X)/b.Width)),
+		Y: math.Max(0, math.Min(1, (f.Y-b.Y)/b.Height)),
+	}
+}
+
+// focalCropOffset returns the offset of a crop of length cropLen within a length of srcLen, so
+// that the crop is centred on the focal point as far as possible
+func focalCropOffset(srcLen int, cropLen int, focal float64) int {
+	offset := int(math.Round(focal*float64(srcLen) - float64(cropLen)/2))
+	if offset < 0 {
+		return 0
+	}
+	if offset > srcLen-cropLen {
+		return srcLen - cropLen
+	}
+	return offset
+}
+
+// CheckBooleanKeys returns an error if settings read from YAML have a key which YAML reads as a
+// boolean, e.g. an unquoted Y in a FocalPoint, as the setting would otherwise be silently ignored
+func CheckBooleanKeys(settings interface{}) error {
+	switch s := settings.(type) {
+	case map[string]interface{}:
+		for key, value := range s {
+			if key == "true" || key == "false" {
+				return fmt.Errorf("a key was read as '%s'; quote keys such as Y, e.g. 'Y': 0.5", key)
+			}
+			if err := CheckBooleanKeys(value); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for key, value := range s {
+			if _, ok := key.(bool); ok {
+				return fmt.Errorf("a key was read as '%t'; quote keys such as Y, e.g. 'Y': 0.5", key)
+			}
+			if err := CheckBooleanKeys(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, value := range s {
+			if err := CheckBooleanKeys(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MetadataPolicy selects which metadata is kept from the source image when encoding an image
+type MetadataPolicy string
+
+const (
+	MetadataStrip     MetadataPolicy = "strip"     // Remove all metadata
+	MetadataCopyright MetadataPolicy = "copyright" // Keep only the EXIF copyright and artist, for attribution
+	MetadataNoGPS     MetadataPolicy = "nogps"     // Keep all metadata except GPS location, which also removes XMP
+)
+
+func (p MetadataPolicy) Validate() error {
+	switch p {
+	case MetadataStrip, MetadataCopyright, MetadataNoGPS:
+		return nil
+	default:
+		return fmt.Errorf("unknown metadata policy '%s'", p)
+	}
+}
+
+// ColourPolicy selects how an image's ICC colour profile is handled when encoding it.
+// Images without an embedded profile are assumed to be sRGB.
+type ColourPolicy string
+
+const (
+	ColourSRGB  ColourPolicy = "srgb"  // Convert to sRGB, which browsers assume for untagged images, and don't embed a profile
+	ColourKeep  ColourPolicy = "keep"  // Keep the source colours and embed the source profile
+	ColourEmbed ColourPolicy = "embed" // Convert to the configured ICCProfile, and embed it
+)
+
+func (c ColourPolicy) Validate() error {
+	switch c {
+	case ColourSRGB, ColourKeep, ColourEmbed:
+		return nil
+	default:
+		return fmt.Errorf("unknown colour profile policy '%s'", c)
+	}
+}
+
+// RawDecoder selects how camera RAW images are decoded before being resized
+type RawDecoder string
+
+const (
+	RawPreview  RawDecoder = "preview"  // Use the JPEG preview embedded by the camera. Fast, and matches the camera's processing
+	RawDemosaic RawDecoder = "demosaic" // Demosaic the sensor data, using the camera's white balance. Slow, but full resolution
+)
+
+func (r RawDecoder) Validate() error {
+	switch r {
+	case RawPreview, RawDemosaic:
+		return nil
+	default:
+		return fmt.Errorf("unknown raw decoder '%s'", r)
+	}
+}
+
+// UpscalePolicy selects what happens to output variants which are larger than their source
+type UpscalePolicy string
+
+const (
+	UpscaleAllow UpscalePolicy = "allow" // Upscale the source to the configured size
+	UpscaleSkip  UpscalePolicy = "skip"  // Don't output the variant
+	UpscaleClamp UpscalePolicy = "clamp" // Output the variant at the source size, unless another variant already has that output
+)
+
+func (u UpscalePolicy) Validate() error {
+	switch u {
+	case UpscaleAllow, UpscaleSkip, UpscaleClamp:
+		return nil
+	default:
+		return fmt.Errorf("unknown upscale policy '%s'", u)
+	}
+}
+
+// HLSSegmentType selects the container used for HLS segments
+type HLSSegmentType string
+
+const (
+	HLSfMP4 HLSSegmentType = "fmp4" // Fragmented MP4. Supports H.264, H.265 and AV1
+	HLSTS   HLSSegmentType = "ts"   // MPEG-TS, for older players. Supports H.264 only
+)
+
+func (h HLSSegmentType) Validate() error {
+	switch h {
+	case HLSfMP4, HLSTS:
+		return nil
+	default:
+		return fmt.Errorf("unknown HLS segment type '%s'", h)
+	}
+}
+
+// SupportsCodec reports whether a codec can be used in HLS segments of this type
+func (h HLSSegmentType) SupportsCodec(c VideoCodec) bool {
+	switch h {
+	case HLSfMP4:
+		return c == H264 || c == H265 || c == AV1
+	case HLSTS:
+		return c == H264
+	default:
+		return false
+	}
+}
+
 // VideoCodec represents the codec used to encode a video file, as part of a VideoConfiguration
 type VideoCodec string
 
@@ -175,6 +996,401 @@ func (c VideoCodec) Validate() error {
 	}
 }
 
+// VideoEncoder selects the encoder used for a VideoCodec. x265 also has settings profiles, which
+// tune it for different kinds of source video.
+type VideoEncoder string
+
+const (
+	EncoderX264          VideoEncoder = "x264"
+	EncoderX265          VideoEncoder = "x265"
+	EncoderX265Grain     VideoEncoder = "x265-grain"     // Retains film grain, rather than smoothing it away
+	EncoderX265Animation VideoEncoder = "x265-animation" // Suits the flat areas and sharp edges of animation
+	EncoderVPX           VideoEncoder = "vpx"
+	EncoderAOM           VideoEncoder = "aom"    // The reference AV1 encoder. Very slow, even at its fastest preset
+	EncoderSVTAV1        VideoEncoder = "svtav1" // Far faster than aom at similar quality, and supports film grain synthesis
+	EncoderRav1e         VideoEncoder = "rav1e"
+)
+
+// videoEncoderCodec maps the codec produced by each encoder
+var videoEncoderCodec = map[VideoEncoder]VideoCodec{
+	EncoderX264:          H264,
+	EncoderX265:          H265,
+	EncoderX265Grain:     H265,
+	EncoderX265Animation: H265,
+	EncoderVPX:           VP9,
+	EncoderAOM:           AV1,
+	EncoderSVTAV1:        AV1,
+	EncoderRav1e:         AV1,
+}
+
+// defaultCodecEncoder maps the default encoder for each codec
+var defaultCodecEncoder = map[VideoCodec]VideoEncoder{
+	H264: EncoderX264,
+	H265: EncoderX265,
+	VP9:  EncoderVPX,
+	AV1:  EncoderAOM,
+}
+
+// defaultEncoderPreset maps the default preset for each encoder. x264 and x265 use named presets,
+// and the AV1 encoders numbered presets, where higher numbers are faster: aom's cpu-used, 0 to 8,
+// svtav1's preset, 0 to 13, and rav1e's speed, 0 to 10.
+var defaultEncoderPreset = map[VideoEncoder]string{
+	EncoderX264:          "slow",
+	EncoderX265:          "slow",
+	EncoderX265Grain:     "slow",
+	EncoderX265Animation: "slow",
+	EncoderAOM:           "8",
+	EncoderSVTAV1:        "8",
+	EncoderRav1e:         "6",
+}
+
+// numberedPresetMax maps the fastest preset of each encoder with numbered presets
+var numberedPresetMax = map[VideoEncoder]int{
+	EncoderAOM:    8,
+	EncoderSVTAV1: 13,
+	EncoderRav1e:  10,
+}
+
+// namedPresets are the presets accepted by x264 and x265
+var namedPresets = map[string]bool{
+	"ultrafast": true, "superfast": true, "veryfast": true, "faster": true, "fast": true,
+	"medium": true, "slow": true, "slower": true, "veryslow": true, "placebo": true,
+}
+
+// validateEncoder applies the default encoder for a VideoConfiguration's codec, and its default
+// preset, then checks that the encoder produces the codec and accepts its settings
+func (v *VideoConfiguration) validateEncoder() error {
+	if v.Encoder == "" {
+		v.Encoder = defaultCodecEncoder[v.Codec]
+	}
+	codec, ok := videoEncoderCodec[v.Encoder]
+	if !ok {
+		return fmt.Errorf("unknown video encoder '%s'", v.Encoder)
+	}
+	if codec != v.Codec {
+		return fmt.Errorf("encoder '%s' produces %s video, so can't be used with codec '%s'", v.Encoder, codec, v.Codec)
+	}
+
+	if v.Preset == "" {
+		v.Preset = defaultEncoderPreset[v.Encoder]
+	}
+	if fastest, ok := numberedPresetMax[v.Encoder]; ok {
+		if preset, err := strconv.Atoi(v.Preset); err != nil || preset < 0 || preset > fastest {
+			return fmt.Errorf("%s preset should be between 0 and %d", v.Encoder, fastest)
+		}
+	} else if codec == H264 || codec == H265 {
+		if !namedPresets[v.Preset] {
+			return fmt.Errorf("unknown %s preset '%s'", v.Encoder, v.Preset)
+		}
+	}
+
+	if v.FilmGrain != 0 && v.Encoder != EncoderSVTAV1 {
+		return fmt.Errorf("film grain synthesis is only supported by the svtav1 encoder")
+	}
+	if v.FilmGrain < 0 || v.FilmGrain > 50 {
+		return fmt.Errorf("film grain level should be between 1 and 50")
+	}
+
+	return nil
+}
+
+// AudioConfiguration describes how a video's audio is encoded
+type AudioConfiguration struct {
+	Codec      AudioCodec // Defaults to AAC for MP4 and segmented video, and Opus for WebM
+	Bitrate    int        // Bitrate in kbit/s. Defaults to 128
+	Channels   int        // Number of channels, e.g. 1 to downmix to mono. 0 keeps the source's channels
+	SampleRate int        // Sample rate in Hz. 0 keeps the source's, as far as the codec allows
+	Normalise  bool       // Normalise loudness to a consistent level, following EBU R128
+	Loudness   float64    // Target integrated loudness in LUFS, when normalising. Defaults to -23, the EBU R128 target
+}
+
+// Validate validates an AudioConfiguration for a video container, applying defaults
+func (a *AudioConfiguration) Validate(container FileOutputType) error {
+	if a.Codec == "" {
+		a.Codec = defaultContainerAudioCodec[container]
+	}
+	switch a.Codec {
+	case AudioNone:
+		return nil
+	case AAC:
+		if container == WebM {
+			return fmt.Errorf("audio codec 'aac' cannot be used with container 'webm' (use opus)")
+		}
+	case Opus:
+		if container == CMAF || container == M3U8 {
+			return fmt.Errorf("audio codec 'opus' cannot be used with segmented video (use aac)")
+		}
+		if a.SampleRate != 0 && !opusSampleRates[a.SampleRate] {
+			return fmt.Errorf("opus sample rate should be 8000, 12000, 16000, 24000 or 48000")
+		}
+	default:
+		return fmt.Errorf("unknown audio codec '%s'", a.Codec)
+	}
+
+	if a.Bitrate == 0 {
+		a.Bitrate = 128
+	}
+	if a.Bitrate < 8 || a.Bitrate > 512 {
+		return fmt.Errorf("audio bitrate should be between 8 and 512 kbit/s")
+	}
+	if a.Channels < 0 || a.Channels > 8 {
+		return fmt.Errorf("audio channels should be between 1 and 8")
+	}
+	if a.SampleRate < 0 {
+		return fmt.Errorf("audio sample rate should be positive")
+	}
+
+	if a.Loudness != 0 && !a.Normalise {
+		return fmt.Errorf("audio loudness requires normalise to be enabled")
+	}
+	if a.Normalise && a.Loudness == 0 {
+		a.Loudness = -23
+	}
+	if a.Normalise && (a.Loudness < -70 || a.Loudness > -5) {
+		return fmt.Errorf("audio loudness should be between -70 and -5 LUFS")
+	}
+
+	return nil
+}
+
+// ThumbnailConfiguration describes which frames of a video are output as thumbnails
+type ThumbnailConfiguration struct {
+	Mode    ThumbnailMode
+	Time    float64 // Position of the frame in seconds, for the time mode
+	Percent float64 // Position of the frame as a percentage of the video's duration, for the percent mode
+	Count   int     // Number of evenly spaced frames, for the count mode
+}
+
+// Validate validates a ThumbnailConfiguration, applying defaults
+func (t *ThumbnailConfiguration) Validate() error {
+	if t.Mode == "" {
+		t.Mode = ThumbnailTime
+	}
+	switch t.Mode {
+	case ThumbnailTime:
+		if t.Time < 0 {
+			return fmt.Errorf("thumbnail time should be positive")
+		}
+	case ThumbnailPercent:
+		if t.Percent < 0 || t.Percent > 100 {
+			return fmt.Errorf("thumbnail percent should be between 0 and 100")
+		}
+	case ThumbnailCount:
+		if t.Count < 1 || t.Count > 100 {
+			return fmt.Errorf("thumbnail count should be between 1 and 100")
+		}
+	case ThumbnailScene, ThumbnailSharpness:
+	default:
+		return fmt.Errorf("unknown thumbnail mode '%s'", t.Mode)
+	}
+	return nil
+}
+
+// ThumbnailMode selects how the frames output as a video's thumbnails are chosen
+type ThumbnailMode string
+
+const (
+	ThumbnailTime      ThumbnailMode = "time"      // A fixed timestamp
+	ThumbnailPercent   ThumbnailMode = "percent"   // A percentage of the video's duration
+	ThumbnailCount     ThumbnailMode = "count"     // Evenly spaced frames, each output as a numbered thumbnail
+	ThumbnailScene     ThumbnailMode = "scene"     // The middle of the video's longest shot, found by scene change detection
+	ThumbnailSharpness ThumbnailMode = "sharpness" // The sharpest of several evenly spaced frames
+)
+
+// PreviewConfiguration describes a short, silent, looping animation cut from a video, e.g. for
+// hover previews. Several short clips can be sampled across the video and stitched together.
+type PreviewConfiguration struct {
+	Start     float64 // Position in seconds where the preview starts. Defaults to 0
+	Duration  float64 // Total length of the preview in seconds. Defaults to 3
+	FrameRate float64 // Frames per second. Defaults to 10
+	Segments  int     // Number of clips sampled evenly from Start to the end of the video. Defaults to 1
+}
+
+// Validate validates a PreviewConfiguration, applying defaults
+func (p *PreviewConfiguration) Validate() error {
+	if p.Duration == 0 {
+		p.Duration = 3
+	}
+	if p.FrameRate == 0 {
+		p.FrameRate = 10
+	}
+	if p.Segments == 0 {
+		p.Segments = 1
+	}
+
+	if p.Start < 0 {
+		return fmt.Errorf("preview start should be positive")
+	}
+	if p.Duration < 0 || p.Duration > 60 {
+		return fmt.Errorf("preview duration should be between 0 and 60 seconds")
+	}
+	if p.FrameRate < 0 || p.FrameRate > 60 {
+		return fmt.Errorf("preview frame rate should be between 0 and 60")
+	}
+	if p.Segments < 1 || p.Segments > 20 {
+		return fmt.Errorf("preview segments should be between 1 and 20")
+	}
+	return nil
+}
+
+// previewFileTypes are the formats which can store animated previews
+var previewFileTypes = map[FileOutputType]bool{WebP: true, AVIF: true, GIF: true}
+
+// SpriteConfiguration describes sprite sheets of a video's frames at a fixed interval, tiled in a
+// grid, with a WebVTT track mapping each part of the video to its tile. Players use them to show
+// previews while seeking. Each tile is MaxWidth wide.
+type SpriteConfiguration struct {
+	Interval float64 // Seconds between frames. Defaults to 5
+	Columns  int     // Tiles per row. Defaults to 10
+	Rows     int     // Maximum rows per sheet, with further frames continuing on another sheet. Defaults to 10
+}
+
+// Validate validates a SpriteConfiguration, applying defaults
+func (s *SpriteConfiguration) Validate() error {
+	if s.Interval == 0 {
+		s.Interval = 5
+	}
+	if s.Columns == 0 {
+		s.Columns = 10
+	}
+	if s.Rows == 0 {
+		s.Rows = 10
+	}
+
+	if s.Interval < 0.1 || s.Interval > 3600 {
+		return fmt.Errorf("sprite interval should be between 0.1 and 3600 seconds")
+	}
+	if s.Columns < 1 || s.Columns > 100 {
+		return fmt.Errorf("sprite columns should be between 1 and 100")
+	}
+	if s.Rows < 1 || s.Rows > 100 {
+		return fmt.Errorf("sprite rows should be between 1 and 100")
+	}
+	return nil
+}
+
+// TargetQualityConfiguration chooses an output's Quality by searching for the lowest setting whose
+// output meets a perceptual quality target, so that every source looks equally good, rather than
+// passing a fixed Quality to the encoder. Images are scored whole, and videos on sample segments.
+type TargetQualityConfiguration struct {
+	Metric         QualityMetric // ssim or butteraugli for images, vmaf for videos. Defaults to ssim for images and vmaf for videos
+	Target         float64       // Score to meet, e.g. 0.98 SSIM, a butteraugli distance of 1.5, or 93 VMAF. Defaults by metric
+	Min            int           // Lowest Quality searched: image quality, or video CRF. Defaults to 30 for images and 15 for videos
+	Max            int           // Highest Quality searched. Defaults to 95 for images and 45 for videos
+	Samples        int           // Number of segments of a video scored at each CRF. Defaults to 3
+	SampleDuration float64       // Length of each segment in seconds. Defaults to 4
+}
+
+// Validate validates a TargetQualityConfiguration for image or video output, applying defaults
+func (t *TargetQualityConfiguration) Validate(mediaType MediaType) error {
+	if t.Metric == "" {
+		t.Metric = MetricSSIM
+		if mediaType == Video {
+			t.Metric = MetricVMAF
+		}
+	}
+	switch t.Metric {
+	case MetricSSIM, MetricButteraugli:
+		if mediaType != Image {
+			return fmt.Errorf("target quality metric '%s' can only be used for images", t.Metric)
+		}
+	case MetricVMAF:
+		if mediaType != Video {
+			return fmt.Errorf("target quality metric '%s' can only be used for videos", t.Metric)
+		}
+	default:
+		return fmt.Errorf("unknown target quality metric '%s'", t.Metric)
+	}
+
+	if t.Target == 0 {
+		t.Target = defaultQualityTarget[t.Metric]
+	}
+	switch {
+	case t.Metric == MetricSSIM && (t.Target < 0 || t.Target > 1):
+		return fmt.Errorf("ssim target should be between 0 and 1 (%g)", t.Target)
+	case t.Metric == MetricButteraugli && (t.Target < 0 || t.Target > 25):
+		return fmt.Errorf("butteraugli target should be between 0 and 25 (%g)", t.Target)
+	case t.Metric == MetricVMAF && (t.Target < 0 || t.Target > 100):
+		return fmt.Errorf("vmaf target should be between 0 and 100 (%g)", t.Target)
+	}
+
+	if mediaType == Image {
+		if t.Min == 0 {
+			t.Min = 30
+		}
+		if t.Max == 0 {
+			t.Max = 95
+		}
+		if t.Samples != 0 || t.SampleDuration != 0 {
+			return fmt.Errorf("target quality samples and sampleduration can only be set for videos")
+		}
+	} else {
+		if t.Min == 0 {
+			t.Min = 15
+		}
+		if t.Max == 0 {
+			t.Max = 45
+		}
+		if t.Samples == 0 {
+			t.Samples = 3
+		}
+		if t.SampleDuration == 0 {
+			t.SampleDuration = 4
+		}
+		if t.Samples < 1 || t.Samples > 20 {
+			return fmt.Errorf("target quality samples should be between 1 and 20")
+		}
+		if t.SampleDuration < 1 || t.SampleDuration > 60 {
+			return fmt.Errorf("target quality sample duration should be between 1 and 60 seconds")
+		}
+	}
+	if t.Min < 1 || t.Max > 100 || t.Min > t.Max {
+		return fmt.Errorf("target quality should search a range within 1 to 100 (%d to %d)", t.Min, t.Max)
+	}
+	return nil
+}
+
+// String describes a TargetQualityConfiguration's target, for filenames. e.g. ssim0.98
+func (t *TargetQualityConfiguration) String() string {
+	return fmt.Sprintf("%s%g", t.Metric, t.Target)
+}
+
+// QualityMetric is a perceptual quality metric, which scores an output against its source
+type QualityMetric string
+
+const (
+	MetricSSIM        QualityMetric = "ssim"        // Structural similarity of the luma, 0 to 1. Higher is better
+	MetricButteraugli QualityMetric = "butteraugli" // Butteraugli distance, from libjxl's butteraugli_main. Lower is better
+	MetricVMAF        QualityMetric = "vmaf"        // Netflix's VMAF, 0 to 100, from ffmpeg's libvmaf filter. Higher is better
+)
+
+// defaultQualityTarget is the default target score for each QualityMetric
+var defaultQualityTarget = map[QualityMetric]float64{
+	MetricSSIM:        0.98,
+	MetricButteraugli: 1.5,
+	MetricVMAF:        93,
+}
+
+// AudioCodec represents the codec used to encode a video's audio
+type AudioCodec string
+
+const (
+	AAC       AudioCodec = "aac"
+	Opus      AudioCodec = "opus"
+	AudioNone AudioCodec = "none" // Strip the audio, e.g. for silent footage
+)
+
+// defaultContainerAudioCodec maps the default audio codec for each video container
+var defaultContainerAudioCodec = map[FileOutputType]AudioCodec{
+	MP4:  AAC,
+	WebM: Opus,
+	CMAF: AAC,
+	M3U8: AAC,
+}
+
+// opusSampleRates are the sample rates supported by Opus
+var opusSampleRates = map[int]bool{8000: true, 12000: true, 16000: true, 24000: true, 48000: true}
+
 // MediaType is the type of a piece of media - Image, Video, etc
 type MediaType string
 
@@ -184,10 +1400,29 @@ const (
 	Unknown MediaType = "unknown"
 )
 
+// Default encoder settings, matching the libvips defaults
+const (
+	defaultAvifSpeed      = 5
+	defaultJxlEffort      = 7
+	defaultPngCompression = 6
+)
+
+// jxlDistanceFromQuality maps a 1-100 quality setting to a JPEG XL distance, using the same
+// mapping as libvips
+func jxlDistanceFromQuality(quality int) float64 {
+	q := float64(quality)
+	if quality >= 30 {
+		return 0.1 + (100-q)*0.09
+	}
+	return 53.0/3000.0*q*q - 23.0/20.0*q + 25.0
+}
+
 // defaultFiletypeCodec maps the default codec for each container format
 var defaultFiletypeCodec = map[FileOutputType]VideoCodec{
 	MP4:  H264,
 	WebM: VP9,
+	CMAF: H264,
+	M3U8: H264,
 }
 
 // validCodecContainer maps the valid containers for each codec
@@ -197,3 +1432,12 @@ var validCodecContainer = map[VideoCodec]FileOutputType{
 	VP9:  WebM,
 	AV1:  WebM,
 }
+
+// validCodecSegmentedContainer maps the valid containers for each codec, when segmented for
+// adaptive streaming
+var validCodecSegmentedContainer = map[VideoCodec]FileOutputType{
+	H264: CMAF,
+	H265: CMAF,
+	VP9:  CMAF,
+	AV1:  CMAF,
+}
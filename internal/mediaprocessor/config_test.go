@@ -0,0 +1,171 @@
+package mediaprocessor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestImageConfigurationIsLossless(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ImageConfiguration
+		want   bool
+	}{
+		{"jpg", ImageConfiguration{FileType: JPG, Quality: 80}, false},
+		{"png", ImageConfiguration{FileType: PNG}, true},
+		{"palette png", ImageConfiguration{FileType: PNG, Palette: true, Quality: 80}, false},
+		{"lossy webp", ImageConfiguration{FileType: WebP, Quality: 80}, false},
+		{"lossless webp", ImageConfiguration{FileType: WebP, Lossless: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.IsLossless(); got != tt.want {
+				t.Errorf("IsLossless() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageConfigurationValidatePalette(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ImageConfiguration
+		wantErr bool
+	}{
+		{"png without quality", ImageConfiguration{MaxWidth: 100, FileType: PNG}, false},
+		{"palette png with quality", ImageConfiguration{MaxWidth: 100, FileType: PNG, Palette: true, Quality: 80}, false},
+		{"palette png without quality", ImageConfiguration{MaxWidth: 100, FileType: PNG, Palette: true}, true},
+		{"palette png with target quality", ImageConfiguration{MaxWidth: 100, FileType: PNG, Palette: true, Quality: 80, TargetQuality: &TargetQualityConfiguration{Metric: MetricSSIM, Target: 0.95}}, true},
+		{"palette jpg", ImageConfiguration{MaxWidth: 100, FileType: JPG, Palette: true, Quality: 80}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateBasicConfigurations(t *testing.T) {
+	png := &ImageConfiguration{MaxWidth: 100, FileType: PNG}
+	palette := &ImageConfiguration{MaxWidth: 100, FileType: PNG, Palette: true, Quality: 80}
+	webp := &ImageConfiguration{MaxWidth: 100, FileType: WebP, Quality: 80}
+
+	if err := validateBasicConfigurations([]*ImageConfiguration{png}); err != nil {
+		t.Errorf("validateBasicConfigurations() error = %v for a png", err)
+	}
+	if err := validateBasicConfigurations([]*ImageConfiguration{png, palette}); err == nil {
+		t.Error("validateBasicConfigurations() accepted a palette png")
+	}
+	if err := validateBasicConfigurations([]*ImageConfiguration{png, webp}); err == nil {
+		t.Error("validateBasicConfigurations() accepted a webp")
+	}
+}
+
+func TestAudioConfigurationValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		audio        AudioConfiguration
+		container    FileOutputType
+		wantErr      bool
+		wantLoudness float64
+	}{
+		{"defaults", AudioConfiguration{}, MP4, false, 0},
+		{"normalised to the default loudness", AudioConfiguration{Normalise: true}, MP4, false, -23},
+		{"normalised to a set loudness", AudioConfiguration{Normalise: true, Loudness: -16}, WebM, false, -16},
+		{"loudness without normalise", AudioConfiguration{Loudness: -16}, MP4, true, 0},
+		{"loudness out of range", AudioConfiguration{Normalise: true, Loudness: -2}, MP4, true, 0},
+		{"opus in segmented video", AudioConfiguration{Codec: Opus}, CMAF, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.audio.Validate(tt.container)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err == nil && tt.audio.Loudness != tt.wantLoudness {
+				t.Errorf("Validate() set loudness %g, want %g", tt.audio.Loudness, tt.wantLoudness)
+			}
+		})
+	}
+}
+
+func TestHLSConfigurationValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		segmentType HLSSegmentType
+		renditions  []*VideoConfiguration
+		wantErr     bool
+	}{
+		{"default codec", HLSfMP4, []*VideoConfiguration{{MaxWidth: 1280, Quality: 23}}, false},
+		{"file type is ignored", HLSfMP4, []*VideoConfiguration{{MaxWidth: 1280, Quality: 23, FileType: MP4}}, false},
+		{"codec supported by segment type", HLSfMP4, []*VideoConfiguration{{MaxWidth: 1280, Quality: 30, Codec: AV1}}, false},
+		{"codec unsupported by segment type", HLSTS, []*VideoConfiguration{{MaxWidth: 1280, Quality: 23, Codec: H265}}, true},
+		{"missing quality", HLSfMP4, []*VideoConfiguration{{MaxWidth: 1280}}, true},
+		{"missing width", HLSfMP4, []*VideoConfiguration{{Quality: 23}}, true},
+		{"odd width", HLSfMP4, []*VideoConfiguration{{MaxWidth: 1279, Quality: 23}}, true},
+		{"target quality", HLSfMP4, []*VideoConfiguration{{MaxWidth: 1280, TargetQuality: &TargetQualityConfiguration{}}}, true},
+		{"thumbnail", HLSfMP4, []*VideoConfiguration{{MaxWidth: 1280, Quality: 23, Thumbnail: &ThumbnailConfiguration{}}}, true},
+		{"duplicate renditions", HLSfMP4, []*VideoConfiguration{{MaxWidth: 1280, Quality: 23}, {MaxWidth: 1280, Quality: 28}}, true},
+		{"no renditions", HLSfMP4, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &HLSConfiguration{SegmentType: tt.segmentType, Renditions: tt.renditions}
+			err := h.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for _, r := range h.Renditions {
+				if r.FileType != M3U8 || r.Codec == "" || r.Audio == nil {
+					t.Errorf("Validate() didn't apply rendition defaults: %+v", r)
+				}
+			}
+		})
+	}
+}
+
+func TestVideoConfigurationValidateManifests(t *testing.T) {
+	for _, fileType := range []FileOutputType{M3U8, MPD} {
+		v := &VideoConfiguration{MaxWidth: 1280, Quality: 23, FileType: fileType}
+		if err := v.Validate(); err == nil {
+			t.Errorf("Validate() accepted a %s configuration", fileType)
+		}
+	}
+}
+
+func TestCheckBooleanKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{"quoted y", "FocalPoint: {X: 0.5, 'Y': 0.3}\n", false},
+		{"lists of configurations", "ImageConfigurations:\n  - FocalPoint: {X: 0.5, 'Y': 0.3}\n", false},
+		{"unquoted y", "FocalPoint: {X: 0.5, Y: 0.3}\n", true},
+		{"unquoted y in a list", "ImageConfigurations:\n  - Crop: focal\n    FocalPoint: {X: 0.5, Y: 0.3}\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.SetConfigType("yaml")
+			if err := v.ReadConfig(strings.NewReader(tt.yaml)); err != nil {
+				t.Fatal(err)
+			}
+			if err := CheckBooleanKeys(v.AllSettings()); (err != nil) != tt.wantErr {
+				t.Errorf("CheckBooleanKeys() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
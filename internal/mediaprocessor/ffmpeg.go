@@ -0,0 +1,152 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Locating the ffmpeg and ffprobe binaries, and checking that the ffmpeg build can encode every
+// VideoConfiguration before any files are processed
+
+// videoEncoderFFmpeg is the ffmpeg encoder used for each VideoEncoder
+var videoEncoderFFmpeg = map[VideoEncoder]string{
+	EncoderX264:          "libx264",
+	EncoderX265:          "libx265",
+	EncoderX265Grain:     "libx265",
+	EncoderX265Animation: "libx265",
+	EncoderVPX:           "libvpx-vp9",
+	EncoderAOM:           "libaom-av1",
+	EncoderSVTAV1:        "libsvtav1",
+	EncoderRav1e:         "librav1e",
+}
+
+// audioCodecEncoder is the ffmpeg encoder used for each audio codec
+var audioCodecEncoder = map[AudioCodec]string{
+	AAC:  "aac",
+	Opus: "libopus",
+}
+
+// thumbnailEncoder is the ffmpeg encoder used for each video thumbnail and preview format
+var thumbnailEncoder = map[FileOutputType]string{
+	JPG:  "mjpeg",
+	PNG:  "png",
+	WebP: "libwebp",
+	AVIF: "libaom-av1",
+	JXL:  "libjxl",
+	GIF:  "gif",
+}
+
+// FindBinary returns the full path of a binary. If path is set but there's no executable there,
+// or path isn't set, the binary is looked up by name on the PATH.
+func FindBinary(path string, name string) (string, error) {
+	if path != "" {
+		found, err := exec.LookPath(path)
+		if err == nil {
+			return found, nil
+		}
+		fmt.Printf("Warning: %s not found at '%s', looking on the PATH instead\n", name, path)
+	}
+
+	found, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s not found: install it, or set its path in the config", name)
+	}
+	return found, nil
+}
+
+// FFmpegEncoders lists the encoders included in the ffmpeg build at ffmpegPath
+func FFmpegEncoders(ffmpegPath string) (map[string]bool, error) {
+	output, err := exec.Command(ffmpegPath, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ffmpeg encoders: %s", err)
+	}
+
+	// Encoders are listed after a legend of their capability flags, e.g.
+	//  V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+	encoders := make(map[string]bool)
+	legend := true
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if legend {
+			legend = len(fields) == 0 || !strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders, nil
+}
+
+// requiredEncoders lists the ffmpeg encoders needed to output a VideoConfiguration
+func (v *VideoConfiguration) requiredEncoders() []string {
+	switch {
+	case v.FileType.GetMediaType() == Image:
+		if encoder, ok := thumbnailEncoder[v.FileType]; ok {
+			return []string{encoder}
+		}
+		return nil
+	case v.Audio != nil && v.Audio.Codec != AudioNone:
+		return []string{videoEncoderFFmpeg[v.Encoder], audioCodecEncoder[v.Audio.Codec]}
+	}
+	return []string{videoEncoderFFmpeg[v.Encoder]}
+}
+
+// FFmpegFilters lists the filters included in the ffmpeg build at ffmpegPath
+func FFmpegFilters(ffmpegPath string) (map[string]bool, error) {
+	output, err := exec.Command(ffmpegPath, "-hide_banner", "-filters").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ffmpeg filters: %s", err)
+	}
+
+	// Filters are listed after a legend of their capability flags, which has no separator, e.g.
+	//   ..C = Command support
+	//  ... libvmaf           VV->V      Calculate the VMAF between two video streams.
+	// Legend lines have '=' as their second field, so never match a filter name
+	filters := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 3 {
+			filters[fields[1]] = true
+		}
+	}
+	return filters, nil
+}
+
+// CheckVideoEncoders checks that the ffmpeg build at ffmpegPath includes the encoders needed by
+// each VideoConfiguration, and the libvmaf filter if a target-quality search needs it, so that a
+// missing encoder is reported before any files are processed
+func CheckVideoEncoders(ffmpegPath string, configs []*VideoConfiguration) error {
+	encoders, err := FFmpegEncoders(ffmpegPath)
+	if err != nil {
+		return err
+	}
+
+	var filters map[string]bool
+	for _, c := range configs {
+		if c.TargetQuality != nil && c.TargetQuality.Metric == MetricVMAF {
+			if filters == nil {
+				if filters, err = FFmpegFilters(ffmpegPath); err != nil {
+					return err
+				}
+			}
+			if !filters["libvmaf"] {
+				return fmt.Errorf("vmaf target quality needs the libvmaf filter, which isn't included in the ffmpeg build at '%s'", ffmpegPath)
+			}
+		}
+		for _, encoder := range c.requiredEncoders() {
+			if encoders[encoder] {
+				continue
+			}
+			description := string(c.FileType)
+			if c.Encoder != "" {
+				description += " " + string(c.Encoder)
+			}
+			return fmt.Errorf(
+				"%s video output at width %d needs the %s encoder, which isn't included in the ffmpeg build at '%s'",
+				description, c.MaxWidth, encoder, ffmpegPath,
+			)
+		}
+	}
+	return nil
+}
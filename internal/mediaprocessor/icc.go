@@ -0,0 +1,351 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// ICC colour management for ImageBasic, which processes images with the Go image libraries, so
+// can't use libvips to convert them. Only RGB matrix/TRC profiles are supported, which covers
+// sRGB, Display P3 and Adobe RGB. Pixels are converted through the profile connection space,
+// using the relative colorimetric intent.
+
+// iccProfile is a parsed RGB matrix/TRC ICC profile
+type iccProfile struct {
+	toXYZ [3][3]float64   // Converts linear RGB to D50 XYZ
+	trc   [3][256]float64 // Tone response curve for each channel, sampled at each 8-bit level
+}
+
+// srgbProfile returns the sRGB profile, using the exact sRGB tone response curve
+func srgbProfile() *iccProfile {
+	p := &iccProfile{
+		// sRGB primaries, chromatically adapted to D50 as in the ICC sRGB profile
+		toXYZ: [3][3]float64{
+			{0.4360747, 0.3850649, 0.1430804},
+			{0.2225045, 0.7168786, 0.0606169},
+			{0.0139322, 0.0971045, 0.7141733},
+		},
+	}
+	for n := 0; n < 256; n++ {
+		v := float64(n) / 255
+		if v <= 0.04045 {
+			v = v / 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		p.trc[0][n], p.trc[1][n], p.trc[2][n] = v, v, v
+	}
+	return p
+}
+
+// parseICCProfile parses an RGB matrix/TRC ICC profile
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 {
+		return nil, errors.New("icc profile is truncated")
+	}
+	if string(data[16:20]) != "RGB " {
+		return nil, fmt.Errorf("unsupported icc profile colour space '%s'", bytes.TrimSpace(data[16:20]))
+	}
+
+	tags := make(map[string][]byte)
+	tagCount := int(binary.BigEndian.Uint32(data[128:132]))
+	for n := 0; n < tagCount; n++ {
+		entry := 132 + n*12
+		if entry+12 > len(data) {
+			return nil, errors.New("icc profile tag table is truncated")
+		}
+		offset := int(binary.BigEndian.Uint32(data[entry+4 : entry+8]))
+		size := int(binary.BigEndian.Uint32(data[entry+8 : entry+12]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, errors.New("icc profile tag is out of bounds")
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	p := &iccProfile{}
+	for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := tags[sig]
+		if len(tag) < 20 || string(tag[0:4]) != "XYZ " {
+			return nil, fmt.Errorf("icc profile has no %s matrix column; only matrix/TRC profiles are supported", sig)
+		}
+		for row := 0; row < 3; row++ {
+			p.toXYZ[row][c] = s15Fixed16(tag[8+row*4:])
+		}
+	}
+	for c, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseICCCurve(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("icc profile %s: %s", sig, err)
+		}
+		for n := 0; n < 256; n++ {
+			p.trc[c][n] = curve(float64(n) / 255)
+		}
+	}
+
+	return p, nil
+}
+
+// parseICCCurve parses a curv or para tone response curve into a function mapping encoded values
+// to linear light
+func parseICCCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("missing tone response curve")
+	}
+
+	switch string(tag[0:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:12]))
+		if len(tag) < 12+count*2 {
+			return nil, errors.New("curve is truncated")
+		}
+		switch count {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:14])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, count)
+		for n := range table {
+			table[n] = float64(binary.BigEndian.Uint16(tag[12+n*2:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(count-1)
+			n := int(math.Min(pos, float64(count-2)))
+			return table[n] + (table[n+1]-table[n])*(pos-float64(n))
+		}, nil
+	case "para":
+		// Parametric curves have 1, 3, 4, 5 or 7 parameters, depending on their function type
+		functionType := int(binary.BigEndian.Uint16(tag[8:10]))
+		paramCounts := []int{1, 3, 4, 5, 7}
+		if functionType >= len(paramCounts) || len(tag) < 12+paramCounts[functionType]*4 {
+			return nil, fmt.Errorf("unsupported parametric curve type %d", functionType)
+		}
+		var g [7]float64
+		for n := 0; n < paramCounts[functionType]; n++ {
+			g[n] = s15Fixed16(tag[12+n*4:])
+		}
+		gamma, a, b, c, d, e, f := g[0], g[1], g[2], g[3], g[4], g[5], g[6]
+		return func(x float64) float64 {
+			switch functionType {
+			case 0:
+				return math.Pow(x, gamma)
+			case 1:
+				if x >= -b/a {
+					return math.Pow(a*x+b, gamma)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return math.Pow(a*x+b, gamma) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+b, gamma)
+				}
+				return c * x
+			default:
+				if x >= d {
+					return math.Pow(a*x+b, gamma) + e
+				}
+				return c*x + f
+			}
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported curve type '%s'", tag[0:4])
+	}
+}
+
+// s15Fixed16 decodes an ICC signed 15.16 fixed point number
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// convertICCProfile converts an image's pixels from one ICC profile to another, in place
+func convertICCProfile(img *image.NRGBA, from *iccProfile, to *iccProfile) {
+	fromXYZ := from.toXYZ
+	toRGB := invertMatrix(to.toXYZ)
+	var transform [3][3]float64
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			for k := 0; k < 3; k++ {
+				transform[row][col] += toRGB[row][k] * fromXYZ[k][col]
+			}
+		}
+	}
+
+	for offset := 0; offset+3 < len(img.Pix); offset += 4 {
+		pix := img.Pix[offset : offset+3]
+		linear := [3]float64{from.trc[0][pix[0]], from.trc[1][pix[1]], from.trc[2][pix[2]]}
+		for c := 0; c < 3; c++ {
+			v := transform[c][0]*linear[0] + transform[c][1]*linear[1] + transform[c][2]*linear[2]
+			pix[c] = to.encode(c, v)
+		}
+	}
+}
+
+// encode finds the 8-bit level whose linear value is closest to v, using the tone response curve
+// of a channel. Curves are assumed to be increasing.
+func (p *iccProfile) encode(channel int, v float64) uint8 {
+	trc := p.trc[channel][:]
+	n := sort.SearchFloat64s(trc, v)
+	if n == 0 {
+		return 0
+	}
+	if n == len(trc) {
+		return 255
+	}
+	if v-trc[n-1] < trc[n]-v {
+		return uint8(n - 1)
+	}
+	return uint8(n)
+}
+
+// invertMatrix inverts a 3x3 matrix
+func invertMatrix(m [3][3]float64) (inv [3][3]float64) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+
+	inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	return
+}
+
+// extractICCProfile returns the ICC profile embedded in JPEG or PNG image data, or nil if there
+// isn't one
+func extractICCProfile(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return extractJpegICCProfile(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return extractPngICCProfile(data)
+	default:
+		return nil
+	}
+}
+
+var (
+	jpegICCMarker = []byte("ICC_PROFILE\x00")
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// extractJpegICCProfile reassembles an ICC profile from a JPEG's APP2 segments
+func extractJpegICCProfile(data []byte) []byte {
+	chunks := make(map[byte][]byte)
+	for offset := 2; offset+4 <= len(data) && data[offset] == 0xFF; {
+		marker := data[offset+1]
+		if marker == 0xDA { // Start of scan - no more metadata segments
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 || offset+2+length > len(data) {
+			break
+		}
+		segment := data[offset+4 : offset+2+length]
+		if marker == 0xE2 && bytes.HasPrefix(segment, jpegICCMarker) && len(segment) > len(jpegICCMarker)+2 {
+			chunks[segment[len(jpegICCMarker)]] = segment[len(jpegICCMarker)+2:]
+		}
+		offset += 2 + length
+	}
+
+	var profile []byte
+	for seq := byte(1); chunks[seq] != nil; seq++ {
+		profile = append(profile, chunks[seq]...)
+	}
+	return profile
+}
+
+// extractPngICCProfile decompresses the ICC profile from a PNG's iCCP chunk
+func extractPngICCProfile(data []byte) []byte {
+	for offset := len(pngSignature); offset+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		chunkType := string(data[offset+4 : offset+8])
+		if chunkType == "IDAT" || offset+12+length > len(data) {
+			break
+		}
+		if chunkType == "iCCP" {
+			chunk := data[offset+8 : offset+8+length]
+			nameEnd := bytes.IndexByte(chunk, 0)
+			if nameEnd < 0 || nameEnd+2 > len(chunk) {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(chunk[nameEnd+2:]))
+			if err != nil {
+				return nil
+			}
+			defer r.Close()
+			profile, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		offset += 12 + length
+	}
+	return nil
+}
+
+// embedICCProfile inserts an ICC profile into encoded JPEG or PNG image data, as the Go encoders
+// can't write one
+func embedICCProfile(data []byte, fileType FileOutputType, profile []byte) ([]byte, error) {
+	switch fileType {
+	case JPG:
+		// Split the profile across APP2 segments, inserted after the start of image marker
+		const maxChunk = 65535 - 2 - 14
+		chunkCount := (len(profile) + maxChunk - 1) / maxChunk
+		if chunkCount > 255 {
+			return nil, errors.New("icc profile is too large to embed in a jpeg")
+		}
+		var out bytes.Buffer
+		out.Write(data[:2])
+		for seq := 0; seq < chunkCount; seq++ {
+			chunk := profile[seq*maxChunk:]
+			if len(chunk) > maxChunk {
+				chunk = chunk[:maxChunk]
+			}
+			out.Write([]byte{0xFF, 0xE2})
+			binary.Write(&out, binary.BigEndian, uint16(2+len(jpegICCMarker)+2+len(chunk)))
+			out.Write(jpegICCMarker)
+			out.Write([]byte{byte(seq + 1), byte(chunkCount)})
+			out.Write(chunk)
+		}
+		out.Write(data[2:])
+		return out.Bytes(), nil
+	case PNG:
+		// Insert an iCCP chunk after the IHDR chunk, which is always first
+		var compressed bytes.Buffer
+		w := zlib.NewWriter(&compressed)
+		w.Write(profile)
+		w.Close()
+		chunk := append([]byte("iCCP"), "icc\x00\x00"...)
+		chunk = append(chunk, compressed.Bytes()...)
+
+		ihdrEnd := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(data[len(pngSignature):]))
+		var out bytes.Buffer
+		out.Write(data[:ihdrEnd])
+		binary.Write(&out, binary.BigEndian, uint32(len(chunk)-4))
+		out.Write(chunk)
+		binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+		out.Write(data[ihdrEnd:])
+		return out.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("can't embed an icc profile in %s images", fileType)
+	}
+}
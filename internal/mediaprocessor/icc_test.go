@@ -0,0 +1,435 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readTestProfile(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// iccTagEntry returns the offset of a tag's entry in a profile's tag table
+func iccTagEntry(t *testing.T, data []byte, sig string) int {
+	t.Helper()
+	for n := 0; n < int(binary.BigEndian.Uint32(data[128:132])); n++ {
+		if entry := 132 + n*12; string(data[entry:entry+4]) == sig {
+			return entry
+		}
+	}
+	t.Fatalf("profile has no %s tag", sig)
+	return 0
+}
+
+func TestParseICCProfile(t *testing.T) {
+	srgb := srgbProfile()
+	adobeGamma := 563.0 / 256 // Adobe RGB stores its 2.2 gamma as a u8Fixed8 number
+
+	tests := []struct {
+		name    string
+		file    string
+		modify  func(t *testing.T, data []byte) []byte
+		wantErr string
+		check   func(t *testing.T, p *iccProfile)
+	}{
+		{
+			name: "srgb v4 parametric curves",
+			file: "srgb.icc",
+			check: func(t *testing.T, p *iccProfile) {
+				for row := 0; row < 3; row++ {
+					for col := 0; col < 3; col++ {
+						if math.Abs(p.toXYZ[row][col]-srgb.toXYZ[row][col]) > 1e-3 {
+							t.Errorf("toXYZ[%d][%d] = %f, want %f", row, col, p.toXYZ[row][col], srgb.toXYZ[row][col])
+						}
+					}
+				}
+				for c := 0; c < 3; c++ {
+					for n := 0; n < 256; n++ {
+						if math.Abs(p.trc[c][n]-srgb.trc[c][n]) > 1e-4 {
+							t.Fatalf("trc[%d][%d] = %f, want %f", c, n, p.trc[c][n], srgb.trc[c][n])
+						}
+					}
+				}
+			},
+		},
+		{
+			name: "adobe rgb v2 gamma curves",
+			file: "adobe-rgb.icc",
+			check: func(t *testing.T, p *iccProfile) {
+				// The D50 white point is the sum of the matrix columns
+				for row, want := range []float64{0.9642, 1, 0.8249} {
+					if sum := p.toXYZ[row][0] + p.toXYZ[row][1] + p.toXYZ[row][2]; math.Abs(sum-want) > 1e-3 {
+						t.Errorf("white point row %d = %f, want %f", row, sum, want)
+					}
+				}
+				for _, n := range []int{0, 64, 128, 255} {
+					want := math.Pow(float64(n)/255, adobeGamma)
+					if math.Abs(p.trc[1][n]-want) > 1e-9 {
+						t.Errorf("trc[1][%d] = %f, want %f", n, p.trc[1][n], want)
+					}
+				}
+			},
+		},
+		{
+			name:    "truncated header",
+			file:    "srgb.icc",
+			modify:  func(t *testing.T, data []byte) []byte { return data[:100] },
+			wantErr: "icc profile is truncated",
+		},
+		{
+			name:    "empty",
+			modify:  func(t *testing.T, data []byte) []byte { return nil },
+			wantErr: "icc profile is truncated",
+		},
+		{
+			name:    "truncated tag table",
+			file:    "srgb.icc",
+			modify:  func(t *testing.T, data []byte) []byte { return data[:140] },
+			wantErr: "icc profile tag table is truncated",
+		},
+		{
+			name:    "truncated tag data",
+			file:    "adobe-rgb.icc",
+			modify:  func(t *testing.T, data []byte) []byte { return data[:len(data)-10] },
+			wantErr: "icc profile tag is out of bounds",
+		},
+		{
+			name: "tag offset out of bounds",
+			file: "srgb.icc",
+			modify: func(t *testing.T, data []byte) []byte {
+				binary.BigEndian.PutUint32(data[iccTagEntry(t, data, "gXYZ")+4:], 0xFFFFFFF0)
+				return data
+			},
+			wantErr: "icc profile tag is out of bounds",
+		},
+		{
+			name: "grey colour space",
+			file: "srgb.icc",
+			modify: func(t *testing.T, data []byte) []byte {
+				copy(data[16:20], "GRAY")
+				return data
+			},
+			wantErr: "unsupported icc profile colour space 'GRAY'",
+		},
+		{
+			name: "missing matrix column",
+			file: "adobe-rgb.icc",
+			modify: func(t *testing.T, data []byte) []byte {
+				copy(data[iccTagEntry(t, data, "bXYZ"):], "A2B0")
+				return data
+			},
+			wantErr: "icc profile has no bXYZ matrix column",
+		},
+		{
+			name: "missing tone response curve",
+			file: "adobe-rgb.icc",
+			modify: func(t *testing.T, data []byte) []byte {
+				copy(data[iccTagEntry(t, data, "gTRC"):], "kTRC")
+				return data
+			},
+			wantErr: "icc profile gTRC: missing tone response curve",
+		},
+		{
+			name: "unsupported curve type",
+			file: "srgb.icc",
+			modify: func(t *testing.T, data []byte) []byte {
+				entry := iccTagEntry(t, data, "rTRC")
+				copy(data[binary.BigEndian.Uint32(data[entry+4:]):], "mAB ")
+				return data
+			},
+			wantErr: "icc profile rTRC: unsupported curve type 'mAB '",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data []byte
+			if tt.file != "" {
+				data = readTestProfile(t, tt.file)
+			}
+			if tt.modify != nil {
+				data = tt.modify(t, data)
+			}
+
+			p, err := parseICCProfile(data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("parseICCProfile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseICCProfile() error = %v", err)
+			}
+			tt.check(t, p)
+		})
+	}
+}
+
+// curvTag builds a curv tone response curve tag
+func curvTag(entries ...uint16) []byte {
+	tag := append([]byte("curv"), make([]byte, 8)...)
+	binary.BigEndian.PutUint32(tag[8:], uint32(len(entries)))
+	for _, e := range entries {
+		tag = append(tag, byte(e>>8), byte(e))
+	}
+	return tag
+}
+
+// paraTag builds a para tone response curve tag
+func paraTag(functionType uint16, params ...float64) []byte {
+	tag := append([]byte("para"), make([]byte, 8)...)
+	binary.BigEndian.PutUint16(tag[8:], functionType)
+	for _, p := range params {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(int32(math.Round(p*65536))))
+		tag = append(tag, b[:]...)
+	}
+	return tag
+}
+
+func TestParseICCCurve(t *testing.T) {
+	// sRGB's curve as a type 3 parametric function
+	srgbParams := []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045}
+
+	tests := []struct {
+		name    string
+		tag     []byte
+		want    map[float64]float64
+		wantErr string
+	}{
+		{
+			name: "identity curv",
+			tag:  curvTag(),
+			want: map[float64]float64{0: 0, 0.3: 0.3, 1: 1},
+		},
+		{
+			name: "gamma curv",
+			tag:  curvTag(2 << 8),
+			want: map[float64]float64{0: 0, 0.5: 0.25, 1: 1},
+		},
+		{
+			name: "table curv",
+			tag:  curvTag(0, 0, 65535),
+			want: map[float64]float64{0: 0, 0.25: 0, 0.75: 0.5, 1: 1},
+		},
+		{
+			name: "gamma para",
+			tag:  paraTag(0, 2),
+			want: map[float64]float64{0: 0, 0.5: 0.25, 1: 1},
+		},
+		{
+			name: "offset para",
+			tag:  paraTag(2, 1, 1, 0, 0.5),
+			want: map[float64]float64{0: 0.5, 0.5: 1, 1: 1.5},
+		},
+		{
+			name: "srgb para",
+			tag:  paraTag(3, srgbParams...),
+			want: map[float64]float64{0: 0, 0.02: 0.02 / 12.92, 0.5: math.Pow(0.555/1.055, 2.4), 1: 1},
+		},
+		{
+			name:    "missing",
+			tag:     nil,
+			wantErr: "missing tone response curve",
+		},
+		{
+			name:    "truncated curv",
+			tag:     curvTag(0, 65535)[:14],
+			wantErr: "curve is truncated",
+		},
+		{
+			name:    "truncated para",
+			tag:     paraTag(3, srgbParams[:2]...),
+			wantErr: "unsupported parametric curve type 3",
+		},
+		{
+			name:    "unknown para function",
+			tag:     paraTag(5, 1, 1, 1, 1, 1, 1, 1),
+			wantErr: "unsupported parametric curve type 5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			curve, err := parseICCCurve(tt.tag)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseICCCurve() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseICCCurve() error = %v", err)
+			}
+			for x, want := range tt.want {
+				if got := curve(x); math.Abs(got-want) > 1e-4 {
+					t.Errorf("curve(%v) = %f, want %f", x, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertICCProfile(t *testing.T) {
+	srgbFile, err := parseICCProfile(readTestProfile(t, "srgb.icc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	adobe, err := parseICCProfile(readTestProfile(t, "adobe-rgb.icc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		from, to *iccProfile
+		in, want color.NRGBA
+	}{
+		{"srgb to itself keeps colours", srgbProfile(), srgbProfile(), color.NRGBA{200, 100, 50, 128}, color.NRGBA{200, 100, 50, 128}},
+		{"srgb file to srgb keeps colours", srgbFile, srgbProfile(), color.NRGBA{12, 34, 250, 255}, color.NRGBA{12, 34, 250, 255}},
+		{"adobe rgb grey stays grey", adobe, srgbProfile(), color.NRGBA{128, 128, 128, 255}, color.NRGBA{128, 128, 128, 255}},
+		{"adobe rgb green is out of srgb gamut", adobe, srgbProfile(), color.NRGBA{0, 255, 0, 255}, color.NRGBA{0, 255, 0, 255}},
+		{"adobe rgb white stays white", adobe, srgbProfile(), color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+			img.SetNRGBA(0, 0, tt.in)
+			convertICCProfile(img, tt.from, tt.to)
+
+			got := img.NRGBAAt(0, 0)
+			for c, v := range []uint8{got.R, got.G, got.B, got.A} {
+				want := []uint8{tt.want.R, tt.want.G, tt.want.B, tt.want.A}[c]
+				if math.Abs(float64(v)-float64(want)) > 1 {
+					t.Fatalf("convertICCProfile() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestInvertMatrix(t *testing.T) {
+	m := srgbProfile().toXYZ
+	inv := invertMatrix(m)
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			var v float64
+			for k := 0; k < 3; k++ {
+				v += m[row][k] * inv[k][col]
+			}
+			want := 0.0
+			if row == col {
+				want = 1
+			}
+			if math.Abs(v-want) > 1e-9 {
+				t.Errorf("m * inv[%d][%d] = %f, want %f", row, col, v, want)
+			}
+		}
+	}
+}
+
+func TestEmbedICCProfile(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	var jpegBuf, pngBuf bytes.Buffer
+	if err := jpeg.Encode(&jpegBuf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	// Large profiles are split across several JPEG APP2 segments
+	largeProfile := make([]byte, 150000)
+	for n := range largeProfile {
+		largeProfile[n] = byte(n * 7)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		fileType FileOutputType
+		profile  []byte
+		wantErr  string
+	}{
+		{"jpeg", jpegBuf.Bytes(), JPG, readTestProfile(t, "srgb.icc"), ""},
+		{"jpeg large profile", jpegBuf.Bytes(), JPG, largeProfile, ""},
+		{"jpeg oversized profile", jpegBuf.Bytes(), JPG, make([]byte, 256*65519), "icc profile is too large to embed in a jpeg"},
+		{"png", pngBuf.Bytes(), PNG, readTestProfile(t, "adobe-rgb.icc"), ""},
+		{"png large profile", pngBuf.Bytes(), PNG, largeProfile, ""},
+		{"webp", pngBuf.Bytes(), WebP, readTestProfile(t, "srgb.icc"), "can't embed an icc profile in webp images"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if extractICCProfile(tt.data) != nil {
+				t.Fatal("extractICCProfile() found a profile before embedding one")
+			}
+
+			out, err := embedICCProfile(tt.data, tt.fileType, tt.profile)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("embedICCProfile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("embedICCProfile() error = %v", err)
+			}
+
+			if got := extractICCProfile(out); !bytes.Equal(got, tt.profile) {
+				t.Errorf("extractICCProfile() returned %d bytes, want the %d byte profile", len(got), len(tt.profile))
+			}
+			if _, _, err := image.Decode(bytes.NewReader(out)); err != nil {
+				t.Errorf("image with embedded profile doesn't decode: %s", err)
+			}
+		})
+	}
+}
+
+func TestExtractICCProfileMalformed(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	withProfile, err := embedICCProfile(buf.Bytes(), PNG, readTestProfile(t, "srgb.icc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"jpeg start of image only", []byte{0xFF, 0xD8}},
+		{"jpeg truncated segment", []byte{0xFF, 0xD8, 0xFF, 0xE2, 0x40, 0x00, 'I', 'C', 'C'}},
+		{"jpeg invalid segment length", []byte{0xFF, 0xD8, 0xFF, 0xE2, 0x00, 0x01}},
+		{"png signature only", pngSignature},
+		{"png truncated iCCP chunk", withProfile[:len(pngSignature)+25+20]},
+		{"not an image", []byte("GIF89a")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractICCProfile(tt.data); got != nil {
+				t.Errorf("extractICCProfile() = %d bytes, want nil", len(got))
+			}
+		})
+	}
+}
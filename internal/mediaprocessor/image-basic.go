@@ -1,14 +1,19 @@
 package mediaprocessor
 
 import (
+	"bytes"
 	"fmt"
 	"image"
+	"image/color"
 	"image/jpeg"
+	"image/png"
+	"io/ioutil"
 	"log"
 	"math"
-	"os"
 
+	vips "github.com/davidbyttow/govips/v2/vips"
 	"github.com/disintegration/imaging"
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
 )
 
 // ImageBasic is an ImageProcessor which uses a mix of Go image generation libraries
@@ -18,63 +23,226 @@ type ImageBasic struct{}
 func (i *ImageBasic) Resize(m *MediaJob) (filenames []string, err error) {
 	// TODO: Do a better job of handling errors - returning early and using multierror to report all errors to the caller
 
-	// Read file in
-	// os.File conforms to io.Reader, which we can call Decode on
-	fh, err := os.Open(m.InputFile.Path)
-	defer fh.Close()
-	if err != nil {
-		log.Fatal("Could not read file")
+	if err = validateBasicConfigurations(m.MediaConfig.ImageConfigurations); err != nil {
+		return
+	}
+
+	// Read file in. The data is kept so that its colour profile can be read.
+	var imgBytes []byte
+	if pixelio.IsRawImage(m.InputFile) {
+		imgBytes, err = decodeRaw(m.FSConfig.DcrawPath, m.InputFile.Path, m.MediaConfig.RawDecoder)
+		if err != nil {
+			log.Fatal("Could not decode RAW file: ", err)
+		}
+	} else {
+		imgBytes, err = ioutil.ReadFile(m.InputFile.Path)
+		if err != nil {
+			log.Fatal("Could not read file")
+		}
 	}
 
-	srcImage, _, err := image.Decode(fh)
+	// N.B. HEIC/HEIF images can't be decoded by the Go image libraries.
+	// Images are rotated upright using their EXIF orientation. The Go encoders don't write
+	// metadata, so output is always stripped whatever the MetadataPolicy.
+	srcImage, err := imaging.Decode(bytes.NewReader(imgBytes), imaging.AutoOrientation(true))
 	if err != nil {
 		log.Fatal("Error decoding image: ", m.InputFile.Path)
 	}
 
-	for _, imageConfig := range m.MediaConfig.ImageConfigurations {
-		// Resize image
-		resizedImage := resizeImage(srcImage, imageConfig.MaxWidth)
+	// Images without a supported colour profile are treated as sRGB
+	srcICC := extractICCProfile(imgBytes)
+	var srcProfile *iccProfile
+	if srcICC != nil {
+		if srcProfile, err = parseICCProfile(srcICC); err != nil {
+			fmt.Printf("Colour profile not supported, treating image as sRGB: %s\n", err)
+		}
+	}
+
+	if m.MediaConfig.Placeholders {
+		if m.Placeholder, err = basicPlaceholder(srcImage, srcProfile); err != nil {
+			log.Fatal("Could not generate placeholder: ", err)
+		}
+	}
 
-		// Write file out
-		outputFilepath := m.OutputPath(imageConfig)
-		fmt.Println("File output path is", outputFilepath)
-		outfh, err := os.Create(outputFilepath)
-		defer outfh.Close()
+	for _, imageConfig := range m.planImageVariants(srcImage.Bounds().Dx(), srcImage.Bounds().Dy()) {
+		// Resize image, cropping if required
+		boxedImage := srcImage
+		if imageConfig.CropBox != nil {
+			left, top, width, height := imageConfig.CropBox.Rect(srcImage.Bounds().Dx(), srcImage.Bounds().Dy())
+			boxedImage = imaging.Crop(srcImage, image.Rect(left, top, left+width, top+height))
+		}
+
+		var resizedImage *image.NRGBA
+		if imageConfig.IsCropped() {
+			resizedImage = cropImage(boxedImage, imageConfig)
+		} else {
+			resizedImage = resizeImage(boxedImage, imageConfig.MaxWidth)
+		}
+
+		embedICC, err := basicColourPolicy(resizedImage, imageConfig, srcProfile, srcICC)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatal("Could not convert image colour profile: ", err)
 		}
 
+		// Encode file
+		var buf bytes.Buffer
 		switch imageConfig.FileType {
 		case JPG:
 			fmt.Println("Encoding output file to JPG")
-			jpeg.Encode(outfh, resizedImage, &jpeg.Options{Quality: imageConfig.Quality})
+			flattened := flattenImage(resizedImage)
+			if imageConfig.TargetQuality != nil {
+				if imageConfig, err = targetJpegQuality(flattened, imageConfig, m.FSConfig.ButteraugliPath); err != nil {
+					log.Fatal("Could not search for target quality: ", err)
+				}
+			}
+			jpeg.Encode(&buf, flattened, &jpeg.Options{Quality: imageConfig.Quality})
+		case PNG:
+			fmt.Println("Encoding output file to PNG")
+			encoder := &png.Encoder{CompressionLevel: pngCompressionLevel(imageConfig.Compression)}
+			encoder.Encode(&buf, resizedImage)
 		case WebP:
 			fmt.Println("WebP output disabled")
-			// fmt.Println("Encoding output file to WebP with chai2010")
-			// var buf bytes.Buffer
-			// if err = webp.Encode(&buf, resizedImage, &webp.Options{Quality: float32(imageConfig.Quality)}); err != nil {
-			// 	log.Println(err)
-			// }
-			// if err = ioutil.WriteFile(outputFilepath, buf.Bytes(), 0664); err != nil {
-			// 	log.Println(err)
-			// }
+			continue
 		default:
 			fmt.Println("Error: unknown output format:", imageConfig.FileType)
 			continue
 		}
 
+		outBytes := buf.Bytes()
+		if embedICC != nil {
+			if outBytes, err = embedICCProfile(outBytes, imageConfig.FileType, embedICC); err != nil {
+				log.Fatal("Could not embed colour profile: ", err)
+			}
+		}
+
+		// Write file out
+		outputFilepath := m.OutputPath(imageConfig)
+		fmt.Println("File output path is", outputFilepath)
+		if err := ioutil.WriteFile(outputFilepath, outBytes, 0644); err != nil {
+			log.Fatal(err)
+		}
+
 		filenames = append(filenames, outputFilepath)
+		m.addVariant(imageConfig, outputFilepath, resizedImage.Bounds().Dx(), resizedImage.Bounds().Dy())
 	}
 
 	return
 }
 
+// validateBasicConfigurations rejects ImageConfigurations using features which the Go encoders
+// don't support, rather than silently producing different output
+func validateBasicConfigurations(configs []*ImageConfiguration) error {
+	for _, c := range configs {
+		if c.Palette {
+			return fmt.Errorf("palette png output isn't supported by the basic image processor")
+		}
+		if c.FileType == WebP {
+			return fmt.Errorf("webp output isn't supported by the basic image processor")
+		}
+	}
+	return nil
+}
+
+// targetJpegQuality searches for the lowest quality at which a JPG meets its ImageConfiguration's
+// target, scoring each candidate by decoding it and comparing it to the image. Only JPG output
+// is supported, as it's the only lossy format the Go encoders write.
+func targetJpegQuality(img *image.NRGBA, i *ImageConfiguration, butteraugliPath string) (*ImageConfiguration, error) {
+	return i.searchTargetQuality(func(candidate *ImageConfiguration) (float64, error) {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: candidate.Quality}); err != nil {
+			return 0, err
+		}
+		distorted, err := jpeg.Decode(&buf)
+		if err != nil {
+			return 0, err
+		}
+		return imageQualityScore(i.TargetQuality.Metric, butteraugliPath, img, distorted)
+	})
+}
+
+// basicColourPolicy converts an image to the colour profile required by an ImageConfiguration,
+// matching the libvips backend. Returns the ICC profile to embed in the output, if any.
+func basicColourPolicy(img *image.NRGBA, i *ImageConfiguration, srcProfile *iccProfile, srcICC []byte) (embedICC []byte, err error) {
+	if srcProfile == nil {
+		srcProfile = srgbProfile()
+	}
+
+	switch i.ColourProfile {
+	case ColourKeep:
+		return srcICC, nil
+	case ColourEmbed:
+		targetProfile := srgbProfile()
+		if i.ICCProfile == "" {
+			// Embed the same compact sRGB profile as libvips
+			profilePath, err := vips.GetSRGBV2MicroICCProfilePath()
+			if err != nil {
+				return nil, err
+			}
+			if embedICC, err = ioutil.ReadFile(profilePath); err != nil {
+				return nil, err
+			}
+		} else {
+			if embedICC, err = ioutil.ReadFile(i.ICCProfile); err != nil {
+				return nil, err
+			}
+			if targetProfile, err = parseICCProfile(embedICC); err != nil {
+				return nil, err
+			}
+		}
+		convertICCProfile(img, srcProfile, targetProfile)
+		return embedICC, nil
+	default:
+		if srcICC != nil {
+			convertICCProfile(img, srcProfile, srgbProfile())
+		}
+		return nil, nil
+	}
+}
+
+// basicPlaceholder generates a Placeholder from an image, with a tiny PNG data URI as there's no
+// WebP encoder
+func basicPlaceholder(srcImage image.Image, srcProfile *iccProfile) (*Placeholder, error) {
+	img := imaging.Fit(srcImage, placeholderHashSize, placeholderHashSize, imaging.Lanczos)
+	if srcProfile != nil {
+		convertICCProfile(img, srcProfile, srgbProfile())
+	}
+
+	var buf bytes.Buffer
+	tiny := imaging.Fit(img, placeholderDataSize, placeholderDataSize, imaging.Lanczos)
+	if err := png.Encode(&buf, tiny); err != nil {
+		return nil, err
+	}
+
+	return newPlaceholder(img, dataURI("image/png", buf.Bytes()))
+}
+
+// flattenImage places an image with an alpha channel over a white background, for formats
+// which can't store transparency
+func flattenImage(srcImage image.Image) *image.NRGBA {
+	background := imaging.New(srcImage.Bounds().Dx(), srcImage.Bounds().Dy(), color.White)
+	return imaging.Overlay(background, srcImage, image.Pt(0, 0), 1.0)
+}
+
+// pngCompressionLevel maps a 1-9 compression level onto the levels supported by image/png.
+// Palette quantisation isn't supported.
+func pngCompressionLevel(compression int) png.CompressionLevel {
+	switch {
+	case compression <= 3:
+		return png.BestSpeed
+	case compression <= 7:
+		return png.DefaultCompression
+	default:
+		return png.BestCompression
+	}
+}
+
 // imaging library typically returns image.NRGBA, so let's roll with that for now
 func resizeImage(srcImage image.Image, targetWidth int) (resizedImage *image.NRGBA) {
 	imgWidth := srcImage.Bounds().Max.X
 	imgHeight := srcImage.Bounds().Max.Y
 	aspectRatio := float64(imgHeight) / float64(imgWidth)
 
+	// Images aren't upscaled, even when the UpscalePolicy allows it
 	resizeWidth := int(math.Min(float64(imgWidth), float64(targetWidth)))
 	resizeHeight := int(float64(resizeWidth) * aspectRatio)
 
@@ -85,3 +253,25 @@ func resizeImage(srcImage image.Image, targetWidth int) (resizedImage *image.NRG
 
 	return
 }
+
+// cropImage scales an image to cover the configured width and height, then crops it.
+// Smart crop modes aren't supported, so the centre of the image is used instead.
+func cropImage(srcImage image.Image, c *ImageConfiguration) *image.NRGBA {
+	if c.Crop != CropFocal {
+		if c.Crop != CropCentre {
+			fmt.Printf("Crop mode '%s' not supported, cropping centre of image\n", c.Crop)
+		}
+		return imaging.Fill(srcImage, c.Width, c.Height, imaging.Center, imaging.Lanczos)
+	}
+
+	imgWidth := float64(srcImage.Bounds().Dx())
+	imgHeight := float64(srcImage.Bounds().Dy())
+	scale := math.Max(float64(c.Width)/imgWidth, float64(c.Height)/imgHeight)
+	scaledImage := imaging.Resize(srcImage, int(math.Ceil(imgWidth*scale)), int(math.Ceil(imgHeight*scale)), imaging.Lanczos)
+
+	focal := c.cropFocalPoint()
+	left := focalCropOffset(scaledImage.Bounds().Dx(), c.Width, focal.X)
+	top := focalCropOffset(scaledImage.Bounds().Dy(), c.Height, focal.Y)
+
+	return imaging.Crop(scaledImage, image.Rect(left, top, left+c.Width, top+c.Height))
+}
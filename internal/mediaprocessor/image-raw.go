@@ -0,0 +1,35 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// Camera RAW decoding using dcraw (https://www.dechifro.org/dcraw/), as neither libvips nor the
+// Go image libraries can read RAW files directly
+
+// decodeRaw decodes a camera RAW file using the dcraw at dcrawPath, returning the image in a format
+// which the image backends can read - the camera's embedded preview (usually JPEG) or a demosaiced TIFF
+func decodeRaw(dcrawPath string, path string, decoder RawDecoder) ([]byte, error) {
+	var args []string
+	switch decoder {
+	case RawPreview:
+		args = []string{"-e", "-c", path} // Extract embedded preview to stdout
+	case RawDemosaic:
+		args = []string{"-w", "-T", "-c", path} // Camera white balance, TIFF output to stdout
+	default:
+		return nil, fmt.Errorf("unknown raw decoder '%s'", decoder)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(dcrawPath, args...)
+	cmd.Stderr = &stderr
+
+	imgBytes, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("dcraw failed to decode '%s': %s: %s", path, err, stderr.String())
+	}
+
+	return imgBytes, nil
+}
@@ -0,0 +1,73 @@
+package mediaprocessor
+
+// #cgo pkg-config: vips
+// #include <vips/vips.h>
+//
+// // save_avif calls heifsave, which govips doesn't let set the chroma subsampling mode.
+// // The options are passed as varargs, which cgo can't call directly.
+// static int save_avif(const void *in, size_t in_len, void **out, size_t *out_len,
+//     int quality, int lossless, int effort, int strip, VipsForeignSubsample subsample) {
+// #if VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION < 13
+//   vips_error("pixel-slicer", "forcing avif chroma subsampling requires libvips 8.13 or later");
+//   return -1;
+// #else
+//   VipsImage *img = vips_image_new_from_buffer(in, in_len, "", NULL);
+//   if (img == NULL) {
+//     return -1;
+//   }
+//   int ret = vips_heifsave_buffer(img, out, out_len,
+//       "compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1,
+//       "Q", quality,
+//       "lossless", lossless,
+//       "effort", effort,
+//       "strip", strip,
+//       "subsample_mode", subsample,
+//       NULL);
+//   g_object_unref(img);
+//   return ret;
+// #endif
+// }
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	vips "github.com/davidbyttow/govips/v2/vips"
+)
+
+// exportSubsampledAvif encodes an image to AVIF with a forced chroma subsampling mode. The image
+// is passed to libvips as an uncompressed PNG, which keeps its alpha channel, colour profile and
+// EXIF and XMP metadata.
+func exportSubsampledAvif(img *vips.ImageRef, i *ImageConfiguration) ([]byte, error) {
+	pngParams := vips.NewPngExportParams()
+	pngParams.Compression = 0
+	pngBytes, _, err := img.ExportPng(pngParams)
+	if err != nil {
+		return nil, err
+	}
+
+	ep := getAvifExportParams(i)
+	var out unsafe.Pointer
+	var outLen C.size_t
+	ret := C.save_avif(
+		unsafe.Pointer(&pngBytes[0]), C.size_t(len(pngBytes)), &out, &outLen,
+		C.int(ep.Quality), C.int(boolToInt(ep.Lossless)), C.int(ep.Effort), C.int(boolToInt(ep.StripMetadata)),
+		C.VipsForeignSubsample(vipsSubsampleMode(i.ChromaSubsampling)),
+	)
+	if ret != 0 {
+		err := fmt.Errorf("unable to save avif: %s", C.GoString(C.vips_error_buffer()))
+		C.vips_error_clear()
+		return nil, err
+	}
+	defer C.g_free(C.gpointer(out))
+
+	return C.GoBytes(out, C.int(outLen)), nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
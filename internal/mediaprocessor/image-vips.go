@@ -1,10 +1,18 @@
 package mediaprocessor
 
 import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
 	"io/ioutil"
 	"log"
+	"math"
+	"os/exec"
+	"strings"
 
 	vips "github.com/davidbyttow/govips/v2/vips"
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
 )
 
 // N.B. Error: invalid flag in pkg-config --cflags: -Xpreprocessor ?
@@ -17,64 +25,394 @@ type ImageVips struct{}
 var STARTEDLIBVIPS bool
 
 func (i *ImageVips) Resize(m *MediaJob) (filenames []string, err error) {
-	imgOrig, err := vips.NewImageFromFile(m.InputFile.Path)
+	imgOrig, err := loadVipsImage(m)
 	if err != nil {
-		log.Fatalf("Could not load image")
+		log.Fatalf("Could not load image: %s", err)
 	}
 
-	for _, imageConfig := range m.MediaConfig.ImageConfigurations {
+	// Rotate the image upright, as libvips doesn't apply the EXIF orientation when resizing
+	if err := imgOrig.AutoRotate(); err != nil {
+		log.Fatalf("Could not rotate image: %s", err)
+	}
+
+	if m.MediaConfig.Placeholders {
+		if m.Placeholder, err = vipsPlaceholder(imgOrig); err != nil {
+			log.Fatalf("Could not generate placeholder: %s", err)
+		}
+	}
+
+	for _, imageConfig := range m.planImageVariants(imgOrig.Width(), imgOrig.Height()) {
+		outputFilepath := m.OutputPath(imageConfig)
+
+		// JPEG sources can be losslessly recompressed to JPEG XL, as long as they aren't resized.
+		// cjxl copies the JPEG's metadata and colour profile as-is, so it can't be used if either
+		// needs changing.
+		if imageConfig.FileType == JXL && imageConfig.LosslessJPEG &&
+			imgOrig.Format() == vips.ImageTypeJPEG && !pixelio.IsRawImage(m.InputFile) &&
+			imgOrig.Width() == imageConfig.MaxWidth && !imageConfig.IsCropped() && imageConfig.CropBox == nil &&
+			!removesVipsMetadata(imgOrig, imageConfig.Metadata) &&
+			(imageConfig.ColourProfile == ColourKeep || (imageConfig.ColourProfile == ColourSRGB && !imgOrig.HasICCProfile())) {
+			if err := recompressJpegToJxl(m.FSConfig.CjxlPath, m.InputFile.Path, outputFilepath); err != nil {
+				log.Fatalf("Failed to recompress JPEG to JPEG XL: %s", err)
+			}
+
+			filenames = append(filenames, outputFilepath)
+			m.addVariant(imageConfig, outputFilepath, imgOrig.Width(), imgOrig.Height())
+			continue
+		}
+
 		img, err := imgOrig.Copy()
 		if err != nil {
 			log.Fatalf("Error copying image")
 		}
 
-		// Scale image
-		err = img.Thumbnail(imageConfig.MaxWidth, 5000, vips.InterestingNone)
+		// Scale image, cropping if required
+		err = resizeVipsImage(img, imageConfig)
 		if err != nil {
-			log.Fatalf("Could not resize image")
+			log.Fatalf("Could not resize image: %s", err)
+		}
+
+		if err := applyColourPolicy(img, imageConfig); err != nil {
+			log.Fatalf("Could not convert image colour profile: %s", err)
+		}
+
+		// JPG has no alpha channel, so flatten transparent areas onto white rather than letting
+		// libvips flatten them onto black. Other formats keep their alpha channel.
+		if imageConfig.FileType == JPG && img.HasAlpha() {
+			if err := img.Flatten(&vips.Color{R: 255, G: 255, B: 255}); err != nil {
+				log.Fatalf("Could not flatten image: %s", err)
+			}
+		}
+
+		if err := applyMetadataPolicy(img, imageConfig.Metadata); err != nil {
+			log.Fatalf("Could not remove image metadata: %s", err)
 		}
 
-		var ep *vips.ExportParams
-		switch imageConfig.FileType {
-		case JPG:
-			ep = getJpgExportParams(imageConfig)
-		case WebP:
-			ep = getWebpExportParams(imageConfig)
-		default:
-			log.Fatalf("Undefined FileType '%s'", imageConfig.FileType)
+		if imageConfig.TargetQuality != nil {
+			if imageConfig, err = targetVipsQuality(img, imageConfig, m.FSConfig.ButteraugliPath); err != nil {
+				log.Fatalf("Could not search for target quality: %s", err)
+			}
 		}
 
-		imgBytes, _, err := img.Export(ep)
+		imgBytes, err := exportImage(img, imageConfig)
 		if err != nil {
 			log.Fatalf("Failed to export image: %s", err)
 		}
 
-		outputFilepath := m.OutputPath(imageConfig)
 		err = ioutil.WriteFile(outputFilepath, imgBytes, 0644)
 		if err != nil {
 			log.Fatalf("Unable to write file")
 		}
 
 		filenames = append(filenames, outputFilepath)
+		m.addVariant(imageConfig, outputFilepath, img.Width(), img.Height())
 	}
 
 	return
 }
 
-func getJpgExportParams(i *ImageConfiguration) *vips.ExportParams {
-	ep := vips.NewDefaultJPEGExportParams()
+// loadVipsImage loads a job's input file. libvips reads HEIC/HEIF files itself, but camera RAW
+// files must be decoded first.
+func loadVipsImage(m *MediaJob) (*vips.ImageRef, error) {
+	if !pixelio.IsRawImage(m.InputFile) {
+		return vips.NewImageFromFile(m.InputFile.Path)
+	}
+
+	imgBytes, err := decodeRaw(m.FSConfig.DcrawPath, m.InputFile.Path, m.MediaConfig.RawDecoder)
+	if err != nil {
+		return nil, err
+	}
+
+	return vips.NewImageFromBuffer(imgBytes)
+}
 
+// vipsPlaceholder generates a Placeholder from an image, with a tiny WebP data URI
+func vipsPlaceholder(imgOrig *vips.ImageRef) (*Placeholder, error) {
+	img, err := imgOrig.Copy()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := img.Thumbnail(placeholderHashSize, placeholderHashSize, vips.InterestingNone); err != nil {
+		return nil, err
+	}
+	if err := applyColourPolicy(img, &ImageConfiguration{ColourProfile: ColourSRGB}); err != nil {
+		return nil, err
+	}
+	pngBytes, _, err := img.ExportPng(vips.NewPngExportParams())
+	if err != nil {
+		return nil, err
+	}
+	pixels, err := png.Decode(bytes.NewReader(pngBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := img.Thumbnail(placeholderDataSize, placeholderDataSize, vips.InterestingNone); err != nil {
+		return nil, err
+	}
+	ep := vips.NewWebpExportParams()
 	ep.StripMetadata = true
+	ep.Quality = 50
+	webpBytes, _, err := img.ExportWebp(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPlaceholder(pixels, dataURI("image/webp", webpBytes))
+}
+
+// resizeVipsImage scales an image to an ImageConfiguration's width, and crops it to the
+// configured height if set. If there's a CropBox, the image is cropped to it first.
+func resizeVipsImage(img *vips.ImageRef, i *ImageConfiguration) error {
+	if i.CropBox != nil {
+		if err := img.ExtractArea(i.CropBox.Rect(img.Width(), img.Height())); err != nil {
+			return err
+		}
+	}
+
+	if !i.IsCropped() {
+		return img.Thumbnail(i.MaxWidth, 5000, vips.InterestingNone)
+	}
+
+	switch i.Crop {
+	case CropAttention:
+		return img.Thumbnail(i.Width, i.Height, vips.InterestingAttention)
+	case CropEntropy:
+		return img.Thumbnail(i.Width, i.Height, vips.InterestingEntropy)
+	case CropFocal:
+		return focalCropVipsImage(img, i.Width, i.Height, i.cropFocalPoint())
+	default:
+		return img.Thumbnail(i.Width, i.Height, vips.InterestingCentre)
+	}
+}
+
+// focalCropVipsImage scales an image to cover width x height, then crops it around a focal point
+func focalCropVipsImage(img *vips.ImageRef, width int, height int, focal *FocalPoint) error {
+	scale := math.Max(float64(width)/float64(img.Width()), float64(height)/float64(img.Height()))
+	if err := img.Resize(scale, vips.KernelLanczos3); err != nil {
+		return err
+	}
+
+	// Rounding may leave the scaled image a pixel short of the crop
+	width = int(math.Min(float64(width), float64(img.Width())))
+	height = int(math.Min(float64(height), float64(img.Height())))
+
+	left := focalCropOffset(img.Width(), width, focal.X)
+	top := focalCropOffset(img.Height(), height, focal.Y)
+
+	return img.ExtractArea(left, top, width, height)
+}
+
+// targetVipsQuality searches for the lowest quality at which an image meets its ImageConfiguration's
+// target, scoring each candidate by decoding its output and comparing it to the image
+func targetVipsQuality(img *vips.ImageRef, i *ImageConfiguration, butteraugliPath string) (*ImageConfiguration, error) {
+	reference, err := decodeVipsImage(img)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.searchTargetQuality(func(candidate *ImageConfiguration) (float64, error) {
+		imgBytes, err := exportImage(img, candidate)
+		if err != nil {
+			return 0, err
+		}
+		output, err := vips.NewImageFromBuffer(imgBytes)
+		if err != nil {
+			return 0, err
+		}
+		distorted, err := decodeVipsImage(output)
+		if err != nil {
+			return 0, err
+		}
+		return imageQualityScore(i.TargetQuality.Metric, butteraugliPath, reference, distorted)
+	})
+}
+
+// decodeVipsImage converts an image to a Go image, via PNG
+func decodeVipsImage(img *vips.ImageRef) (image.Image, error) {
+	ep := vips.NewPngExportParams()
+	ep.Compression = 1 // The PNG is decoded straight away, so isn't worth compressing
+	pngBytes, _, err := img.ExportPng(ep)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(pngBytes))
+}
+
+// exportImage encodes an image using the output format of the supplied ImageConfiguration
+func exportImage(img *vips.ImageRef, i *ImageConfiguration) (imgBytes []byte, err error) {
+	switch i.FileType {
+	case JPG:
+		imgBytes, _, err = img.ExportJpeg(getJpgExportParams(i))
+	case PNG:
+		imgBytes, _, err = img.ExportPng(getPngExportParams(i))
+	case WebP:
+		imgBytes, _, err = img.ExportWebp(getWebpExportParams(i))
+	case AVIF:
+		if i.ChromaSubsampling != SubsampleAuto {
+			return exportSubsampledAvif(img, i)
+		}
+		imgBytes, _, err = img.ExportAvif(getAvifExportParams(i))
+	case JXL:
+		imgBytes, _, err = img.ExportJxl(getJxlExportParams(i))
+	default:
+		err = fmt.Errorf("undefined FileType '%s'", i.FileType)
+	}
+
+	return
+}
+
+func getJpgExportParams(i *ImageConfiguration) *vips.JpegExportParams {
+	ep := vips.NewJpegExportParams()
+
+	ep.StripMetadata = stripVipsMetadata(i)
 	ep.Quality = i.Quality
+	ep.SubsampleMode = vipsSubsampleMode(i.ChromaSubsampling)
 
 	return ep
 }
 
-func getWebpExportParams(i *ImageConfiguration) *vips.ExportParams {
-	ep := vips.NewDefaultWEBPExportParams()
+func getPngExportParams(i *ImageConfiguration) *vips.PngExportParams {
+	ep := vips.NewPngExportParams()
 
-	ep.StripMetadata = true
+	ep.StripMetadata = stripVipsMetadata(i)
+	ep.Compression = i.Compression
+	ep.Palette = i.Palette
+	ep.Quality = i.Quality // Only used when quantising to a palette
+
+	return ep
+}
+
+func getWebpExportParams(i *ImageConfiguration) *vips.WebpExportParams {
+	ep := vips.NewWebpExportParams()
+
+	ep.StripMetadata = stripVipsMetadata(i)
 	ep.Quality = i.Quality
+	ep.Lossless = i.Lossless
+
+	return ep
+}
+
+func getAvifExportParams(i *ImageConfiguration) *vips.AvifExportParams {
+	ep := vips.NewAvifExportParams()
+
+	ep.StripMetadata = stripVipsMetadata(i)
+	ep.Quality = i.Quality
+	ep.Lossless = i.Lossless
+	ep.Effort = 9 - i.Speed // libvips effort runs in the opposite direction to speed
+
+	return ep
+}
+
+// getJxlExportParams uses the distance setting rather than quality, as libvips gives quality
+// precedence when both are set. libvips can't strip metadata when saving JPEG XL, so this relies
+// on applyMetadataPolicy.
+func getJxlExportParams(i *ImageConfiguration) *vips.JxlExportParams {
+	ep := vips.NewJxlExportParams()
+
+	ep.Quality = 0
+	ep.Distance = i.Distance
+	ep.Effort = i.Effort
+	ep.Lossless = i.Lossless
 
 	return ep
 }
+
+// applyColourPolicy converts an image to the colour profile required by an ImageConfiguration.
+// Images without an embedded profile are assumed to be sRGB, unless they're CMYK.
+func applyColourPolicy(img *vips.ImageRef, i *ImageConfiguration) error {
+	sourceProfile := vips.SRGBIEC6196621ICCProfilePath
+	if img.Interpretation() == vips.InterpretationCMYK {
+		sourceProfile = "cmyk" // libvips' built-in CMYK profile
+	}
+
+	switch i.ColourProfile {
+	case ColourKeep:
+		return nil
+	case ColourEmbed:
+		targetProfile := i.ICCProfile
+		if targetProfile == "" {
+			targetProfile = vips.SRGBV2MicroICCProfilePath
+		}
+		return img.TransformICCProfileWithFallback(targetProfile, sourceProfile)
+	default:
+		if img.HasICCProfile() || img.Interpretation() == vips.InterpretationCMYK {
+			if err := img.TransformICCProfileWithFallback(vips.SRGBIEC6196621ICCProfilePath, sourceProfile); err != nil {
+				return err
+			}
+		}
+		return img.RemoveICCProfile()
+	}
+}
+
+// stripVipsMetadata returns true if libvips should strip all metadata when saving an image, which
+// also removes its ICC profile
+func stripVipsMetadata(i *ImageConfiguration) bool {
+	return i.Metadata == MetadataStrip && i.ColourProfile == ColourSRGB
+}
+
+// applyMetadataPolicy removes the EXIF, XMP and IPTC metadata which a MetadataPolicy doesn't keep.
+// libvips rebuilds the EXIF block from the remaining exif- fields when the image is saved.
+func applyMetadataPolicy(img *vips.ImageRef, policy MetadataPolicy) error {
+	var keep []string
+	for _, field := range img.ImageFields() {
+		if !isVipsMetadataField(field) || keepsVipsMetadataField(policy, field) {
+			keep = append(keep, field)
+		}
+	}
+
+	return img.RemoveMetadata(keep...)
+}
+
+// removesVipsMetadata returns true if a MetadataPolicy would remove any of an image's metadata
+func removesVipsMetadata(img *vips.ImageRef, policy MetadataPolicy) bool {
+	for _, field := range img.ImageFields() {
+		if isVipsMetadataField(field) && !keepsVipsMetadataField(policy, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// isVipsMetadataField returns true if a libvips image field holds EXIF, XMP or IPTC metadata,
+// rather than describing the image data
+func isVipsMetadataField(field string) bool {
+	return strings.HasPrefix(field, "exif-") || field == "xmp-data" || field == "iptc-data"
+}
+
+// keepsVipsMetadataField returns true if a MetadataPolicy keeps a libvips metadata field.
+// libvips names EXIF fields by IFD, where IFD 0 is the main image and IFD 3 is GPS.
+func keepsVipsMetadataField(policy MetadataPolicy, field string) bool {
+	switch policy {
+	case MetadataCopyright:
+		return field == "exif-data" || field == "exif-ifd0-Copyright" || field == "exif-ifd0-Artist"
+	case MetadataNoGPS:
+		return !strings.HasPrefix(field, "exif-ifd3-") && field != "xmp-data"
+	default:
+		return false
+	}
+}
+
+// recompressJpegToJxl losslessly transcodes a JPEG file to JPEG XL using the cjxl at cjxlPath.
+// libvips always decodes to pixels, so can't preserve the original JPEG data.
+func recompressJpegToJxl(cjxlPath string, inputPath string, outputPath string) error {
+	cmd := exec.Command(cjxlPath, "--lossless_jpeg=1", inputPath, outputPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cjxl failed: %s: %s", err, output)
+	}
+
+	return nil
+}
+
+// vipsSubsampleMode maps a ChromaSubsampling mode to its libvips equivalent
+func vipsSubsampleMode(c ChromaSubsampling) vips.SubsampleMode {
+	switch c {
+	case Subsample420:
+		return vips.VipsForeignSubsampleOn
+	case Subsample444:
+		return vips.VipsForeignSubsampleOff
+	default:
+		return vips.VipsForeignSubsampleAuto
+	}
+}
@@ -0,0 +1,199 @@
+package mediaprocessor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// SourceManifest describes the output produced for an input file, so that consumers such as static
+// site generators don't need to guess filenames or read the input file again. Paths are relative
+// to the output dir, which makes them the S3 keys of uploaded files.
+type SourceManifest struct {
+	Source      string           `json:"source"` // Path of the input file, relative to the input dir
+	Input       *pixelio.Probe   `json:"input,omitempty"`
+	Variants    []*Variant       `json:"variants"`
+	Placeholder *Placeholder     `json:"placeholder,omitempty"`
+	Skipped     []SkippedVariant `json:"skipped,omitempty"`
+}
+
+// Variant describes an output file produced for an input file
+type Variant struct {
+	Path      string         `json:"path"`
+	MimeType  string         `json:"mimeType"`
+	Format    FileOutputType `json:"format"`
+	Codec     VideoCodec     `json:"codec,omitempty"`
+	Encoder   VideoEncoder   `json:"encoder,omitempty"`
+	Width     int            `json:"width"`
+	Height    int            `json:"height"`
+	Density   float64        `json:"density,omitempty"` // Device pixel ratio, for images expanded from a DPR list
+	Quality   int            `json:"quality,omitempty"` // Image quality, or video CRF. Omitted for lossless images
+	Lossless  bool           `json:"lossless,omitempty"`
+	Size      int64          `json:"size"`                // Size in bytes
+	SHA256    string         `json:"sha256"`              // Hex-encoded hash of the file's contents
+	Timestamp *float64       `json:"timestamp,omitempty"` // Position of a video thumbnail's frame in the source, in seconds
+	Animated  bool           `json:"animated,omitempty"`  // Set for animated video previews
+	Sprite    bool           `json:"sprite,omitempty"`    // Set for scrubbing sprite sheets, and their WebVTT track
+	Score     *QualityScore  `json:"score,omitempty"`     // Score of the Quality chosen by a target-quality search
+}
+
+// addVariant records an output file produced by a job, with its pixel dimensions
+func (m *MediaJob) addVariant(mediaConfiguration MediaConfiguration, outputPath string, width int, height int) *Variant {
+	variant := &Variant{
+		Path:   outputPath,
+		Width:  width,
+		Height: height,
+	}
+
+	switch c := mediaConfiguration.(type) {
+	case *ImageConfiguration:
+		variant.Format = c.FileType
+		variant.Density = c.density
+		variant.Lossless = c.IsLossless()
+		if !variant.Lossless {
+			variant.Quality = c.Quality
+		}
+		variant.Score = c.measured
+	case *VideoConfiguration:
+		variant.Format = c.FileType
+		variant.Quality = c.Quality
+		variant.Score = c.measured
+		if c.FileType.GetMediaType() == Video {
+			variant.Codec = c.Codec
+			variant.Encoder = c.Encoder
+		}
+		variant.Animated = c.Preview != nil
+		variant.Sprite = c.Sprite != nil
+	}
+
+	m.Variants = append(m.Variants, variant)
+	return variant
+}
+
+// ManifestPath returns the output path of a job's SourceManifest
+// e.g. output/subdir1/sunset.jpg.json
+func (m *MediaJob) ManifestPath() string {
+	return pixelio.GetSourceOutputPath(m.FSConfig.OutputDir, m.InputFile, ".json")
+}
+
+// buildManifest builds a job's SourceManifest from the variants it output, and keeps it on the
+// job, so that it can be written, used to generate snippets, and added to a RunManifest
+func (m *MediaJob) buildManifest() (*SourceManifest, error) {
+	if m.Manifest != nil {
+		return m.Manifest, nil
+	}
+
+	manifest := &SourceManifest{
+		Source:      filepath.Join(m.InputFile.Subdir, m.InputFile.Filename),
+		Input:       m.InputFile.Probe,
+		Variants:    []*Variant{},
+		Placeholder: m.Placeholder,
+	}
+	for _, v := range m.Variants {
+		variant := *v
+		if err := variant.hashFile(); err != nil {
+			return nil, err
+		}
+		variant.Path = pixelio.StripFileOutputDir(m.FSConfig.OutputDir, v.Path)
+		variant.MimeType = pixelio.ExtensionMimeType(v.Path)
+		manifest.Variants = append(manifest.Variants, &variant)
+	}
+	for _, skipped := range m.Skipped {
+		skipped.Path = pixelio.StripFileOutputDir(m.FSConfig.OutputDir, skipped.Path)
+		manifest.Skipped = append(manifest.Skipped, skipped)
+	}
+
+	m.Manifest = manifest
+	return manifest, nil
+}
+
+// WriteManifest writes a job's SourceManifest as JSON, returning its path
+func (m *MediaJob) WriteManifest() (string, error) {
+	manifest, err := m.buildManifest()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	manifestPath := m.ManifestPath()
+	if err := ioutil.WriteFile(manifestPath, data, 0644); err != nil {
+		return "", err
+	}
+
+	return manifestPath, nil
+}
+
+// hashFile sets the size and hash of a Variant from its output file
+func (v *Variant) hashFile() error {
+	f, err := os.Open(v.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+
+	v.Size = size
+	v.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// RunManifest aggregates the SourceManifests of every input file processed in a run.
+// It's shared between workers.
+type RunManifest struct {
+	mu      sync.Mutex
+	sources map[string]*SourceManifest
+}
+
+// NewRunManifest returns an empty RunManifest
+func NewRunManifest() *RunManifest {
+	return &RunManifest{sources: make(map[string]*SourceManifest)}
+}
+
+// Add adds an input file's SourceManifest, replacing any earlier manifest for the same file
+func (r *RunManifest) Add(manifest *SourceManifest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sources[manifest.Source] = manifest
+}
+
+// Write writes the RunManifest as JSON, with its sources sorted by path
+func (r *RunManifest) Write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sources := []*SourceManifest{}
+	for _, manifest := range r.sources {
+		sources = append(sources, manifest)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Source < sources[j].Source })
+
+	data, err := json.MarshalIndent(struct {
+		Sources []*SourceManifest `json:"sources"`
+	}{sources}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := pixelio.EnsureDirExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,169 @@
+package mediaprocessor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+func TestAddVariant(t *testing.T) {
+	tests := []struct {
+		name   string
+		config MediaConfiguration
+		want   Variant
+	}{
+		{
+			"lossy image", &ImageConfiguration{FileType: WebP, Quality: 80},
+			Variant{Format: WebP, Quality: 80},
+		},
+		{
+			"lossless image omits quality", &ImageConfiguration{FileType: PNG, Quality: 80},
+			Variant{Format: PNG, Lossless: true},
+		},
+		{
+			"dpr variant", &ImageConfiguration{FileType: JPG, Quality: 80, density: 2},
+			Variant{Format: JPG, Quality: 80, Density: 2},
+		},
+		{
+			"video", &VideoConfiguration{FileType: MP4, Codec: H264, Encoder: "libx264", Quality: 23},
+			Variant{Format: MP4, Codec: H264, Encoder: "libx264", Quality: 23},
+		},
+		{
+			"video thumbnail has no codec", &VideoConfiguration{FileType: JPG, Codec: H264, Quality: 80},
+			Variant{Format: JPG, Quality: 80},
+		},
+		{
+			"animated preview", &VideoConfiguration{FileType: WebP, Quality: 80, Preview: &PreviewConfiguration{}},
+			Variant{Format: WebP, Quality: 80, Animated: true},
+		},
+		{
+			"sprite sheet", &VideoConfiguration{FileType: JPG, Quality: 80, Sprite: &SpriteConfiguration{}},
+			Variant{Format: JPG, Quality: 80, Sprite: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaJob{}
+			got := m.addVariant(tt.config, "output/sunset.out", 400, 300)
+
+			want := tt.want
+			want.Path, want.Width, want.Height = "output/sunset.out", 400, 300
+			if !reflect.DeepEqual(*got, want) {
+				t.Errorf("addVariant() = %+v, want %+v", *got, want)
+			}
+			if len(m.Variants) != 1 || m.Variants[0] != got {
+				t.Error("addVariant() didn't record the variant on the job")
+			}
+		})
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outputPath := filepath.Join(dir, "holiday", "sunset.jpg-800.webp")
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(outputPath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &MediaJob{
+		FSConfig:  &FSConfig{OutputDir: dir},
+		InputFile: &pixelio.InputFile{Filename: "sunset.jpg", Subdir: "holiday"},
+		Skipped:   []SkippedVariant{{Path: filepath.Join(dir, "holiday", "sunset.jpg-4000.webp"), Reason: SkipUpscale}},
+	}
+	m.addVariant(&ImageConfiguration{FileType: WebP, Quality: 80}, outputPath, 800, 600)
+
+	manifest, err := m.buildManifest()
+	if err != nil {
+		t.Fatalf("buildManifest() error = %v", err)
+	}
+
+	want := &SourceManifest{
+		Source: "holiday/sunset.jpg",
+		Variants: []*Variant{{
+			Path:     "holiday/sunset.jpg-800.webp",
+			MimeType: "image/webp",
+			Format:   WebP,
+			Width:    800,
+			Height:   600,
+			Quality:  80,
+			Size:     5,
+			SHA256:   "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		}},
+		Skipped: []SkippedVariant{{Path: "holiday/sunset.jpg-4000.webp", Reason: SkipUpscale}},
+	}
+	if !reflect.DeepEqual(manifest, want) {
+		t.Errorf("buildManifest() = %+v, want %+v", manifest, want)
+	}
+	if m.Variants[0].Path != outputPath {
+		t.Error("buildManifest() modified the job's variants")
+	}
+
+	if again, _ := m.buildManifest(); again != manifest {
+		t.Error("buildManifest() built the manifest again, rather than reusing it")
+	}
+	if path := m.ManifestPath(); path != filepath.Join(dir, "holiday", "sunset.jpg.json") {
+		t.Errorf("ManifestPath() = %s", path)
+	}
+
+	m.Manifest = nil
+	if err := os.Remove(outputPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.buildManifest(); err == nil {
+		t.Error("buildManifest() didn't return an error for a missing variant")
+	}
+}
+
+func TestRunManifestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	run := NewRunManifest()
+	run.Add(&SourceManifest{Source: "b.jpg", Variants: []*Variant{}})
+	run.Add(&SourceManifest{Source: "a.jpg", Variants: []*Variant{}})
+	run.Add(&SourceManifest{Source: "b.jpg", Variants: []*Variant{{Path: "b-800.jpg"}}})
+
+	path := filepath.Join(dir, "manifests", "run.json")
+	if err := run.Write(path); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written struct {
+		Sources []*SourceManifest `json:"sources"`
+	}
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+
+	var sources []string
+	for _, s := range written.Sources {
+		sources = append(sources, s.Source)
+	}
+	if !reflect.DeepEqual(sources, []string{"a.jpg", "b.jpg"}) {
+		t.Errorf("Write() wrote sources %v, want them sorted without duplicates", sources)
+	}
+	if len(written.Sources[1].Variants) != 1 {
+		t.Error("Write() didn't replace an earlier manifest for the same source")
+	}
+}
@@ -17,8 +17,13 @@ type ImageProcessor interface {
 
 // VideoProcessor is an interface for types which can process videos
 type VideoProcessor interface {
-	Thumbnail(*MediaJob, *VideoConfiguration) error
+	Thumbnail(m *MediaJob, videoConfig *VideoConfiguration, seconds float64, outputPath string) error
+	Preview(m *MediaJob, videoConfig *VideoConfiguration, clips []PreviewClip) error
+	Sprite(m *MediaJob, videoConfig *VideoConfiguration, grid SpriteGrid, outputPattern string) error
+	TranscodeChunk(m *MediaJob, chunk *VideoChunk) error
+	Concat(m *MediaJob, videoConfig *VideoConfiguration, chunkPaths []string) error
 	Transcode(*MediaJob, *VideoConfiguration) error
+	Segment(m *MediaJob, rendition *VideoConfiguration, options SegmentOptions) error
 }
 
 type MediaProcessor struct {
@@ -43,6 +48,13 @@ type MediaJob struct {
 	S3Client       *s3.S3Client
 	InputFile      *pixelio.InputFile
 	MediaProcessor *MediaProcessor
+	RunManifest    *RunManifest     // Manifest aggregating every job in the run, if enabled
+	Variants       []*Variant       // Variants output by the job
+	Skipped        []SkippedVariant // Variants which weren't output, as the input file was too small
+	Placeholder    *Placeholder     // Placeholder for an image input file, if enabled
+	Manifest       *SourceManifest  // Manifest of the job's output, once written
+	ChunkQueue     chan MediaJob    // Queue of chunk jobs for the worker pool. Videos aren't chunked if nil
+	Chunk          *VideoChunk      // Set for chunk jobs, which encode a section of a video for their parent job
 }
 
 // OutputPath returns the full output path for a MediaJob with a specific MediaConfiguration
@@ -64,6 +76,17 @@ func (m *MediaJob) CheckOutputDir() {
 
 // ProcessImage dispatches an image resize job to the configured ImageProcessor
 func (m *MediaJob) ProcessImage() (filenames []string, err error) {
+	// Apply any per-image settings from the input file's sidecar
+	if m.InputFile.Sidecar != "" {
+		sidecar, err := ReadSidecar(m.InputFile.Sidecar)
+		if err != nil {
+			return nil, err
+		}
+		if m.MediaConfig, err = m.MediaConfig.ApplySidecar(sidecar); err != nil {
+			return nil, err
+		}
+	}
+
 	if len(m.MediaConfig.ImageConfigurations) == 0 {
 		return
 	}
@@ -71,12 +94,35 @@ func (m *MediaJob) ProcessImage() (filenames []string, err error) {
 	// Image encoding is more efficient if image file is read in and decoded once
 	// and output at multiple sizes, so this is performed in Resize()
 	m.CheckOutputDir()
-	return m.MediaProcessor.Image.Resize(m)
+	if filenames, err = m.MediaProcessor.Image.Resize(m); err != nil {
+		return nil, err
+	}
+
+	// Placeholders are published in the image's SourceManifest
+	if m.FSConfig.Manifest || m.MediaConfig.Placeholders {
+		manifestPath, err := m.WriteManifest()
+		if err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, manifestPath)
+	}
+
+	if m.FSConfig.HTML {
+		snippetPath, err := m.WriteSnippet(Image)
+		if err != nil {
+			return nil, err
+		}
+		if snippetPath != "" {
+			filenames = append(filenames, snippetPath)
+		}
+	}
+
+	return filenames, nil
 }
 
 // ProcessVideo dispatchse a video resize job to the configured VideoProcessor
 func (m *MediaJob) ProcessVideo() (filenames []string, errs error) {
-	if len(m.MediaConfig.VideoConfigurations) == 0 {
+	if len(m.MediaConfig.VideoConfigurations) == 0 && m.MediaConfig.HLS == nil {
 		return
 	}
 
@@ -84,29 +130,119 @@ func (m *MediaJob) ProcessVideo() (filenames []string, errs error) {
 
 	m.CheckOutputDir()
 
-	// Video encoding doesn't store the file in memory, so iterate through the MediaTypes here
+	// Segmented configurations are output together, as an adaptive streaming ladder
+	var videoConfigs, cmafConfigs []*VideoConfiguration
 	for _, videoConfig := range m.MediaConfig.VideoConfigurations {
+		if videoConfig.FileType == CMAF {
+			cmafConfigs = append(cmafConfigs, videoConfig)
+		} else {
+			videoConfigs = append(videoConfigs, videoConfig)
+		}
+	}
+
+	if len(videoConfigs) > 0 && m.MediaConfig.Upscale != UpscaleAllow {
+		probe, err := m.Probe()
+		if err != nil {
+			return nil, err
+		}
+		videoConfigs = m.planVideoVariants(videoConfigs, probe.Width, func(v *VideoConfiguration) string { return m.OutputPath(v) })
+	}
+
+	// Video encoding doesn't store the file in memory, so iterate through the MediaTypes here
+	for _, videoConfig := range videoConfigs {
+		var outputs []videoOutput
 		var err error
 		encodeStartTime := time.Now()
 
-		// Depending on the requested media type, either transcode video or generate a thumbnail
+		// Depending on the requested media type, either transcode video or generate thumbnails
 		switch videoConfig.FileType.GetMediaType() {
 		case Image:
-			err = m.MediaProcessor.Video.Thumbnail(m, videoConfig)
+			switch {
+			case videoConfig.Preview != nil:
+				outputs, err = m.processPreview(videoConfig)
+			case videoConfig.Sprite != nil:
+				outputs, err = m.processSprite(videoConfig)
+			default:
+				outputs, err = m.processThumbnails(videoConfig)
+			}
 		case Video:
-			err = m.MediaProcessor.Video.Transcode(m, videoConfig)
+			// Encode at the CRF chosen by a target-quality search, which is recorded for the output
+			if videoConfig.TargetQuality != nil {
+				if videoConfig, err = m.targetVideoQuality(videoConfig); err != nil {
+					break
+				}
+			}
+			if m.shouldChunk(videoConfig) {
+				err = m.transcodeChunked(videoConfig)
+			} else {
+				err = m.MediaProcessor.Video.Transcode(m, videoConfig)
+			}
+			if err == nil {
+				outputs = []videoOutput{{Path: m.OutputPath(videoConfig)}}
+			}
 		default:
 			err = fmt.Errorf("configuration contains unknown media type: %s", videoConfig.FileType)
 		}
 
 		fmt.Printf("Encoding took %.2fs\n", time.Since(encodeStartTime).Seconds())
 
-		if err == nil {
-			outputFilepath := m.OutputPath(videoConfig)
-			filenames = append(filenames, outputFilepath)
-		} else {
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+
+		for _, output := range outputs {
+			filenames = append(filenames, output.Path)
+			if m.FSConfig.Manifest || m.FSConfig.HTML {
+				width, height := output.Width, output.Height
+				if !output.Sized {
+					probe, err := pixelio.ProbeVideo(output.Path, m.FSConfig.FFprobePath)
+					if err != nil {
+						errs = multierror.Append(errs, err)
+					} else {
+						width, height = probe.Width, probe.Height
+					}
+				}
+				variant := m.addVariant(videoConfig, output.Path, width, height)
+				variant.Timestamp = output.Timestamp
+				if output.Format != "" {
+					variant.Format, variant.Quality = output.Format, 0
+				}
+			}
+		}
+	}
+
+	if m.MediaConfig.HLS != nil {
+		hlsFilenames, err := m.ProcessHLS()
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		filenames = append(filenames, hlsFilenames...)
+	}
+
+	if len(cmafConfigs) > 0 {
+		cmafFilenames, err := m.ProcessCMAF(cmafConfigs)
+		if err != nil {
 			errs = multierror.Append(errs, err)
 		}
+		filenames = append(filenames, cmafFilenames...)
+	}
+
+	if m.FSConfig.Manifest {
+		manifestPath, err := m.WriteManifest()
+		if err != nil {
+			return filenames, multierror.Append(errs, err)
+		}
+		filenames = append(filenames, manifestPath)
+	}
+
+	if m.FSConfig.HTML {
+		snippetPath, err := m.WriteSnippet(Video)
+		if err != nil {
+			return filenames, multierror.Append(errs, err)
+		}
+		if snippetPath != "" {
+			filenames = append(filenames, snippetPath)
+		}
 	}
 
 	return
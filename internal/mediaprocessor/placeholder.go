@@ -0,0 +1,213 @@
+package mediaprocessor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+// Placeholder contains compact previews of an image, which can be shown while the image loads
+type Placeholder struct {
+	BlurHash       string `json:"blurHash"`       // https://blurha.sh
+	ThumbHash      string `json:"thumbHash"`      // Base64-encoded, https://evanw.github.io/thumbhash/
+	DataURI        string `json:"dataUri"`        // A tiny version of the image, as a base64 data URI
+	DominantColour string `json:"dominantColour"` // e.g. #a0b1c2
+}
+
+// Sizes of the images placeholders are generated from
+const (
+	placeholderHashSize = 100 // ThumbHash doesn't accept images larger than 100x100
+	placeholderDataSize = 16
+)
+
+// newPlaceholder generates a Placeholder from a small sRGB version of an image, no larger than
+// placeholderHashSize, and a data URI of a tiny version of the image
+func newPlaceholder(img image.Image, dataURI string) (*Placeholder, error) {
+	pixels := imaging.Clone(img)
+
+	// Use more components along the longer side of the image
+	xComponents, yComponents := 4, 3
+	if pixels.Bounds().Dy() > pixels.Bounds().Dx() {
+		xComponents, yComponents = 3, 4
+	}
+	blurHash, err := blurhash.Encode(xComponents, yComponents, pixels)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Placeholder{
+		BlurHash:       blurHash,
+		ThumbHash:      base64.StdEncoding.EncodeToString(thumbHash(pixels)),
+		DataURI:        dataURI,
+		DominantColour: dominantColour(pixels),
+	}, nil
+}
+
+// dataURI encodes image data as a base64 data URI
+func dataURI(mimeType string, data []byte) string {
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data))
+}
+
+// dominantColour finds the most common colour in an image, ignoring transparent areas. Colours
+// are grouped into bins, and the average of the largest bin is returned as a hex colour.
+func dominantColour(img *image.NRGBA) string {
+	type bin struct{ count, r, g, b int }
+	bins := make(map[int]*bin)
+	var largest *bin
+
+	for offset := 0; offset+3 < len(img.Pix); offset += 4 {
+		r, g, b, a := int(img.Pix[offset]), int(img.Pix[offset+1]), int(img.Pix[offset+2]), img.Pix[offset+3]
+		if a < 128 {
+			continue
+		}
+
+		key := r>>4<<8 | g>>4<<4 | b>>4
+		if bins[key] == nil {
+			bins[key] = &bin{}
+		}
+		c := bins[key]
+		c.count++
+		c.r, c.g, c.b = c.r+r, c.g+g, c.b+b
+		if largest == nil || c.count > largest.count {
+			largest = c
+		}
+	}
+
+	if largest == nil {
+		return "#ffffff" // Fully transparent
+	}
+	return fmt.Sprintf("#%02x%02x%02x", largest.r/largest.count, largest.g/largest.count, largest.b/largest.count)
+}
+
+// thumbHash encodes an image of up to 100x100 pixels as a ThumbHash. This follows the reference
+// implementation at https://github.com/evanw/thumbhash
+func thumbHash(img *image.NRGBA) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	rgba := img.Pix
+
+	// Determine the average colour
+	var avgR, avgG, avgB, avgA float64
+	for i := 0; i < w*h; i++ {
+		alpha := float64(rgba[i*4+3]) / 255
+		avgR += alpha / 255 * float64(rgba[i*4])
+		avgG += alpha / 255 * float64(rgba[i*4+1])
+		avgB += alpha / 255 * float64(rgba[i*4+2])
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+
+	hasAlpha := avgA < float64(w*h)
+	lLimit := 7.0
+	if hasAlpha {
+		lLimit = 5 // Use fewer luminance bits if there's alpha
+	}
+	longest := math.Max(float64(w), float64(h))
+	lx := int(math.Max(1, math.Round(lLimit*float64(w)/longest)))
+	ly := int(math.Max(1, math.Round(lLimit*float64(h)/longest)))
+
+	// Convert the image from RGBA to LPQA, composited over the average colour
+	l := make([]float64, w*h) // Luminance
+	p := make([]float64, w*h) // Yellow - blue
+	q := make([]float64, w*h) // Red - green
+	a := make([]float64, w*h) // Alpha
+	for i := 0; i < w*h; i++ {
+		alpha := float64(rgba[i*4+3]) / 255
+		r := avgR*(1-alpha) + alpha/255*float64(rgba[i*4])
+		g := avgG*(1-alpha) + alpha/255*float64(rgba[i*4+1])
+		b := avgB*(1-alpha) + alpha/255*float64(rgba[i*4+2])
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	// Encode each channel using the DCT, into a constant term and normalised varying terms
+	encodeChannel := func(channel []float64, nx int, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				var f float64
+				for x := 0; x < w; x++ {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+				}
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(w * h)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+		return
+	}
+	lDC, lAC, lScale := encodeChannel(l, maxInt(3, lx), maxInt(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+	var aDC, aScale float64
+	var aAC []float64
+	if hasAlpha {
+		aDC, aAC, aScale = encodeChannel(a, 5, 5)
+	}
+
+	// Write the constants
+	round := func(v float64) int { return int(math.Round(v)) }
+	isLandscape := w > h
+	header24 := round(63*lDC) | round(31.5+31.5*pDC)<<6 | round(31.5+31.5*qDC)<<12 | round(31*lScale)<<18
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	header16 := round(63*pScale)<<3 | round(63*qScale)<<9
+	if isLandscape {
+		header16 |= ly | 1<<15
+	} else {
+		header16 |= lx
+	}
+	hash := []byte{byte(header24), byte(header24 >> 8), byte(header24 >> 16), byte(header16), byte(header16 >> 8)}
+	channels := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		hash = append(hash, byte(round(15*aDC)|round(15*aScale)<<4))
+		channels = append(channels, aAC)
+	}
+
+	// Write the varying terms, two to a byte
+	acStart := len(hash)
+	acIndex := 0
+	for _, ac := range channels {
+		for _, f := range ac {
+			if acStart+acIndex>>1 >= len(hash) {
+				hash = append(hash, 0)
+			}
+			hash[acStart+acIndex>>1] |= byte(round(15*f) << uint((acIndex&1)<<2))
+			acIndex++
+		}
+	}
+
+	return hash
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,144 @@
+package mediaprocessor
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// testSolid returns an image filled with a single colour
+func testSolid(width int, height int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// testGradient returns an opaque image with a diagonal gradient, so that it has some structure
+func testGradient(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / width), uint8(y * 255 / height), uint8((x + y) % 256), 255})
+		}
+	}
+	return img
+}
+
+// thumbHashAverage decodes the average colour from a ThumbHash's header, as the reference
+// implementation's thumbHashToAverageRGBA does
+func thumbHashAverage(hash []byte) (r, g, b, a float64) {
+	header := int(hash[0]) | int(hash[1])<<8 | int(hash[2])<<16
+	l := float64(header&63) / 63
+	p := float64(header>>6&63)/31.5 - 1
+	q := float64(header>>12&63)/31.5 - 1
+	a = 1
+	if header>>23 != 0 {
+		a = float64(hash[5]&15) / 15
+	}
+	b = l - 2.0/3.0*p
+	r = (3*l - b + q) / 2
+	g = r - q
+	return
+}
+
+func TestThumbHash(t *testing.T) {
+	halfTransparent := testSolid(100, 100, color.NRGBA{0, 0, 255, 255})
+	for y := 0; y < 100; y++ {
+		for x := 50; x < 100; x++ {
+			halfTransparent.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 0})
+		}
+	}
+
+	tests := []struct {
+		name                       string
+		img                        *image.NRGBA
+		wantLength                 int
+		wantAlpha, wantLandscape   bool
+		wantR, wantG, wantB, wantA float64
+	}{
+		{"solid landscape", testSolid(100, 75, color.NRGBA{255, 0, 0, 255}), 21, false, true, 1, 0, 0, 1},
+		{"solid portrait", testSolid(75, 100, color.NRGBA{0, 255, 0, 255}), 21, false, false, 0, 1, 0, 1},
+		{"solid square", testSolid(100, 100, color.NRGBA{255, 255, 255, 255}), 24, false, false, 1, 1, 1, 1},
+		{"transparent areas ignored in the average", halfTransparent, 25, true, false, 0, 0, 1, 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := thumbHash(tt.img)
+			if len(hash) != tt.wantLength {
+				t.Fatalf("thumbHash() is %d bytes, want %d", len(hash), tt.wantLength)
+			}
+			if hasAlpha := hash[2]&0x80 != 0; hasAlpha != tt.wantAlpha {
+				t.Errorf("thumbHash() has alpha %t, want %t", hasAlpha, tt.wantAlpha)
+			}
+			if isLandscape := hash[4]&0x80 != 0; isLandscape != tt.wantLandscape {
+				t.Errorf("thumbHash() is landscape %t, want %t", isLandscape, tt.wantLandscape)
+			}
+
+			r, g, b, a := thumbHashAverage(hash)
+			if math.Abs(r-tt.wantR) > 0.05 || math.Abs(g-tt.wantG) > 0.05 || math.Abs(b-tt.wantB) > 0.05 || math.Abs(a-tt.wantA) > 0.05 {
+				t.Errorf("thumbHash() average colour = (%.2f, %.2f, %.2f, %.2f), want (%g, %g, %g, %g)", r, g, b, a, tt.wantR, tt.wantG, tt.wantB, tt.wantA)
+			}
+		})
+	}
+}
+
+func TestThumbHashVaryingTerms(t *testing.T) {
+	// A solid image has no varying terms, so their scales round to zero
+	solid := thumbHash(testSolid(100, 75, color.NRGBA{40, 80, 120, 255}))
+	if lScale := solid[2] >> 2 & 31; lScale != 0 {
+		t.Errorf("thumbHash() of a solid image has luminance scale %d, want 0", lScale)
+	}
+	if pScale, qScale := int(solid[3])>>3|int(solid[4]&1)<<5, solid[4]>>1&63; pScale != 0 || qScale != 0 {
+		t.Errorf("thumbHash() of a solid image has colour scales %d and %d, want 0", pScale, qScale)
+	}
+
+	// A gradient's varying terms are normalised, so the largest is encoded as 0 or 15
+	hash := thumbHash(testGradient(100, 75))
+	extreme := false
+	for _, v := range hash[5:] {
+		if v&15 == 0 || v&15 == 15 || v>>4 == 0 || v>>4 == 15 {
+			extreme = true
+		}
+	}
+	if !extreme {
+		t.Errorf("thumbHash() of a gradient has no normalised varying terms: %x", hash)
+	}
+	if lx := int(hash[3] & 7); lx != 5 {
+		t.Errorf("thumbHash() encodes %d luminance rows, want 5", lx)
+	}
+}
+
+func TestDominantColour(t *testing.T) {
+	mostlyRed := testSolid(10, 10, color.NRGBA{250, 10, 10, 255})
+	for x := 0; x < 10; x++ {
+		mostlyRed.SetNRGBA(x, 0, color.NRGBA{0, 0, 255, 255})
+	}
+	hiddenBlue := testSolid(10, 10, color.NRGBA{0, 0, 255, 0})
+	for x := 0; x < 10; x++ {
+		hiddenBlue.SetNRGBA(x, 0, color.NRGBA{0, 255, 0, 255})
+	}
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+		want string
+	}{
+		{"largest bin", mostlyRed, "#fa0a0a"},
+		{"transparent pixels ignored", hiddenBlue, "#00ff00"},
+		{"fully transparent", testSolid(10, 10, color.NRGBA{0, 0, 0, 0}), "#ffffff"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dominantColour(tt.img); got != tt.want {
+				t.Errorf("dominantColour() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// ProbeInputFiles calls ProbeInputFile for each file, reporting any errors
+func ProbeInputFiles(files []*pixelio.InputFile, ffprobePath string, dcrawPath string) {
+	for _, file := range files {
+		if err := ProbeInputFile(file, ffprobePath, dcrawPath); err != nil {
+			fmt.Printf("Unable to probe '%s': %s\n", file.Path, err)
+		}
+	}
+}
+
+// ProbeInputFile inspects a file before it's processed, filling in its Probe. Videos are probed
+// with the ffprobe at ffprobePath, and images by reading their header with libvips, using the
+// dcraw at dcrawPath for RAW images. libvips must be started first.
+func ProbeInputFile(file *pixelio.InputFile, ffprobePath string, dcrawPath string) (err error) {
+	switch pixelio.GetMediaType(file) {
+	case string(Image):
+		file.Probe, err = probeImage(file, dcrawPath)
+	case string(Video):
+		file.Probe, err = pixelio.ProbeVideo(file.Path, ffprobePath)
+	default:
+		err = fmt.Errorf("unable to probe unknown media type")
+	}
+	return
+}
+
+// probeImage reads an image's size from its header. The width and height are swapped for images
+// with an EXIF orientation which rotates them by 90 degrees, as images are auto-rotated before
+// they're resized. RAW images are measured from their embedded preview, which is cheap to extract.
+func probeImage(file *pixelio.InputFile, dcrawPath string) (*pixelio.Probe, error) {
+	var img *vips.ImageRef
+	var err error
+	if pixelio.IsRawImage(file) {
+		var imgBytes []byte
+		if imgBytes, err = decodeRaw(dcrawPath, file.Path, RawPreview); err == nil {
+			img, err = vips.NewImageFromBuffer(imgBytes)
+		}
+	} else {
+		img, err = vips.NewImageFromFile(file.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	probe := &pixelio.Probe{
+		Width:    img.Width(),
+		Height:   img.Height(),
+		Rotation: exifOrientationRotation[img.Orientation()],
+		HasAlpha: img.HasAlpha(),
+	}
+	if probe.Rotation%180 == 90 {
+		probe.Width, probe.Height = probe.Height, probe.Width
+	}
+	return probe, nil
+}
+
+// exifOrientationRotation is the clockwise rotation applied by each EXIF orientation. Mirrored
+// orientations are included, as they rotate the image too.
+var exifOrientationRotation = map[int]int{3: 180, 4: 180, 5: 90, 6: 90, 7: 270, 8: 270}
+
+// Probe returns the job's InputFile's Probe, probing the file if it hasn't been already
+func (m *MediaJob) Probe() (*pixelio.Probe, error) {
+	if m.InputFile.Probe == nil {
+		if err := ProbeInputFile(m.InputFile, m.FSConfig.FFprobePath, m.FSConfig.DcrawPath); err != nil {
+			return nil, err
+		}
+	}
+	return m.InputFile.Probe, nil
+}
+
+// EstimatedWork estimates how much work a job involves, in megapixels encoded, for reporting
+// progress. Videos are weighted by their number of frames, video thumbnails count as a frame
+// per thumbnail, and animated previews by their number of frames. Jobs which haven't been probed, or produce little output, count as 1.
+func (m *MediaJob) EstimatedWork() int {
+	probe := m.InputFile.Probe
+	if probe == nil || probe.Width == 0 || probe.Height == 0 {
+		return 1
+	}
+
+	var pixels float64
+	switch pixelio.GetMediaType(m.InputFile) {
+	case string(Image):
+		for _, c := range m.MediaConfig.ImageConfigurations {
+			if c.duplicate {
+				continue
+			}
+			fitted, _ := c.fitSource(probe.Width, probe.Height)
+			outputPixels := scaledPixels(probe, fitted.MaxWidth)
+			if fitted.IsCropped() {
+				outputPixels = float64(fitted.Width * fitted.Height)
+			}
+			// Target-quality searches encode the image once for each quality they try
+			if c.TargetQuality != nil {
+				outputPixels *= 1 + c.TargetQuality.searchSteps()
+			}
+			pixels += outputPixels
+		}
+	case string(Video):
+		frames := float64(probe.Frames())
+		configs := m.MediaConfig.VideoConfigurations
+		if m.MediaConfig.HLS != nil {
+			configs = append(append([]*VideoConfiguration{}, configs...), m.MediaConfig.HLS.Renditions...)
+		}
+		for _, c := range configs {
+			fitted, _ := c.fitSource(probe.Width)
+			if c.FileType.GetMediaType() == Image {
+				outputFrames := 1.0
+				if c.Preview != nil {
+					outputFrames = c.Preview.Duration * c.Preview.FrameRate
+				} else if c.Sprite != nil {
+					outputFrames = math.Ceil(probe.Duration / c.Sprite.Interval)
+				} else if c.Thumbnail != nil && c.Thumbnail.Mode == ThumbnailCount {
+					outputFrames = float64(c.Thumbnail.Count)
+				}
+				pixels += scaledPixels(probe, fitted.MaxWidth) * outputFrames
+			} else {
+				pixels += scaledPixels(probe, fitted.MaxWidth) * frames
+				// Target-quality searches encode the sample segments once for each CRF they try
+				if c.TargetQuality != nil {
+					sampleFrames := math.Min(frames, float64(c.TargetQuality.Samples)*c.TargetQuality.SampleDuration*probe.FrameRate)
+					pixels += scaledPixels(probe, fitted.MaxWidth) * sampleFrames * c.TargetQuality.searchSteps()
+				}
+			}
+		}
+	}
+
+	return int(math.Max(1, math.Ceil(pixels/1e6)))
+}
+
+// scaledPixels returns the number of pixels in a probed source, scaled down to a width
+func scaledPixels(probe *pixelio.Probe, width int) float64 {
+	width = int(math.Min(float64(width), float64(probe.Width)))
+	return float64(width) * float64(width) * float64(probe.Height) / float64(probe.Width)
+}
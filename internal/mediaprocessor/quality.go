@@ -0,0 +1,226 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Target-quality searches, which choose each output's Quality by encoding it at several settings
+// and scoring the results with a perceptual quality metric. The search is run here, so that a
+// processor only needs to encode at a given setting and decode its output.
+
+// QualityScore is the score of the Quality chosen by a target-quality search
+type QualityScore struct {
+	Metric QualityMetric `json:"metric"`
+	Target float64       `json:"target"`
+	Value  float64       `json:"value"`
+}
+
+// meets reports whether a score meets the target. Butteraugli measures distance from the
+// source, so lower scores are better, while higher scores are better for the other metrics.
+func (t *TargetQualityConfiguration) meets(score float64) bool {
+	if t.Metric == MetricButteraugli {
+		return score <= t.Target
+	}
+	return score >= t.Target
+}
+
+// searchQuality binary searches the settings from worst to best, inclusive, for the one closest
+// to worst whose score meets the target, assuming that scores improve towards best. If no setting
+// meets the target, best is chosen. Settings are scored at most once.
+func (t *TargetQualityConfiguration) searchQuality(worst int, best int, score func(setting int) (float64, error)) (*QualityScore, int, error) {
+	direction := 1
+	if best < worst {
+		direction = -1
+	}
+	setting := func(step int) int { return worst + direction*step }
+
+	scores := make(map[int]float64)
+	scoreStep := func(step int) (float64, error) {
+		if s, ok := scores[step]; ok {
+			return s, nil
+		}
+		s, err := score(setting(step))
+		if err != nil {
+			return 0, err
+		}
+		fmt.Printf("Quality %d scored %s %.4f\n", setting(step), t.Metric, s)
+		scores[step] = s
+		return s, nil
+	}
+
+	steps := (best - worst) * direction
+	chosen := steps
+	for low, high := 0, steps; low <= high; {
+		middle := (low + high) / 2
+		s, err := scoreStep(middle)
+		if err != nil {
+			return nil, 0, err
+		}
+		if t.meets(s) {
+			chosen, high = middle, middle-1
+		} else {
+			low = middle + 1
+		}
+	}
+
+	s, err := scoreStep(chosen)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !t.meets(s) {
+		fmt.Printf("Warning: no quality setting meets the %s target of %g, using %d\n", t.Metric, t.Target, setting(chosen))
+	}
+	return &QualityScore{Metric: t.Metric, Target: t.Target, Value: s}, setting(chosen), nil
+}
+
+// searchSteps returns the number of settings a search scores, at most
+func (t *TargetQualityConfiguration) searchSteps() float64 {
+	return math.Ceil(math.Log2(float64(t.Max - t.Min + 2)))
+}
+
+// searchTargetQuality searches for the lowest quality at which an image's output meets the
+// ImageConfiguration's target, scoring each candidate configuration with score. Returns a copy of
+// the configuration which encodes at the chosen quality, recording its score.
+func (i *ImageConfiguration) searchTargetQuality(score func(candidate *ImageConfiguration) (float64, error)) (*ImageConfiguration, error) {
+	t := i.TargetQuality
+	measured, quality, err := t.searchQuality(t.Min, t.Max, func(quality int) (float64, error) {
+		return score(i.withQuality(quality))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	chosen := i.withQuality(quality)
+	chosen.measured = measured
+	fmt.Printf("Chose quality %d for %s output %s, scoring %s %.4f\n", quality, i.FileType, i.dimensions(), measured.Metric, measured.Value)
+	return chosen, nil
+}
+
+// withQuality returns a copy of a target-quality ImageConfiguration which encodes at quality.
+// JPEG XL's distance is derived from it, as for configurations with a fixed Quality.
+func (i *ImageConfiguration) withQuality(quality int) *ImageConfiguration {
+	candidate := *i
+	candidate.Quality = quality
+	if candidate.FileType == JXL {
+		candidate.Distance = jxlDistanceFromQuality(quality)
+	}
+	return &candidate
+}
+
+// imageQualityScore scores a decoded output image against the image it was encoded from.
+// butteraugliPath is the path of butteraugli_main, used by the butteraugli metric.
+func imageQualityScore(metric QualityMetric, butteraugliPath string, reference image.Image, distorted image.Image) (float64, error) {
+	// Both images are flattened onto white, as JPG output is, so that transparent areas are
+	// compared as they're displayed rather than by the colour of their hidden pixels
+	reference, distorted = flattenImage(reference), flattenImage(distorted)
+
+	switch metric {
+	case MetricSSIM:
+		return ssim(reference, distorted)
+	case MetricButteraugli:
+		return butteraugliDistance(butteraugliPath, reference, distorted)
+	}
+	return 0, fmt.Errorf("target quality metric '%s' can't be used for images", metric)
+}
+
+// ssim returns the mean structural similarity of two images' luma, from 0 to 1, over 8x8
+// windows spaced 4 pixels apart
+func ssim(reference image.Image, distorted image.Image) (float64, error) {
+	bounds := reference.Bounds()
+	if distorted.Bounds().Dx() != bounds.Dx() || distorted.Bounds().Dy() != bounds.Dy() {
+		return 0, fmt.Errorf("unable to compare images of different sizes")
+	}
+	if bounds.Empty() {
+		return 0, fmt.Errorf("unable to compare empty images")
+	}
+	x := image.NewGray(bounds)
+	draw.Draw(x, bounds, reference, bounds.Min, draw.Src)
+	y := image.NewGray(bounds)
+	draw.Draw(y, bounds, distorted, distorted.Bounds().Min, draw.Src)
+
+	const window, stride = 8, 4
+	const c1, c2 = (0.01 * 255) * (0.01 * 255), (0.03 * 255) * (0.03 * 255)
+
+	// Images smaller than a window are compared as a single window
+	windowWidth := int(math.Min(window, float64(bounds.Dx())))
+	windowHeight := int(math.Min(window, float64(bounds.Dy())))
+
+	var total float64
+	var windows int
+	for top := bounds.Min.Y; top+windowHeight <= bounds.Max.Y; top += stride {
+		for left := bounds.Min.X; left+windowWidth <= bounds.Max.X; left += stride {
+			var sumX, sumY, sumXX, sumYY, sumXY float64
+			for j := top; j < top+windowHeight; j++ {
+				for i := left; i < left+windowWidth; i++ {
+					a, b := float64(x.GrayAt(i, j).Y), float64(y.GrayAt(i, j).Y)
+					sumX, sumY = sumX+a, sumY+b
+					sumXX, sumYY, sumXY = sumXX+a*a, sumYY+b*b, sumXY+a*b
+				}
+			}
+			n := float64(windowWidth * windowHeight)
+			meanX, meanY := sumX/n, sumY/n
+			varianceX, varianceY := sumXX/n-meanX*meanX, sumYY/n-meanY*meanY
+			covariance := sumXY/n - meanX*meanY
+
+			total += (2*meanX*meanY + c1) * (2*covariance + c2) /
+				((meanX*meanX + meanY*meanY + c1) * (varianceX + varianceY + c2))
+			windows++
+		}
+	}
+	return total / float64(windows), nil
+}
+
+// butteraugliDistance returns the butteraugli distance between two images, using libjxl's
+// butteraugli_main tool at butteraugliPath. 1.0 is around the threshold of a visible difference.
+func butteraugliDistance(butteraugliPath string, reference image.Image, distorted image.Image) (float64, error) {
+	dir, err := ioutil.TempDir("", "pixel-slicer-butteraugli-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	referencePath := filepath.Join(dir, "reference.png")
+	distortedPath := filepath.Join(dir, "distorted.png")
+	if err := writePng(referencePath, reference); err != nil {
+		return 0, err
+	}
+	if err := writePng(distortedPath, distorted); err != nil {
+		return 0, err
+	}
+
+	// The distance is printed first, followed by the 3-norm, e.g.
+	// 1.2345678
+	// 3-norm: 0.612345
+	output, err := exec.Command(butteraugliPath, referencePath, distortedPath).Output()
+	if err != nil {
+		return 0, fmt.Errorf("butteraugli_main failed (it's included in libjxl's tools): %s", err)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("butteraugli_main output no distance")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// writePng writes an image to a PNG file
+func writePng(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,160 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+func TestSSIM(t *testing.T) {
+	gradient := testGradient(64, 48)
+
+	// Transparent pixels hide colours which aren't displayed
+	transparent := testGradient(64, 48)
+	for n := 3; n < len(transparent.Pix); n += 4 {
+		transparent.Pix[n] = 0
+	}
+	white := image.NewNRGBA(transparent.Bounds())
+	for n := range white.Pix {
+		white.Pix[n] = 255
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, gradient, &jpeg.Options{Quality: 10}); err != nil {
+		t.Fatal(err)
+	}
+	lowQuality, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                 string
+		reference, distorted image.Image
+		wantMin, wantMax     float64
+		wantErr              bool
+	}{
+		{"identical images", gradient, gradient, 1, 1, false},
+		{"images smaller than a window", testGradient(3, 2), testGradient(3, 2), 1, 1, false},
+		{"low quality jpg", gradient, lowQuality, 0.5, 0.99, false},
+		{"transparent reference matches flattened output", transparent, white, 1, 1, false},
+		{"different sizes", gradient, testGradient(64, 47), 0, 0, true},
+		{"empty images", image.NewNRGBA(image.Rect(0, 0, 0, 0)), image.NewNRGBA(image.Rect(0, 0, 0, 0)), 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := imageQualityScore(MetricSSIM, "", tt.reference, tt.distorted)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("imageQualityScore() = %f, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("imageQualityScore() error = %v", err)
+			}
+			if got < tt.wantMin-1e-9 || got > tt.wantMax+1e-9 {
+				t.Errorf("imageQualityScore() = %f, want between %g and %g", got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestSearchQuality(t *testing.T) {
+	// Scores which improve linearly from worst to best, as SSIM does with quality
+	linear := func(setting int) float64 { return float64(setting) / 100 }
+
+	tests := []struct {
+		name        string
+		metric      QualityMetric
+		target      float64
+		worst, best int
+		score       func(setting int) float64
+		want        int
+		wantScore   float64
+	}{
+		{"target met in the middle", MetricSSIM, 0.6, 30, 95, linear, 60, 0.6},
+		{"target met just above worst", MetricSSIM, 0.31, 30, 95, linear, 31, 0.31},
+		{"target met just below best", MetricSSIM, 0.94, 30, 95, linear, 94, 0.94},
+		{"every setting meets the target", MetricSSIM, 0.1, 30, 95, linear, 30, 0.3},
+		{"only best meets the target", MetricSSIM, 0.95, 30, 95, linear, 95, 0.95},
+		{"no setting meets the target", MetricSSIM, 0.99, 30, 95, linear, 95, 0.95},
+		{"worst equals best and meets the target", MetricSSIM, 0.5, 80, 80, linear, 80, 0.8},
+		{"worst equals best and misses the target", MetricSSIM, 0.9, 80, 80, linear, 80, 0.8},
+		{"lower scores are better for butteraugli", MetricButteraugli, 1.5, 30, 95, func(setting int) float64 { return float64(100-setting) / 20 }, 70, 1.5},
+		{"settings searched downwards, as for video crf", MetricVMAF, 70, 45, 15, func(crf int) float64 { return float64(100 - crf) }, 30, 70},
+		{"crf search converges on best", MetricVMAF, 99, 45, 15, func(crf int) float64 { return float64(100 - crf) }, 15, 85},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &TargetQualityConfiguration{Metric: tt.metric, Target: tt.target, Min: tt.worst, Max: tt.best}
+			if tt.best < tt.worst {
+				target.Min, target.Max = tt.best, tt.worst
+			}
+			scored := make(map[int]bool)
+			measured, got, err := target.searchQuality(tt.worst, tt.best, func(setting int) (float64, error) {
+				if scored[setting] {
+					t.Errorf("setting %d scored twice", setting)
+				}
+				scored[setting] = true
+				if (setting-tt.worst)*(setting-tt.best) > 0 {
+					t.Errorf("setting %d scored outside the range %d to %d", setting, tt.worst, tt.best)
+				}
+				return tt.score(setting), nil
+			})
+			if err != nil {
+				t.Fatalf("searchQuality() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("searchQuality() chose %d, want %d", got, tt.want)
+			}
+			if math.Abs(measured.Value-tt.wantScore) > 1e-9 {
+				t.Errorf("searchQuality() scored %f, want %f", measured.Value, tt.wantScore)
+			}
+			if len(scored) > int(target.searchSteps()) {
+				t.Errorf("searchQuality() scored %d settings, want a binary search", len(scored))
+			}
+		})
+	}
+}
+
+func TestSearchTargetQuality(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ImageConfiguration
+		want     int
+		wantDist float64
+	}{
+		{"jpg", ImageConfiguration{FileType: JPG, TargetQuality: &TargetQualityConfiguration{Metric: MetricSSIM, Target: 0.7, Min: 30, Max: 95}}, 70, 0},
+		{"min equals max", ImageConfiguration{FileType: WebP, TargetQuality: &TargetQualityConfiguration{Metric: MetricSSIM, Target: 0.99, Min: 60, Max: 60}}, 60, 0},
+		{"jxl distance follows quality", ImageConfiguration{FileType: JXL, TargetQuality: &TargetQualityConfiguration{Metric: MetricSSIM, Target: 0.9, Min: 30, Max: 95}}, 90, jxlDistanceFromQuality(90)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chosen, err := tt.config.searchTargetQuality(func(candidate *ImageConfiguration) (float64, error) {
+				if candidate.FileType == JXL && candidate.Distance != jxlDistanceFromQuality(candidate.Quality) {
+					t.Errorf("candidate at quality %d has distance %g", candidate.Quality, candidate.Distance)
+				}
+				return float64(candidate.Quality) / 100, nil
+			})
+			if err != nil {
+				t.Fatalf("searchTargetQuality() error = %v", err)
+			}
+			if chosen.Quality != tt.want || chosen.Distance != tt.wantDist {
+				t.Errorf("searchTargetQuality() chose quality %d distance %g, want %d distance %g", chosen.Quality, chosen.Distance, tt.want, tt.wantDist)
+			}
+			if chosen.measured == nil || chosen.measured.Value != float64(tt.want)/100 {
+				t.Errorf("searchTargetQuality() recorded score %v", chosen.measured)
+			}
+			if tt.config.Quality != 0 || tt.config.measured != nil {
+				t.Error("searchTargetQuality() modified the original configuration")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package mediaprocessor
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Sidecar contains per-image settings, read from a YAML or JSON file alongside an input file.
+// e.g. sunset.jpg.yaml
+type Sidecar struct {
+	FocalPoint          *FocalPoint           // Crop around this point, for ImageConfigurations using the focal crop mode
+	CropBox             *CropBox              // Crop the source image to this area before resizing
+	ImageConfigurations []*ImageConfiguration // Replace the configured ImageConfigurations for this image
+}
+
+// ReadSidecar reads and validates a sidecar file
+func ReadSidecar(path string) (*Sidecar, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "unable to read sidecar '%s'", path)
+	}
+
+	var sidecar Sidecar
+	if err := CheckBooleanKeys(v.AllSettings()); err != nil {
+		return nil, errors.Wrapf(err, "invalid sidecar '%s'", path)
+	}
+	if err := v.Unmarshal(&sidecar); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse sidecar '%s'", path)
+	}
+
+	if sidecar.FocalPoint != nil {
+		if err := sidecar.FocalPoint.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid sidecar '%s'", path)
+		}
+	}
+	if sidecar.CropBox != nil {
+		if err := sidecar.CropBox.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid sidecar '%s'", path)
+		}
+	}
+
+	return &sidecar, nil
+}
+
+// ApplySidecar returns a copy of a MediaConfig with a sidecar's per-image settings applied.
+// The original MediaConfig is shared between jobs, so isn't modified.
+func (m *MediaConfig) ApplySidecar(s *Sidecar) (*MediaConfig, error) {
+	mediaConfig := *m
+
+	imageConfigs := m.ImageConfigurations
+	if len(s.ImageConfigurations) > 0 {
+		var err error
+		if imageConfigs, err = ExpandImageConfigurations(s.ImageConfigurations); err != nil {
+			return nil, errors.Wrap(err, "invalid sidecar image configuration")
+		}
+	}
+
+	// The ImageConfigurations have already been validated, so their crop geometry is resolved
+	mediaConfig.ImageConfigurations = nil
+	for _, c := range imageConfigs {
+		imageConfig := *c
+
+		if s.CropBox != nil {
+			imageConfig.CropBox = s.CropBox
+		}
+		// Other crop modes keep their own crop, as the crop mode is part of the output filename
+		if s.FocalPoint != nil && imageConfig.IsCropped() && imageConfig.Crop == CropFocal {
+			imageConfig.FocalPoint = s.FocalPoint
+		}
+
+		if err := imageConfig.Validate(); err != nil {
+			return nil, errors.Wrap(err, "invalid sidecar image configuration")
+		}
+		mediaConfig.ImageConfigurations = append(mediaConfig.ImageConfigurations, &imageConfig)
+	}
+
+	return &mediaConfig, nil
+}
@@ -0,0 +1,152 @@
+package mediaprocessor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		filename string
+		contents string
+		want     *Sidecar
+		wantErr  bool
+	}{
+		{
+			"yaml focal point and crop box", "sunset.jpg.yaml",
+			"FocalPoint: {X: 0.7, 'Y': 0.4}\nCropBox: {X: 0.1, 'Y': 0, Width: 0.8, Height: 1}\n",
+			&Sidecar{FocalPoint: &FocalPoint{X: 0.7, Y: 0.4}, CropBox: &CropBox{X: 0.1, Width: 0.8, Height: 1}}, false,
+		},
+		{
+			"json image configurations", "sunset.jpg.json",
+			`{"imageconfigurations": [{"maxwidth": 800, "quality": 80, "filetype": "jpg"}]}`,
+			&Sidecar{ImageConfigurations: []*ImageConfiguration{{MaxWidth: 800, Quality: 80, FileType: JPG}}}, false,
+		},
+		{"empty", "empty.jpg.yaml", "", &Sidecar{}, false},
+		{"focal point outside the image", "outside.jpg.yaml", "FocalPoint: {X: 1.5, 'Y': 0.4}\n", nil, true},
+		{"crop box outside the image", "box.jpg.yaml", "CropBox: {X: 0.5, 'Y': 0, Width: 0.8, Height: 1}\n", nil, true},
+		{"unquoted y read as true", "unquoted.jpg.yaml", "FocalPoint: {X: 0.7, Y: 0.4}\n", nil, true},
+		{"invalid yaml", "invalid.jpg.yaml", "FocalPoint: [\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.filename)
+			if err := ioutil.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadSidecar(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadSidecar() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			// Unset lists may be decoded as empty
+			if got != nil && len(got.ImageConfigurations) == 0 {
+				got.ImageConfigurations = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadSidecar() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ReadSidecar(filepath.Join(dir, "missing.jpg.yaml")); err == nil {
+		t.Error("ReadSidecar() of a missing file didn't return an error")
+	}
+}
+
+func TestApplySidecar(t *testing.T) {
+	configs := []*ImageConfiguration{
+		{MaxWidth: 800, Quality: 80, FileType: JPG},
+		{Width: 400, Height: 300, Quality: 80, FileType: JPG},
+		{Width: 400, Height: 300, Crop: CropAttention, Quality: 80, FileType: JPG},
+		{Width: 400, Height: 300, Crop: CropFocal, FocalPoint: &FocalPoint{X: 0.5, Y: 0.3}, Quality: 80, FileType: JPG},
+	}
+	mediaConfig := &MediaConfig{}
+	var err error
+	if mediaConfig.ImageConfigurations, err = ExpandImageConfigurations(configs); err != nil {
+		t.Fatal(err)
+	}
+
+	type variant struct {
+		suffix     string
+		crop       CropMode
+		focalPoint *FocalPoint
+		cropBox    *CropBox
+	}
+	configured := []variant{
+		{"x800.jpg", "", nil, nil},
+		{"x400x300-centre.jpg", CropCentre, nil, nil},
+		{"x400x300-attention.jpg", CropAttention, nil, nil},
+		{"x400x300-focal.jpg", CropFocal, &FocalPoint{X: 0.5, Y: 0.3}, nil},
+	}
+	focal := &FocalPoint{X: 0.7, Y: 0.4}
+	box := &CropBox{X: 0.1, Width: 0.8, Height: 1}
+
+	tests := []struct {
+		name    string
+		sidecar Sidecar
+		want    []variant
+		wantErr bool
+	}{
+		{"nothing set", Sidecar{}, configured, false},
+		{
+			"focal point only used by focal crops", Sidecar{FocalPoint: focal},
+			[]variant{configured[0], configured[1], configured[2], {"x400x300-focal.jpg", CropFocal, focal, nil}}, false,
+		},
+		{
+			"crop box used by every configuration", Sidecar{CropBox: box},
+			[]variant{
+				{"x800.jpg", "", nil, box},
+				{"x400x300-centre.jpg", CropCentre, nil, box},
+				{"x400x300-attention.jpg", CropAttention, nil, box},
+				{"x400x300-focal.jpg", CropFocal, &FocalPoint{X: 0.5, Y: 0.3}, box},
+			}, false,
+		},
+		{
+			"image configurations replaced",
+			Sidecar{FocalPoint: focal, ImageConfigurations: []*ImageConfiguration{
+				{Width: 800, AspectRatio: "4:5", Crop: CropFocal, Quality: 80, FileType: JPG},
+				{MaxWidth: 400, DPR: []float64{1, 2}, Quality: 80, FileType: JPG},
+			}},
+			[]variant{{"x800x1000-focal.jpg", CropFocal, focal, nil}, {"x400w@1x.jpg", "", nil, nil}, {"x400w@2x.jpg", "", nil, nil}}, false,
+		},
+		{"invalid image configuration", Sidecar{ImageConfigurations: []*ImageConfiguration{{MaxWidth: 800, Quality: 180, FileType: JPG}}}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied, err := mediaConfig.ApplySidecar(&tt.sidecar)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ApplySidecar() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var got []variant
+			for _, c := range applied.ImageConfigurations {
+				got = append(got, variant{c.OutputFileSuffix(false), c.Crop, c.FocalPoint, c.CropBox})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ApplySidecar() = %+v, want %+v", got, tt.want)
+			}
+
+			// The original MediaConfig is shared between jobs
+			for n, c := range mediaConfig.ImageConfigurations {
+				if c.CropBox != nil || !reflect.DeepEqual(c.FocalPoint, configured[n].focalPoint) {
+					t.Errorf("ApplySidecar() modified the original configuration %s", c.OutputFileSuffix(false))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// SnippetData is passed to the templates which generate HTML snippets
+type SnippetData struct {
+	Source      string          // Path of the input file, relative to the input dir
+	Sources     []SnippetSource // <source> elements, in the order browsers should consider them
+	Src         string          // URL of the <img> fallback, the largest variant of the most compatible format
+	Srcset      string          // srcset of the <img> fallback, with width descriptors
+	Sizes       string          // sizes of the <img> and <source> elements, the width the image is displayed at
+	Poster      string          // URL of the largest video thumbnail, if any
+	Width       int             // Width of the largest variant, to reserve space while loading
+	Height      int             // Height of the largest variant
+	Placeholder *Placeholder    // Placeholder for images, if enabled
+}
+
+// SnippetSource describes a <source> element
+type SnippetSource struct {
+	Type   string // MIME type, including the codec for videos
+	Srcset string // Image srcset, with width descriptors
+	Src    string // Video URL
+	Media  string // Video media query, selecting smaller videos on smaller screens
+}
+
+// defaultPictureTemplate is used to generate snippets for images, unless overridden
+const defaultPictureTemplate = `<picture>
+{{- range .Sources}}
+  <source type="{{.Type}}" srcset="{{.Srcset | html}}" sizes="{{$.Sizes | html}}">
+{{- end}}
+  <img src="{{.Src | html}}" srcset="{{.Srcset | html}}" sizes="{{.Sizes | html}}" width="{{.Width}}" height="{{.Height}}" alt="" loading="lazy" decoding="async">
+</picture>
+`
+
+// defaultVideoTemplate is used to generate snippets for videos, unless overridden
+const defaultVideoTemplate = `<video controls playsinline preload="metadata" width="{{.Width}}" height="{{.Height}}"{{with .Poster}} poster="{{. | html}}"{{end}}>
+{{- range .Sources}}
+  <source src="{{.Src | html}}" type="{{.Type | html}}"{{with .Media}} media="{{.}}"{{end}}>
+{{- end}}
+</video>
+`
+
+// imageFormatOrder lists image formats from most to least efficient. Browsers use the first
+// <source> they support, so more efficient formats are listed first.
+var imageFormatOrder = []FileOutputType{JXL, AVIF, WebP, JPG, PNG}
+
+// universalImageFormats are supported by every browser, so can be used as the <img> fallback
+var universalImageFormats = map[FileOutputType]bool{JPG: true, PNG: true}
+
+// videoCodecOrder lists video codecs from most to least efficient
+var videoCodecOrder = []VideoCodec{AV1, VP9, H265, H264}
+
+// videoCodecParameter is the codecs parameter of each codec's MIME type. Browsers check these
+// to skip videos they can't play. Levels are chosen to cover 1080p.
+var videoCodecParameter = map[VideoCodec]string{
+	H264: "avc1.640028", // High profile, level 4.0
+	H265: "hvc1",        // Apple platforms only play HEVC tagged as hvc1
+	VP9:  "vp9",
+	AV1:  "av01.0.08M.08", // Main profile, level 4.0, 8-bit
+}
+
+// ParseSnippetTemplate parses the template used to generate snippets for a MediaType, from a
+// template file. The default template is used if no file is given. Templates are parsed once,
+// when the config is validated, and shared by every job through FSConfig.SnippetTemplates.
+func ParseSnippetTemplate(mediaType MediaType, path string) (*template.Template, error) {
+	text := defaultPictureTemplate
+	if mediaType == Video {
+		text = defaultVideoTemplate
+	}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+
+	tmpl, err := template.New(string(mediaType)).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %s", mediaType, err)
+	}
+	return tmpl, nil
+}
+
+// SnippetPath returns the output path of a job's HTML snippet
+// e.g. output/subdir1/sunset.jpg.html
+func (m *MediaJob) SnippetPath() string {
+	return pixelio.GetSourceOutputPath(m.FSConfig.OutputDir, m.InputFile, ".html")
+}
+
+// WriteSnippet writes an HTML snippet displaying a job's variants, returning its path. Returns
+// an empty path if the job has no variants to display.
+func (m *MediaJob) WriteSnippet(mediaType MediaType) (string, error) {
+	manifest, err := m.buildManifest()
+	if err != nil {
+		return "", err
+	}
+
+	var data *SnippetData
+	switch mediaType {
+	case Image:
+		data = m.pictureSnippetData(manifest)
+	case Video:
+		data = m.videoSnippetData(manifest)
+	}
+	if data == nil {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err := m.FSConfig.SnippetTemplates[mediaType].Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("unable to generate snippet for %s: %s", manifest.Source, err)
+	}
+
+	snippetPath := m.SnippetPath()
+	if err := ioutil.WriteFile(snippetPath, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return snippetPath, nil
+}
+
+// pictureSnippetData prepares the data for an image's <picture> snippet. Each format gets a
+// srcset of its sizes, and the most compatible format is used for the <img> fallback. Variants
+// with a different aspect ratio to the largest fallback, such as cropped thumbnails, are left out,
+// as are empty variants.
+func (m *MediaJob) pictureSnippetData(manifest *SourceManifest) *SnippetData {
+	byFormat := make(map[FileOutputType][]*Variant)
+	for _, v := range manifest.Variants {
+		if v.Size == 0 {
+			continue
+		}
+		byFormat[v.Format] = append(byFormat[v.Format], v)
+	}
+
+	// Use the first universally supported format as the fallback. Less efficient formats would
+	// never be chosen by the browser, so are left out.
+	var formats []FileOutputType
+	var fallbackFormat FileOutputType
+	for _, format := range imageFormatOrder {
+		if len(byFormat[format]) == 0 {
+			continue
+		}
+		formats = append(formats, format)
+		if universalImageFormats[format] {
+			fallbackFormat = format
+			break
+		}
+	}
+	if len(formats) == 0 {
+		return nil
+	}
+	if fallbackFormat == "" {
+		fallbackFormat = formats[len(formats)-1]
+	}
+
+	fallback := largestVariant(byFormat[fallbackFormat])
+	data := &SnippetData{
+		Source:      manifest.Source,
+		Src:         m.variantURL(fallback),
+		Sizes:       m.FSConfig.HTMLSizes,
+		Width:       fallback.Width,
+		Height:      fallback.Height,
+		Placeholder: manifest.Placeholder,
+	}
+	for _, format := range formats {
+		srcset := m.srcset(byFormat[format], fallback)
+		if format == fallbackFormat {
+			data.Srcset = srcset
+			break
+		}
+		data.Sources = append(data.Sources, SnippetSource{
+			Type:   byFormat[format][0].MimeType,
+			Srcset: srcset,
+		})
+	}
+
+	return data
+}
+
+// videoSnippetData prepares the data for a video's <video> snippet. Videos are ordered by codec
+// efficiency, after any HLS playlist. Within each codec, smaller videos are selected with media
+// queries on narrower screens, falling back to the largest video. Empty variants are left out.
+func (m *MediaJob) videoSnippetData(manifest *SourceManifest) *SnippetData {
+	byCodec := make(map[VideoCodec][]*Variant)
+	var videos, thumbnails, playlists []*Variant
+	for _, v := range manifest.Variants {
+		if v.Size == 0 {
+			continue
+		}
+		if v.Format == M3U8 {
+			playlists = append(playlists, v)
+			videos = append(videos, v)
+		} else if v.Format.GetMediaType() == Video {
+			byCodec[v.Codec] = append(byCodec[v.Codec], v)
+			videos = append(videos, v)
+		} else if !v.Animated && !v.Sprite {
+			thumbnails = append(thumbnails, v)
+		}
+	}
+	if len(videos) == 0 {
+		return nil
+	}
+
+	largest := largestVariant(videos)
+	data := &SnippetData{
+		Source: manifest.Source,
+		Width:  largest.Width,
+		Height: largest.Height,
+	}
+	if len(thumbnails) > 0 {
+		data.Poster = m.variantURL(largestVariant(thumbnails))
+	}
+
+	// Adaptive streaming is preferred by browsers which support it natively
+	for _, v := range playlists {
+		data.Sources = append(data.Sources, SnippetSource{Type: v.MimeType, Src: m.variantURL(v)})
+	}
+	for _, codec := range videoCodecOrder {
+		variants := byCodec[codec]
+		sort.SliceStable(variants, func(i, j int) bool { return variants[i].Width < variants[j].Width })
+		for n, v := range variants {
+			source := SnippetSource{
+				Type: fmt.Sprintf(`%s; codecs="%s"`, v.MimeType, videoCodecParameter[codec]),
+				Src:  m.variantURL(v),
+			}
+			if n < len(variants)-1 {
+				source.Media = fmt.Sprintf("(max-width: %dpx)", v.Width)
+			}
+			data.Sources = append(data.Sources, source)
+		}
+	}
+
+	return data
+}
+
+// srcset builds a srcset with width descriptors from variants with the same aspect ratio as
+// the reference variant. Only the first variant of each width is used.
+func (m *MediaJob) srcset(variants []*Variant, reference *Variant) string {
+	sorted := append([]*Variant{}, variants...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Width < sorted[j].Width })
+
+	var candidates []string
+	widths := make(map[int]bool)
+	for _, v := range sorted {
+		if widths[v.Width] || !sameAspectRatio(v, reference) {
+			continue
+		}
+		widths[v.Width] = true
+		candidates = append(candidates, fmt.Sprintf("%s %dw", m.variantURL(v), v.Width))
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// variantURL returns the URL of a variant, prefixed by the configured base URL
+func (m *MediaJob) variantURL(v *Variant) string {
+	path := (&url.URL{Path: v.Path}).EscapedPath()
+	if m.FSConfig.HTMLBaseURL == "" {
+		return path
+	}
+	return strings.TrimSuffix(m.FSConfig.HTMLBaseURL, "/") + "/" + path
+}
+
+// largestVariant returns the widest of a list of variants
+func largestVariant(variants []*Variant) *Variant {
+	largest := variants[0]
+	for _, v := range variants[1:] {
+		if v.Width > largest.Width {
+			largest = v
+		}
+	}
+	return largest
+}
+
+// sameAspectRatio reports whether two variants have the same aspect ratio, allowing for the
+// rounding of smaller sizes
+func sameAspectRatio(a *Variant, b *Variant) bool {
+	if a.Height == 0 || b.Height == 0 {
+		return a.Height == b.Height
+	}
+	ratioA := float64(a.Width) / float64(a.Height)
+	ratioB := float64(b.Width) / float64(b.Height)
+	return math.Abs(ratioA-ratioB)/ratioB < 0.02
+}
@@ -0,0 +1,174 @@
+package mediaprocessor
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testVariant returns a non-empty variant of a manifest
+func testVariant(path string, format FileOutputType, mimeType string, width int, height int) *Variant {
+	return &Variant{Path: path, MimeType: mimeType, Format: format, Width: width, Height: height, Size: 1000}
+}
+
+func TestPictureSnippetData(t *testing.T) {
+	jpg400 := testVariant("photo-400.jpg", JPG, "image/jpeg", 400, 300)
+	jpg800 := testVariant("photo-800.jpg", JPG, "image/jpeg", 800, 600)
+	webp400 := testVariant("photo-400.webp", WebP, "image/webp", 400, 300)
+	webp800 := testVariant("photo-800.webp", WebP, "image/webp", 800, 600)
+	avif800 := testVariant("photo-800.avif", AVIF, "image/avif", 800, 600)
+	png800 := testVariant("photo-800.png", PNG, "image/png", 800, 600)
+	square := testVariant("photo-400x400-centre.jpg", JPG, "image/jpeg", 400, 400)
+	dpr2x := testVariant("photo-400w@2x.jpg", JPG, "image/jpeg", 800, 600)
+	empty := testVariant("photo-800.webp", WebP, "image/webp", 800, 600)
+	empty.Size = 0
+
+	tests := []struct {
+		name     string
+		variants []*Variant
+		want     *SnippetData
+	}{
+		{
+			"single format", []*Variant{jpg800, jpg400},
+			&SnippetData{Src: "photo-800.jpg", Srcset: "photo-400.jpg 400w, photo-800.jpg 800w", Width: 800, Height: 600},
+		},
+		{
+			"formats ordered by efficiency", []*Variant{jpg800, webp800, webp400, avif800},
+			&SnippetData{
+				Sources: []SnippetSource{
+					{Type: "image/avif", Srcset: "photo-800.avif 800w"},
+					{Type: "image/webp", Srcset: "photo-400.webp 400w, photo-800.webp 800w"},
+				},
+				Src: "photo-800.jpg", Srcset: "photo-800.jpg 800w", Width: 800, Height: 600,
+			},
+		},
+		{
+			"formats less efficient than the fallback left out", []*Variant{png800, jpg800},
+			&SnippetData{Src: "photo-800.jpg", Srcset: "photo-800.jpg 800w", Width: 800, Height: 600},
+		},
+		{
+			"least efficient format used without a universal format", []*Variant{webp800, avif800},
+			&SnippetData{
+				Sources: []SnippetSource{{Type: "image/avif", Srcset: "photo-800.avif 800w"}},
+				Src:     "photo-800.webp", Srcset: "photo-800.webp 800w", Width: 800, Height: 600,
+			},
+		},
+		{
+			"different aspect ratios left out", []*Variant{jpg800, square, jpg400},
+			&SnippetData{Src: "photo-800.jpg", Srcset: "photo-400.jpg 400w, photo-800.jpg 800w", Width: 800, Height: 600},
+		},
+		{
+			"first variant of each width used", []*Variant{jpg800, dpr2x},
+			&SnippetData{Src: "photo-800.jpg", Srcset: "photo-800.jpg 800w", Width: 800, Height: 600},
+		},
+		{
+			"empty variants left out", []*Variant{empty, jpg800},
+			&SnippetData{Src: "photo-800.jpg", Srcset: "photo-800.jpg 800w", Width: 800, Height: 600},
+		},
+		{"no variants", nil, nil},
+		{"only empty variants", []*Variant{empty}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaJob{FSConfig: &FSConfig{}}
+			got := m.pictureSnippetData(&SourceManifest{Variants: tt.variants})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pictureSnippetData() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoSnippetData(t *testing.T) {
+	h264640 := testVariant("clip-640.mp4", MP4, "video/mp4", 640, 360)
+	h264640.Codec = H264
+	h2641280 := testVariant("clip-1280.mp4", MP4, "video/mp4", 1280, 720)
+	h2641280.Codec = H264
+	av1 := testVariant("clip-1280.webm", WebM, "video/webm", 1280, 720)
+	av1.Codec = AV1
+	playlist := testVariant("clip.m3u8", M3U8, "application/vnd.apple.mpegurl", 1920, 1080)
+	poster := testVariant("clip.jpg", JPG, "image/jpeg", 1280, 720)
+	preview := testVariant("clip-preview.webp", WebP, "image/webp", 1920, 1080)
+	preview.Animated = true
+	sprite := testVariant("clip-sprite-1.jpg", JPG, "image/jpeg", 1600, 900)
+	sprite.Sprite = true
+	empty := testVariant("clip-1920.mp4", MP4, "video/mp4", 1920, 1080)
+	empty.Codec = H264
+	empty.Size = 0
+
+	tests := []struct {
+		name     string
+		variants []*Variant
+		want     *SnippetData
+	}{
+		{
+			"codecs ordered by efficiency, with media queries", []*Variant{h2641280, h264640, av1},
+			&SnippetData{
+				Sources: []SnippetSource{
+					{Type: `video/webm; codecs="av01.0.08M.08"`, Src: "clip-1280.webm"},
+					{Type: `video/mp4; codecs="avc1.640028"`, Src: "clip-640.mp4", Media: "(max-width: 640px)"},
+					{Type: `video/mp4; codecs="avc1.640028"`, Src: "clip-1280.mp4"},
+				},
+				Width: 1280, Height: 720,
+			},
+		},
+		{
+			"playlist first", []*Variant{h2641280, playlist},
+			&SnippetData{
+				Sources: []SnippetSource{
+					{Type: "application/vnd.apple.mpegurl", Src: "clip.m3u8"},
+					{Type: `video/mp4; codecs="avc1.640028"`, Src: "clip-1280.mp4"},
+				},
+				Width: 1920, Height: 1080,
+			},
+		},
+		{
+			"poster from thumbnails, not previews or sprites", []*Variant{preview, sprite, poster, h2641280},
+			&SnippetData{
+				Sources: []SnippetSource{{Type: `video/mp4; codecs="avc1.640028"`, Src: "clip-1280.mp4"}},
+				Poster:  "clip.jpg", Width: 1280, Height: 720,
+			},
+		},
+		{
+			"empty variants left out", []*Variant{h2641280, empty},
+			&SnippetData{
+				Sources: []SnippetSource{{Type: `video/mp4; codecs="avc1.640028"`, Src: "clip-1280.mp4"}},
+				Width:   1280, Height: 720,
+			},
+		},
+		{"only thumbnails", []*Variant{poster}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaJob{FSConfig: &FSConfig{}}
+			got := m.videoSnippetData(&SourceManifest{Variants: tt.variants})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("videoSnippetData() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariantURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		path    string
+		want    string
+	}{
+		{"relative", "", "subdir/sunset-800.jpg", "subdir/sunset-800.jpg"},
+		{"base url", "https://cdn.example.com/media", "subdir/sunset-800.jpg", "https://cdn.example.com/media/subdir/sunset-800.jpg"},
+		{"base url with a trailing slash", "https://cdn.example.com/media/", "sunset-800.jpg", "https://cdn.example.com/media/sunset-800.jpg"},
+		{"escaped path", "", "my photos/sunset #1-800.jpg", "my%20photos/sunset%20%231-800.jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaJob{FSConfig: &FSConfig{HTMLBaseURL: tt.baseURL}}
+			if got := m.variantURL(&Variant{Path: tt.path}); got != tt.want {
+				t.Errorf("variantURL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
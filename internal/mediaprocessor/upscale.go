@@ -0,0 +1,195 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"math"
+)
+
+// SkipReason describes why an output variant wasn't produced
+type SkipReason string
+
+const (
+	SkipUpscale   SkipReason = "upscale"   // The variant is larger than its source
+	SkipDuplicate SkipReason = "duplicate" // The variant duplicates another output, as configured or once clamped to the source size
+)
+
+// SkippedVariant records an output variant which wasn't produced for a job's input file
+type SkippedVariant struct {
+	Path   string     `json:"path"` // Output path the variant would have been written to
+	Reason SkipReason `json:"reason"`
+}
+
+// skipVariant records that a variant, which would have been written to outputPath, won't be
+// output for a job
+func (m *MediaJob) skipVariant(outputPath string, reason SkipReason) {
+	fmt.Printf("Skipping %s (%s)\n", outputPath, reason)
+	m.Skipped = append(m.Skipped, SkippedVariant{Path: outputPath, Reason: reason})
+}
+
+// applyUpscalePolicy decides which of a job's variants to output. For each variant, upscaled
+// reports whether it's larger than its source, and keys identifies its output once it's been
+// clamped to the source size. Returns why each variant should be skipped, or "" if it should
+// be output.
+func applyUpscalePolicy(policy UpscalePolicy, upscaled []bool, keys []string) []SkipReason {
+	reasons := make([]SkipReason, len(upscaled))
+
+	switch policy {
+	case UpscaleSkip:
+		for n := range upscaled {
+			if upscaled[n] {
+				reasons[n] = SkipUpscale
+			}
+		}
+	case UpscaleClamp:
+		// Variants which fit the source take precedence over clamped variants with the same output
+		output := make(map[string]bool)
+		for n := range upscaled {
+			if !upscaled[n] {
+				output[keys[n]] = true
+			}
+		}
+		for n := range upscaled {
+			if !upscaled[n] {
+				continue
+			}
+			if output[keys[n]] {
+				reasons[n] = SkipDuplicate
+				continue
+			}
+			output[keys[n]] = true
+		}
+	}
+
+	return reasons
+}
+
+// planImageVariants applies a job's UpscalePolicy to its ImageConfigurations, given the size of
+// the source image. Returns the configurations to output, which are clamped to the source size
+// by the clamp policy, and records any skipped variants, including duplicate configurations.
+func (m *MediaJob) planImageVariants(srcWidth int, srcHeight int) (variants []*ImageConfiguration) {
+	var configs []*ImageConfiguration
+	for _, c := range m.MediaConfig.ImageConfigurations {
+		if c.duplicate {
+			m.skipVariant(m.OutputPath(c), SkipDuplicate)
+			continue
+		}
+		configs = append(configs, c)
+	}
+
+	fitted := make([]*ImageConfiguration, len(configs))
+	upscaled := make([]bool, len(configs))
+	keys := make([]string, len(configs))
+	for n, c := range configs {
+		fitted[n], upscaled[n] = c.fitSource(srcWidth, srcHeight)
+		keys[n] = fitted[n].outputKey()
+	}
+
+	for n, reason := range applyUpscalePolicy(m.MediaConfig.Upscale, upscaled, keys) {
+		switch {
+		case reason != "":
+			m.skipVariant(m.OutputPath(configs[n]), reason)
+		case m.MediaConfig.Upscale == UpscaleClamp:
+			variants = append(variants, fitted[n])
+		default:
+			variants = append(variants, configs[n])
+		}
+	}
+
+	return
+}
+
+// planVideoVariants applies a job's UpscalePolicy to VideoConfigurations, given the width of the
+// source video. Returns the configurations to output, which are clamped to the source width by
+// the clamp policy, and records any skipped variants using outputPath.
+func (m *MediaJob) planVideoVariants(configs []*VideoConfiguration, srcWidth int, outputPath func(*VideoConfiguration) string) (variants []*VideoConfiguration) {
+	fitted := make([]*VideoConfiguration, len(configs))
+	upscaled := make([]bool, len(configs))
+	keys := make([]string, len(configs))
+	for n, c := range configs {
+		fitted[n], upscaled[n] = c.fitSource(srcWidth)
+		keys[n] = fitted[n].outputKey()
+	}
+
+	for n, reason := range applyUpscalePolicy(m.MediaConfig.Upscale, upscaled, keys) {
+		switch {
+		case reason != "":
+			m.skipVariant(outputPath(configs[n]), reason)
+		case m.MediaConfig.Upscale == UpscaleClamp:
+			variants = append(variants, fitted[n])
+		default:
+			variants = append(variants, configs[n])
+		}
+	}
+
+	return
+}
+
+// fitSource returns a copy of an ImageConfiguration clamped to the size of its source image,
+// and whether it needed clamping. The source size is measured after applying any CropBox.
+// Clamped DPR variants are relabelled with the density they actually have.
+func (i *ImageConfiguration) fitSource(srcWidth int, srcHeight int) (*ImageConfiguration, bool) {
+	if i.CropBox != nil {
+		_, _, srcWidth, srcHeight = i.CropBox.Rect(srcWidth, srcHeight)
+	}
+
+	var fitted ImageConfiguration
+	if !i.IsCropped() {
+		if i.MaxWidth <= srcWidth {
+			return i, false
+		}
+		fitted = *i
+		fitted.MaxWidth = srcWidth
+		if fitted.Width != 0 {
+			fitted.Width = srcWidth
+		}
+	} else {
+		// Cropped images are scaled to cover the crop, so shrink the crop, keeping its aspect ratio
+		scale := math.Max(float64(i.Width)/float64(srcWidth), float64(i.Height)/float64(srcHeight))
+		if scale <= 1 {
+			return i, false
+		}
+		fitted = *i
+		fitted.Width = int(math.Max(1, math.Floor(float64(i.Width)/scale)))
+		fitted.Height = int(math.Max(1, math.Floor(float64(i.Height)/scale)))
+		fitted.MaxWidth = fitted.Width
+	}
+
+	if fitted.density != 0 {
+		fitted.density = math.Round(float64(fitted.MaxWidth)/float64(fitted.displayWidth)*100) / 100
+	}
+	return &fitted, true
+}
+
+// fitSource returns a copy of a VideoConfiguration clamped to the width of its source video, and
+// whether it needed clamping
+func (v *VideoConfiguration) fitSource(srcWidth int) (*VideoConfiguration, bool) {
+	if v.MaxWidth <= srcWidth {
+		return v, false
+	}
+	fitted := *v
+	fitted.MaxWidth = srcWidth - srcWidth%2 // Keep the width even, as required by most codecs
+	return &fitted, true
+}
+
+// outputKey identifies the output of a VideoConfiguration, ignoring its filename, so that
+// duplicate configurations can be detected
+func (v *VideoConfiguration) outputKey() string {
+	// Segmented renditions are named by their width and codec
+	if v.FileType == M3U8 || v.FileType == CMAF {
+		return fmt.Sprintf("%s-%s-%d", v.FileType, v.Codec, v.MaxWidth)
+	}
+	key := fmt.Sprintf("%s-%s-%d-%s-%s-%s-%d", v.FileType, v.Codec, v.MaxWidth, v.qualitySetting(), v.Preset, v.Encoder, v.FilmGrain)
+	if v.Audio != nil {
+		key += fmt.Sprintf("-audio%+v", *v.Audio)
+	}
+	if v.Thumbnail != nil {
+		key += fmt.Sprintf("-thumbnail%+v", *v.Thumbnail)
+	}
+	if v.Preview != nil {
+		key += fmt.Sprintf("-preview%+v", *v.Preview)
+	}
+	if v.Sprite != nil {
+		key += fmt.Sprintf("-sprite%+v", *v.Sprite)
+	}
+	return key
+}
@@ -0,0 +1,186 @@
+package mediaprocessor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyUpscalePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   UpscalePolicy
+		upscaled []bool
+		keys     []string
+		want     []SkipReason
+	}{
+		{"allow outputs everything", UpscaleAllow, []bool{false, true, true}, []string{"a", "b", "b"}, []SkipReason{"", "", ""}},
+		{"skip upscaled variants", UpscaleSkip, []bool{false, true, false, true}, []string{"a", "b", "c", "d"}, []SkipReason{"", SkipUpscale, "", SkipUpscale}},
+		{"clamp outputs distinct variants", UpscaleClamp, []bool{false, true}, []string{"a", "b"}, []SkipReason{"", ""}},
+		{"clamped variants duplicating each other", UpscaleClamp, []bool{false, true, true}, []string{"a", "b", "b"}, []SkipReason{"", "", SkipDuplicate}},
+		{"variants which fit take precedence", UpscaleClamp, []bool{true, false}, []string{"a", "a"}, []SkipReason{SkipDuplicate, ""}},
+		{"no variants", UpscaleClamp, nil, nil, []SkipReason{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applyUpscalePolicy(tt.policy, tt.upscaled, tt.keys); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("applyUpscalePolicy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoFitSource(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxWidth     int
+		srcWidth     int
+		wantWidth    int
+		wantUpscaled bool
+	}{
+		{"smaller than the source", 640, 1920, 640, false},
+		{"same as the source", 1920, 1920, 1920, false},
+		{"clamped to the source", 1920, 1280, 1280, true},
+		{"clamped to an even width", 1920, 1279, 1278, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &VideoConfiguration{MaxWidth: tt.maxWidth}
+			fitted, upscaled := v.fitSource(tt.srcWidth)
+			if fitted.MaxWidth != tt.wantWidth || upscaled != tt.wantUpscaled {
+				t.Errorf("fitSource() = %d, %t, want %d, %t", fitted.MaxWidth, upscaled, tt.wantWidth, tt.wantUpscaled)
+			}
+			if v.MaxWidth != tt.maxWidth {
+				t.Error("fitSource() modified the original configuration")
+			}
+		})
+	}
+}
+
+func TestVideoOutputKey(t *testing.T) {
+	mp4 := func(modify func(v *VideoConfiguration)) *VideoConfiguration {
+		v := &VideoConfiguration{MaxWidth: 1280, Quality: 23, FileType: MP4, Codec: H264}
+		modify(v)
+		return v
+	}
+	still := func(fileType FileOutputType, modify func(v *VideoConfiguration)) *VideoConfiguration {
+		v := &VideoConfiguration{MaxWidth: 1280, Quality: 80, FileType: fileType}
+		modify(v)
+		return v
+	}
+	oneClip := &PreviewConfiguration{Duration: 3, FrameRate: 10, Segments: 1}
+	threeClips := &PreviewConfiguration{Duration: 3, FrameRate: 10, Segments: 3}
+	sprite := &SpriteConfiguration{Interval: 5, Columns: 10, Rows: 10}
+	denseSprite := &SpriteConfiguration{Interval: 2, Columns: 10, Rows: 10}
+
+	tests := []struct {
+		name     string
+		a, b     *VideoConfiguration
+		wantSame bool
+	}{
+		{"identical", mp4(func(v *VideoConfiguration) {}), mp4(func(v *VideoConfiguration) {}), true},
+		{"different quality", mp4(func(v *VideoConfiguration) {}), mp4(func(v *VideoConfiguration) { v.Quality = 28 }), false},
+		{
+			"different audio codec",
+			mp4(func(v *VideoConfiguration) { v.Audio = &AudioConfiguration{Codec: AAC, Bitrate: 128} }),
+			mp4(func(v *VideoConfiguration) { v.Audio = &AudioConfiguration{Codec: AudioNone} }),
+			false,
+		},
+		{
+			"different audio bitrate",
+			mp4(func(v *VideoConfiguration) { v.Audio = &AudioConfiguration{Codec: AAC, Bitrate: 128} }),
+			mp4(func(v *VideoConfiguration) { v.Audio = &AudioConfiguration{Codec: AAC, Bitrate: 96} }),
+			false,
+		},
+		{
+			"different loudness normalisation",
+			mp4(func(v *VideoConfiguration) { v.Audio = &AudioConfiguration{Codec: AAC, Bitrate: 128} }),
+			mp4(func(v *VideoConfiguration) {
+				v.Audio = &AudioConfiguration{Codec: AAC, Bitrate: 128, Normalise: true, Loudness: -23}
+			}),
+			false,
+		},
+		{
+			"different thumbnail modes",
+			still(JPG, func(v *VideoConfiguration) { v.Thumbnail = &ThumbnailConfiguration{Mode: ThumbnailTime} }),
+			still(JPG, func(v *VideoConfiguration) { v.Thumbnail = &ThumbnailConfiguration{Mode: ThumbnailCount, Count: 3} }),
+			false,
+		},
+		{
+			"different thumbnail counts",
+			still(JPG, func(v *VideoConfiguration) { v.Thumbnail = &ThumbnailConfiguration{Mode: ThumbnailCount, Count: 3} }),
+			still(JPG, func(v *VideoConfiguration) { v.Thumbnail = &ThumbnailConfiguration{Mode: ThumbnailCount, Count: 5} }),
+			false,
+		},
+		{
+			"thumbnail and preview",
+			still(WebP, func(v *VideoConfiguration) {}),
+			still(WebP, func(v *VideoConfiguration) { v.Preview = oneClip }),
+			false,
+		},
+		{
+			"different preview segments",
+			still(WebP, func(v *VideoConfiguration) { v.Preview = oneClip }),
+			still(WebP, func(v *VideoConfiguration) { v.Preview = threeClips }),
+			false,
+		},
+		{
+			"thumbnail and sprite",
+			still(JPG, func(v *VideoConfiguration) {}),
+			still(JPG, func(v *VideoConfiguration) { v.Sprite = sprite }),
+			false,
+		},
+		{
+			"different sprite intervals",
+			still(JPG, func(v *VideoConfiguration) { v.Sprite = sprite }),
+			still(JPG, func(v *VideoConfiguration) { v.Sprite = denseSprite }),
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := tt.a.outputKey() == tt.b.outputKey(); same != tt.wantSame {
+				t.Errorf("outputKey() %q and %q, want the same key %t", tt.a.outputKey(), tt.b.outputKey(), tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestPlanVideoVariants(t *testing.T) {
+	preview := &VideoConfiguration{MaxWidth: 640, Quality: 80, FileType: WebP, Preview: &PreviewConfiguration{Duration: 3, FrameRate: 10, Segments: 1}}
+	sprite := &VideoConfiguration{MaxWidth: 320, Quality: 80, FileType: WebP, Sprite: &SpriteConfiguration{Interval: 5, Columns: 10, Rows: 10}}
+	mp4 := &VideoConfiguration{MaxWidth: 1920, Quality: 23, FileType: MP4, Codec: H264}
+	smallMP4 := &VideoConfiguration{MaxWidth: 1280, Quality: 23, FileType: MP4, Codec: H264}
+
+	tests := []struct {
+		name        string
+		policy      UpscalePolicy
+		configs     []*VideoConfiguration
+		srcWidth    int
+		wantWidths  []int
+		wantSkipped []SkipReason
+	}{
+		{"preview and sprite clamped to the same width", UpscaleClamp, []*VideoConfiguration{preview, sprite}, 300, []int{300, 300}, nil},
+		{"clamped video duplicating another", UpscaleClamp, []*VideoConfiguration{mp4, smallMP4}, 1280, []int{1280}, []SkipReason{SkipDuplicate}},
+		{"upscaled variants skipped", UpscaleSkip, []*VideoConfiguration{mp4, smallMP4, sprite}, 1280, []int{1280, 320}, []SkipReason{SkipUpscale}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaJob{MediaConfig: &MediaConfig{Upscale: tt.policy}}
+			var widths []int
+			for _, v := range m.planVideoVariants(tt.configs, tt.srcWidth, func(v *VideoConfiguration) string { return v.OutputFileSuffix(true) }) {
+				widths = append(widths, v.MaxWidth)
+			}
+			var skipped []SkipReason
+			for _, s := range m.Skipped {
+				skipped = append(skipped, s.Reason)
+			}
+			if !reflect.DeepEqual(widths, tt.wantWidths) || !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("planVideoVariants() output widths %v and skipped %v, want %v and %v", widths, skipped, tt.wantWidths, tt.wantSkipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// Chunked encoding splits a long video at keyframes into chunks, which are encoded in parallel as
+// chunk jobs by the worker pool, then concatenated without re-encoding. Audio is encoded once for
+// the whole video as the chunks are concatenated, so there are no gaps at chunk boundaries.
+
+// VideoChunk is a section of a video, encoded by a chunk job for its parent job
+type VideoChunk struct {
+	Index      int
+	Start      float64 // Position in seconds of the keyframe the chunk starts at
+	Frames     int     // Number of frames in the chunk, or 0 for the last chunk, which runs to the end
+	Config     *VideoConfiguration
+	OutputPath string // Path of the encoded chunk, in the parent job's temporary chunk directory
+	result     chan<- error
+}
+
+// ProcessChunk encodes a chunk job's chunk, reporting the result to its parent job
+func (m *MediaJob) ProcessChunk() {
+	fmt.Printf("Encoding chunk %d of '%s' from %.2fs\n", m.Chunk.Index+1, m.InputFile.Filename, m.Chunk.Start)
+	m.Chunk.result <- m.MediaProcessor.Video.TranscodeChunk(m, m.Chunk)
+}
+
+// shouldChunk reports whether a video configuration is encoded in chunks. Only progressive
+// videos more than twice the chunk duration are, as shorter videos gain little.
+func (m *MediaJob) shouldChunk(c *VideoConfiguration) bool {
+	if m.ChunkQueue == nil || m.FSConfig.ChunkDuration <= 0 || c.FileType.GetMediaType() != Video || c.FileType == CMAF {
+		return false
+	}
+	source, err := m.Probe()
+	return err == nil && source.Duration > 2*float64(m.FSConfig.ChunkDuration)
+}
+
+// transcodeChunked encodes a video configuration in chunks. The chunk jobs are queued for the
+// worker pool, and this job encodes chunks too while it waits for them, so the chunks are
+// always encoded even if every other worker is busy.
+func (m *MediaJob) transcodeChunked(c *VideoConfiguration) error {
+	frames, err := pixelio.ProbeFrames(m.InputFile.Path, m.FSConfig.FFprobePath)
+	if err != nil {
+		return err
+	}
+
+	// Chunks are written beside the output, so they're concatenated without crossing filesystems
+	outputPath := m.OutputPath(c)
+	chunkDir, err := ioutil.TempDir(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+"-chunks-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(chunkDir)
+
+	chunks := planChunks(frames, float64(m.FSConfig.ChunkDuration))
+	fmt.Printf("Encoding '%s' in %d chunks\n", m.InputFile.Filename, len(chunks))
+
+	results := make(chan error, len(chunks))
+	var chunkPaths []string
+	for _, chunk := range chunks {
+		chunk.Config = c
+		chunk.OutputPath = filepath.Join(chunkDir, fmt.Sprintf("chunk-%04d.mkv", chunk.Index))
+		chunk.result = results
+		chunkPaths = append(chunkPaths, chunk.OutputPath)
+	}
+
+	// Queue the chunk jobs from another goroutine, as the queue may be full
+	go func() {
+		for _, chunk := range chunks {
+			chunkJob := *m
+			chunkJob.Chunk = chunk
+			m.ChunkQueue <- chunkJob
+		}
+	}()
+
+	var errs error
+	for remaining := len(chunks); remaining > 0; {
+		select {
+		case err := <-results:
+			remaining--
+			if err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		case chunkJob := <-m.ChunkQueue:
+			chunkJob.ProcessChunk()
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+
+	return m.MediaProcessor.Video.Concat(m, c, chunkPaths)
+}
+
+// planChunks splits a video's frames into chunks of roughly the target duration, each starting
+// at a keyframe. The last chunk is at least half the target duration, to avoid a tiny chunk.
+// Without any frames, the whole video is a single chunk.
+func planChunks(frames []pixelio.Frame, target float64) []*VideoChunk {
+	if len(frames) == 0 {
+		return []*VideoChunk{{}}
+	}
+	end := frames[len(frames)-1].Time
+	chunks := []*VideoChunk{{Start: frames[0].Time}}
+	startFrame := 0
+	for i, frame := range frames {
+		current := chunks[len(chunks)-1]
+		if !frame.Keyframe || frame.Time < current.Start+target || frame.Time > end-target/2 {
+			continue
+		}
+		current.Frames = i - startFrame
+		chunks = append(chunks, &VideoChunk{Index: len(chunks), Start: frame.Time})
+		startFrame = i
+	}
+	return chunks
+}
+
+// concatList writes a list of chunks for ffmpeg's concat demuxer, quoting their paths
+func concatList(chunkPaths []string) string {
+	var list strings.Builder
+	for _, path := range chunkPaths {
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(path, "'", `'\''`))
+	}
+	return list.String()
+}
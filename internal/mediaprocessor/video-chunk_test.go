@@ -0,0 +1,66 @@
+package mediaprocessor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// testFrames returns count frames a second apart, with a keyframe every keyframeInterval
+// frames, or only the first frame if keyframeInterval is 0
+func testFrames(count int, keyframeInterval int) []pixelio.Frame {
+	frames := make([]pixelio.Frame, count)
+	for i := range frames {
+		frames[i] = pixelio.Frame{Time: float64(i), Keyframe: i == 0 || keyframeInterval > 0 && i%keyframeInterval == 0}
+	}
+	return frames
+}
+
+func TestPlanChunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []pixelio.Frame
+		target float64
+		want   []VideoChunk
+	}{
+		{"no frames", nil, 10, []VideoChunk{{Index: 0, Start: 0, Frames: 0}}},
+		{"single keyframe", testFrames(100, 0), 10, []VideoChunk{{Index: 0, Start: 0, Frames: 0}}},
+		{"no keyframes", []pixelio.Frame{{Time: 0}, {Time: 20}, {Time: 40}}, 10, []VideoChunk{{Index: 0, Start: 0, Frames: 0}}},
+		{
+			"split at keyframes", testFrames(35, 10), 10,
+			[]VideoChunk{{Index: 0, Start: 0, Frames: 10}, {Index: 1, Start: 10, Frames: 10}, {Index: 2, Start: 20, Frames: 0}},
+		},
+		{
+			"chunks reach the target before splitting", testFrames(40, 4), 10,
+			[]VideoChunk{{Index: 0, Start: 0, Frames: 12}, {Index: 1, Start: 12, Frames: 12}, {Index: 2, Start: 24, Frames: 0}},
+		},
+		{
+			"short last chunk merged", testFrames(24, 10), 10,
+			[]VideoChunk{{Index: 0, Start: 0, Frames: 10}, {Index: 1, Start: 10, Frames: 0}},
+		},
+		{
+			"first frame after the start", []pixelio.Frame{{Time: 0.5, Keyframe: true}, {Time: 10.5, Keyframe: true}, {Time: 30.5}}, 10,
+			[]VideoChunk{{Index: 0, Start: 0.5, Frames: 1}, {Index: 1, Start: 10.5, Frames: 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []VideoChunk
+			for _, chunk := range planChunks(tt.frames, tt.target) {
+				got = append(got, *chunk)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planChunks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcatList(t *testing.T) {
+	want := "file '/tmp/chunk-0000.mkv'\nfile '/tmp/it'\\''s/chunk-0001.mkv'\n"
+	if got := concatList([]string{"/tmp/chunk-0000.mkv", "/tmp/it's/chunk-0001.mkv"}); got != want {
+		t.Errorf("concatList() =\n%s\nwant\n%s", got, want)
+	}
+}
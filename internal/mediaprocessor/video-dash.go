@@ -0,0 +1,152 @@
+package mediaprocessor
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// The subset of the MPEG-DASH MPD schema needed to describe static CMAF renditions
+// https://dashif.org/docs/DASH-IF-IOP-v4.3.pdf
+
+type dashMPD struct {
+	XMLName                   xml.Name   `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                  string     `xml:"profiles,attr"`
+	Type                      string     `xml:"type,attr"`
+	MediaPresentationDuration string     `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string     `xml:"minBufferTime,attr"`
+	Period                    dashPeriod `xml:"Period"`
+}
+
+type dashPeriod struct {
+	ID             string              `xml:"id,attr"`
+	AdaptationSets []dashAdaptationSet `xml:"AdaptationSet"`
+}
+
+type dashAdaptationSet struct {
+	ID               int                  `xml:"id,attr"`
+	ContentType      string               `xml:"contentType,attr"`
+	MimeType         string               `xml:"mimeType,attr"`
+	SegmentAlignment bool                 `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                  `xml:"startWithSAP,attr"`
+	Representations  []dashRepresentation `xml:"Representation"`
+}
+
+type dashRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int                 `xml:"bandwidth,attr"`
+	Codecs          string              `xml:"codecs,attr"`
+	Width           int                 `xml:"width,attr,omitempty"`
+	Height          int                 `xml:"height,attr,omitempty"`
+	SegmentTemplate dashSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type dashSegmentTemplate struct {
+	Timescale      int           `xml:"timescale,attr"`
+	Initialization string        `xml:"initialization,attr"`
+	Media          string        `xml:"media,attr"`
+	StartNumber    int           `xml:"startNumber,attr"`
+	Timeline       []dashSegment `xml:"SegmentTimeline>S"`
+}
+
+type dashSegment struct {
+	Duration int `xml:"d,attr"`
+	Repeat   int `xml:"r,attr,omitempty"` // Number of following segments with the same duration
+}
+
+// dashTimescale is the number of DASH timeline units per second
+const dashTimescale = 1000
+
+// writeDASHManifest writes a static DASH manifest listing CMAF renditions and their separate
+// audio track, if there is one. The segments are shared with the HLS playlists, so they're
+// addressed using the names ffmpeg gave them, numbered from 0.
+func writeDASHManifest(manifestPath string, segmentDuration int, renditions []*hlsRendition, audio *hlsRendition) error {
+	var duration float64
+	for _, r := range renditions {
+		duration = math.Max(duration, r.duration())
+	}
+
+	mpd := dashMPD{
+		Profiles:                  "urn:mpeg:dash:profile:isoff-live:2011,urn:mpeg:dash:profile:cmaf:2019",
+		Type:                      "static",
+		MediaPresentationDuration: fmt.Sprintf("PT%.3fS", duration),
+		MinBufferTime:             fmt.Sprintf("PT%dS", segmentDuration),
+		Period:                    dashPeriod{ID: "0"},
+	}
+
+	// Players can only switch between representations with the same codec, so each codec gets its
+	// own adaptation set
+	var codecs []VideoCodec
+	byCodec := make(map[VideoCodec][]*hlsRendition)
+	for _, r := range renditions {
+		if byCodec[r.codec] == nil {
+			codecs = append(codecs, r.codec)
+		}
+		byCodec[r.codec] = append(byCodec[r.codec], r)
+	}
+	for _, codec := range codecs {
+		adaptationSet := dashAdaptationSet{
+			ID:               len(mpd.Period.AdaptationSets),
+			ContentType:      "video",
+			MimeType:         "video/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+		}
+		for _, r := range byCodec[codec] {
+			representation := dashRepresentationFromRendition(r)
+			representation.Width, representation.Height = r.width, r.height
+			adaptationSet.Representations = append(adaptationSet.Representations, representation)
+		}
+		mpd.Period.AdaptationSets = append(mpd.Period.AdaptationSets, adaptationSet)
+	}
+
+	if audio != nil {
+		mpd.Period.AdaptationSets = append(mpd.Period.AdaptationSets, dashAdaptationSet{
+			ID:               len(mpd.Period.AdaptationSets),
+			ContentType:      "audio",
+			MimeType:         "audio/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			Representations:  []dashRepresentation{dashRepresentationFromRendition(audio)},
+		})
+	}
+
+	data, err := xml.MarshalIndent(mpd, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+
+	return ioutil.WriteFile(manifestPath, data, 0644)
+}
+
+// dashRepresentationFromRendition describes a rendition's segments as a DASH representation
+func dashRepresentationFromRendition(r *hlsRendition) dashRepresentation {
+	name := strings.TrimSuffix(filepath.Base(r.playlist), ".m3u8")
+
+	template := dashSegmentTemplate{
+		Timescale:      dashTimescale,
+		Initialization: filepath.Base(r.init),
+		Media:          name + "-$Number%03d$" + filepath.Ext(r.segments[0]),
+		StartNumber:    0,
+	}
+	for _, d := range r.durations {
+		units := int(math.Round(d * dashTimescale))
+		last := len(template.Timeline) - 1
+		if last >= 0 && template.Timeline[last].Duration == units {
+			template.Timeline[last].Repeat++
+			continue
+		}
+		template.Timeline = append(template.Timeline, dashSegment{Duration: units})
+	}
+
+	return dashRepresentation{
+		ID:              name,
+		Bandwidth:       r.bandwidth,
+		Codecs:          r.codecs,
+		SegmentTemplate: template,
+	}
+}
@@ -0,0 +1,135 @@
+package mediaprocessor
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDASHRepresentationFromRendition(t *testing.T) {
+	tests := []struct {
+		name      string
+		durations []float64
+		want      []dashSegment
+	}{
+		{"equal segments repeated", []float64{4, 4, 4, 1.5}, []dashSegment{{Duration: 4000, Repeat: 2}, {Duration: 1500}}},
+		{"durations rounded to the timescale", []float64{4.0004, 3.9996, 2}, []dashSegment{{Duration: 4000, Repeat: 1}, {Duration: 2000}}},
+		{"varying segments", []float64{2, 4, 2}, []dashSegment{{Duration: 2000}, {Duration: 4000}, {Duration: 2000}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &hlsRendition{
+				playlist:  "output/sunset-cmaf/720-h264.m3u8",
+				init:      "output/sunset-cmaf/720-h264-init.mp4",
+				segments:  []string{"output/sunset-cmaf/720-h264-000.m4s"},
+				durations: tt.durations,
+				bandwidth: 3000000,
+				codecs:    "avc1.64001F",
+			}
+			want := dashRepresentation{
+				ID:        "720-h264",
+				Bandwidth: 3000000,
+				Codecs:    "avc1.64001F",
+				SegmentTemplate: dashSegmentTemplate{
+					Timescale:      dashTimescale,
+					Initialization: "720-h264-init.mp4",
+					Media:          "720-h264-$Number%03d$.m4s",
+					Timeline:       tt.want,
+				},
+			}
+			if got := dashRepresentationFromRendition(r); !reflect.DeepEqual(got, want) {
+				t.Errorf("dashRepresentationFromRendition() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteDASHManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rendition := func(name string, codec VideoCodec, width int, height int) *hlsRendition {
+		return &hlsRendition{
+			playlist:  filepath.Join(dir, name+".m3u8"),
+			init:      filepath.Join(dir, name+"-init.mp4"),
+			segments:  []string{filepath.Join(dir, name+"-000.m4s"), filepath.Join(dir, name+"-001.m4s")},
+			durations: []float64{4, 2.5},
+			width:     width,
+			height:    height,
+			codec:     codec,
+		}
+	}
+	h264640 := rendition("640-h264", H264, 640, 360)
+	h2641280 := rendition("1280-h264", H264, 1280, 720)
+	av1 := rendition("1280-av1", AV1, 1280, 720)
+	audio := &hlsRendition{
+		playlist:  filepath.Join(dir, "audio.m3u8"),
+		init:      filepath.Join(dir, "audio-init.mp4"),
+		segments:  []string{filepath.Join(dir, "audio-000.m4s")},
+		durations: []float64{6.6},
+		codecs:    aacCodecString,
+	}
+
+	type adaptationSet struct {
+		contentType     string
+		representations []string
+	}
+	tests := []struct {
+		name       string
+		renditions []*hlsRendition
+		audio      *hlsRendition
+		want       []adaptationSet
+	}{
+		{
+			"a set for each codec", []*hlsRendition{h264640, av1, h2641280}, nil,
+			[]adaptationSet{{"video", []string{"640-h264", "1280-h264"}}, {"video", []string{"1280-av1"}}},
+		},
+		{
+			"separate audio track", []*hlsRendition{h264640, h2641280}, audio,
+			[]adaptationSet{{"video", []string{"640-h264", "1280-h264"}}, {"audio", []string{"audio"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "manifest.mpd")
+			if err := writeDASHManifest(path, 4, tt.renditions, tt.audio); err != nil {
+				t.Fatalf("writeDASHManifest() error = %v", err)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var mpd dashMPD
+			if err := xml.Unmarshal(data, &mpd); err != nil {
+				t.Fatalf("writeDASHManifest() wrote an invalid manifest: %v", err)
+			}
+
+			if mpd.Type != "static" || mpd.MediaPresentationDuration != "PT6.500S" || mpd.MinBufferTime != "PT4S" {
+				t.Errorf("writeDASHManifest() wrote type %s, duration %s and buffer time %s", mpd.Type, mpd.MediaPresentationDuration, mpd.MinBufferTime)
+			}
+
+			var got []adaptationSet
+			for n, a := range mpd.Period.AdaptationSets {
+				if a.ID != n {
+					t.Errorf("writeDASHManifest() wrote adaptation set %d with id %d", n, a.ID)
+				}
+				set := adaptationSet{contentType: a.ContentType}
+				for _, r := range a.Representations {
+					set.representations = append(set.representations, r.ID)
+				}
+				got = append(got, set)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("writeDASHManifest() wrote adaptation sets %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
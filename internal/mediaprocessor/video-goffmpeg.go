@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 
+	goffmpeg "github.com/xfrr/goffmpeg/ffmpeg"
 	"github.com/xfrr/goffmpeg/transcoder"
 )
 
@@ -11,18 +12,16 @@ import (
 // doesn't allow custom flags to be passed.
 type VideoGoffmpeg struct{}
 
-func (v *VideoGoffmpeg) Thumbnail(m *MediaJob, videoConfig *VideoConfiguration) (err error) {
-	outputFilepath := m.OutputPath(videoConfig)
-
-	t := new(transcoder.Transcoder)
-	if err = t.Initialize(m.InputFile.Path, outputFilepath); err != nil {
+func (v *VideoGoffmpeg) Thumbnail(m *MediaJob, videoConfig *VideoConfiguration, seconds float64, outputPath string) (err error) {
+	t := newGoffmpegTranscoder(m)
+	if err = t.Initialize(m.InputFile.Path, outputPath); err != nil {
 		log.Println("Error initialising video transcoder:", err)
 		return
 	}
 
 	t.MediaFile().SetVframes(1)
 	t.MediaFile().SetSkipAudio(true)
-	t.MediaFile().SetSeekTime("0")                                                 // Use first frame for thumbnail
+	t.MediaFile().SetSeekTime(fmt.Sprintf("%.3f", seconds))
 	t.MediaFile().SetVideoFilter(fmt.Sprintf("scale=%d:-2", videoConfig.MaxWidth)) // -2 ensures height is a multiple of 2
 	t.MediaFile().SetQScale(uint32(videoConfig.Quality))
 
@@ -35,7 +34,7 @@ func (v *VideoGoffmpeg) Thumbnail(m *MediaJob, videoConfig *VideoConfiguration)
 func (v *VideoGoffmpeg) Transcode(m *MediaJob, videoConfig *VideoConfiguration) (err error) {
 	outputFilepath := m.OutputPath(videoConfig)
 
-	t := new(transcoder.Transcoder)
+	t := newGoffmpegTranscoder(m)
 	if err = t.Initialize(m.InputFile.Path, outputFilepath); err != nil {
 		log.Println("Error initialising video transcoder:", err)
 		return
@@ -71,3 +70,30 @@ func (v *VideoGoffmpeg) Transcode(m *MediaJob, videoConfig *VideoConfiguration)
 	err = <-done
 	return
 }
+
+func (v *VideoGoffmpeg) Preview(m *MediaJob, videoConfig *VideoConfiguration, clips []PreviewClip) error {
+	return fmt.Errorf("animated previews require custom ffmpeg flags, which aren't supported by VideoGoffmpeg")
+}
+
+func (v *VideoGoffmpeg) Sprite(m *MediaJob, videoConfig *VideoConfiguration, grid SpriteGrid, outputPattern string) error {
+	return fmt.Errorf("sprite sheets require custom ffmpeg flags, which aren't supported by VideoGoffmpeg")
+}
+
+func (v *VideoGoffmpeg) TranscodeChunk(m *MediaJob, chunk *VideoChunk) error {
+	return fmt.Errorf("chunked encoding requires custom ffmpeg flags, which aren't supported by VideoGoffmpeg")
+}
+
+func (v *VideoGoffmpeg) Concat(m *MediaJob, videoConfig *VideoConfiguration, chunkPaths []string) error {
+	return fmt.Errorf("chunked encoding requires custom ffmpeg flags, which aren't supported by VideoGoffmpeg")
+}
+
+func (v *VideoGoffmpeg) Segment(m *MediaJob, rendition *VideoConfiguration, options SegmentOptions) error {
+	return fmt.Errorf("segmented output requires custom ffmpeg flags, which aren't supported by VideoGoffmpeg")
+}
+
+// newGoffmpegTranscoder creates a transcoder using the job's ffmpeg and ffprobe binaries
+func newGoffmpegTranscoder(m *MediaJob) *transcoder.Transcoder {
+	t := new(transcoder.Transcoder)
+	t.SetConfiguration(goffmpeg.Configuration{FfmpegBin: m.FSConfig.FFmpegPath, FfprobeBin: m.FSConfig.FFprobePath})
+	return t
+}
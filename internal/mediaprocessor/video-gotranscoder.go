@@ -2,11 +2,16 @@ package mediaprocessor
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/floostack/transcoder/ffmpeg"
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
 )
 
 // VideoGotranscoder is based on github.com/floostack/transcoder.
@@ -14,10 +19,10 @@ import (
 // codecs such as VP9.
 type VideoGotranscoder struct{}
 
-func (v *VideoGotranscoder) Thumbnail(m *MediaJob, videoConfig *VideoConfiguration) (err error) {
+func (v *VideoGotranscoder) Thumbnail(m *MediaJob, videoConfig *VideoConfiguration, seconds float64, outputPath string) (err error) {
 	vFrames := 1
 	skipAudio := true
-	seekTime := "0"
+	seekTime := fmt.Sprintf("%.3f", seconds)
 	videoFilter := fmt.Sprintf("scale=%d:-2", videoConfig.MaxWidth)
 
 	opts := ffmpeg.Options{
@@ -30,7 +35,7 @@ func (v *VideoGotranscoder) Thumbnail(m *MediaJob, videoConfig *VideoConfigurati
 		QScaleVideo: &videoConfig.Quality,
 	}
 
-	err = transcodeVideo(m, videoConfig, opts, customOpts)
+	err = transcodeVideo(m, outputPath, opts, customOpts)
 	if err != nil {
 		return err
 	}
@@ -45,62 +50,141 @@ func (v *VideoGotranscoder) Transcode(m *MediaJob, videoConfig *VideoConfigurati
 	}
 
 	// Generate ffmpeg options and custom options for first pass
-	var opts ffmpeg.Options
-	var customOpts CustomOptions
-	var secondPass bool
-	switch videoConfig.Codec {
-	case H264:
-		opts, customOpts, secondPass = getH264Params(videoConfig)
-	case H265:
-		opts, customOpts, secondPass = getH265Params(videoConfig)
-	case VP9:
-		opts, customOpts, secondPass = getVp9Params(m, videoConfig, 1)
-	case AV1:
-		opts, customOpts, secondPass = getAv1Params(m, videoConfig, 1)
-	default:
-		return fmt.Errorf("unknown codec type '%s'", videoConfig.Codec)
+	passLogFile := m.OutputPath(videoConfig) + ".log"
+	opts, customOpts, secondPass, err := getEncoderParams(videoConfig, 1, passLogFile)
+	if err != nil {
+		return err
 	}
 
-	err = transcodeVideo(m, videoConfig, opts, customOpts)
+	// Audio is encoded in the final pass. If the source can't be probed, assume it has audio
+	source, _ := m.Probe()
+	if !secondPass {
+		getAudioParams(&opts, videoConfig.Audio, source)
+	}
+
+	err = transcodeVideo(m, m.OutputPath(videoConfig), opts, customOpts)
 	if err != nil {
 		return err
 	}
 
 	// If using a 2-pass codec, perform the second pass
 	if secondPass {
-		switch videoConfig.Codec {
-		case VP9:
-			opts, customOpts, _ = getVp9Params(m, videoConfig, 2)
-		case AV1:
-			opts, customOpts, _ = getAv1Params(m, videoConfig, 2)
-		default:
-			return fmt.Errorf("no second pass action configured for file type '%s'", videoConfig.FileType)
+		opts, customOpts, _, _ = getEncoderParams(videoConfig, 2, passLogFile)
+		getAudioParams(&opts, videoConfig.Audio, source)
+
+		err = transcodeVideo(m, m.OutputPath(videoConfig), opts, customOpts)
+		if err != nil {
+			return err
 		}
+	}
 
-		err = transcodeVideo(m, videoConfig, opts, customOpts)
+	return
+}
+
+// TranscodeChunk encodes a chunk of a video, without audio, seeking the input to the chunk's
+// keyframe. Two-pass encoders keep separate stats for each chunk.
+func (v *VideoGotranscoder) TranscodeChunk(m *MediaJob, chunk *VideoChunk) (err error) {
+	inputArgs := []string{"-seek_timestamp", "1", "-ss", fmt.Sprintf("%.6f", chunk.Start), "-i", m.InputFile.Path}
+	passLogFile := chunk.OutputPath + ".log"
+	for pass := 1; pass <= 2; pass++ {
+		opts, customOpts, twoPass, err := getEncoderParams(chunk.Config, pass, passLogFile)
 		if err != nil {
 			return err
 		}
+		skipAudio := true
+		opts.SkipAudio = &skipAudio
+		if chunk.Frames > 0 {
+			opts.Vframes = &chunk.Frames
+		}
+		// Chunks are Matroska, which doesn't use codec tags. The tag is set on concatenation
+		customOpts.VideoTag = nil
+
+		if err := runFFmpeg(m, inputArgs, chunk.OutputPath, opts, customOpts); err != nil {
+			return err
+		}
+		if !twoPass {
+			break
+		}
+	}
+	return nil
+}
+
+// Concat joins encoded chunks into the output video without re-encoding them, encoding the
+// source's audio alongside
+func (v *VideoGotranscoder) Concat(m *MediaJob, videoConfig *VideoConfiguration, chunkPaths []string) (err error) {
+	listPath := filepath.Join(filepath.Dir(chunkPaths[0]), "chunks.txt")
+	if err := ioutil.WriteFile(listPath, []byte(concatList(chunkPaths)), 0644); err != nil {
+		return err
+	}
+	inputArgs := []string{
+		"-f", "concat", "-safe", "0", "-i", listPath, "-i", m.InputFile.Path, "-map", "0:v:0", "-map", "1:a:0?",
+	}
+
+	// The chunks' codec tag and container flags, such as faststart, are set when they're joined
+	encoderOpts, encoderCustomOpts, _, err := getEncoderParams(videoConfig, 1, "")
+	if err != nil {
+		return err
 	}
 
+	videoCodec := "copy"
+	overwrite := true
+	opts := ffmpeg.Options{
+		VideoCodec: &videoCodec,
+		Overwrite:  &overwrite,
+		MovFlags:   encoderOpts.MovFlags,
+	}
+	source, _ := m.Probe()
+	getAudioParams(&opts, videoConfig.Audio, source)
+
+	customOpts := CustomOptions{
+		VideoTag: encoderCustomOpts.VideoTag,
+	}
+
+	return runFFmpeg(m, inputArgs, m.OutputPath(videoConfig), opts, customOpts)
+}
+
+// Preview encodes an animated preview of the clips
+func (v *VideoGotranscoder) Preview(m *MediaJob, videoConfig *VideoConfiguration, clips []PreviewClip) (err error) {
+	opts, customOpts := getPreviewParams(videoConfig, clips)
+	return runFFmpeg(m, previewInputArgs(m.InputFile.Path, clips), m.OutputPath(videoConfig), opts, customOpts)
+}
+
+// Sprite tiles frames into sprite sheets, numbered by an image2 sequence pattern, e.g. clip-sprite-%d.jpg
+func (v *VideoGotranscoder) Sprite(m *MediaJob, videoConfig *VideoConfiguration, grid SpriteGrid, outputPattern string) (err error) {
+	opts, customOpts := getSpriteParams(videoConfig, grid)
+	return transcodeVideo(m, outputPattern, opts, customOpts)
+}
+
+// getEncoderParams provides ffmpeg parameters for a pass of a VideoConfiguration's encoder, and
+// whether it needs a second pass. Two-pass encoders write their stats to passLogFile.
+func getEncoderParams(c *VideoConfiguration, pass int, passLogFile string) (opts ffmpeg.Options, customOpts CustomOptions, twoPass bool, err error) {
+	switch c.Encoder {
+	case EncoderX264:
+		opts, customOpts, twoPass = getH264Params(c)
+	case EncoderX265, EncoderX265Grain, EncoderX265Animation:
+		opts, customOpts, twoPass = getH265Params(c)
+	case EncoderVPX:
+		opts, customOpts, twoPass = getVp9Params(c, pass, passLogFile)
+	case EncoderAOM:
+		opts, customOpts, twoPass = getAv1Params(c, pass, passLogFile)
+	case EncoderSVTAV1:
+		opts, customOpts, twoPass = getSvtAv1Params(c)
+	case EncoderRav1e:
+		opts, customOpts, twoPass = getRav1eParams(c)
+	default:
+		err = fmt.Errorf("unknown encoder '%s'", c.Encoder)
+	}
 	return
 }
 
-// transcodeVideo performs the actual video transcoding, based on passed configuration
-func transcodeVideo(m *MediaJob, videoConfig *VideoConfiguration, opts ffmpeg.Options, customOpts CustomOptions) (err error) {
+// transcodeVideo performs the actual video transcoding to outputFilepath, based on passed configuration
+func transcodeVideo(m *MediaJob, outputFilepath string, opts ffmpeg.Options, customOpts CustomOptions) (err error) {
 	ffmpegConf := &ffmpeg.Config{
-		FfmpegBinPath:   "/usr/local/bin/ffmpeg",
-		FfprobeBinPath:  "/usr/local/bin/ffprobe",
+		FfmpegBinPath:   m.FSConfig.FFmpegPath,
+		FfprobeBinPath:  m.FSConfig.FFprobePath,
 		ProgressEnabled: true,
 	}
 
-	params := strings.Join(opts.GetStrArguments(), " ")
-	paramsCustom := strings.Join(customOpts.GetStrArguments(), " ")
-
-	// For debugging
-	fmt.Printf("** ffmpeg command is:\n    %s\n    %s\n", params, paramsCustom)
-
-	outputFilepath := m.OutputPath(videoConfig)
 	progress, err := ffmpeg.
 		New(ffmpegConf).
 		Input(m.InputFile.Path).
@@ -121,6 +205,32 @@ func transcodeVideo(m *MediaJob, videoConfig *VideoConfiguration, opts ffmpeg.Op
 	return
 }
 
+// runFFmpeg runs ffmpeg directly, for encodes which need input options such as seeking, which
+// floostack/transcoder can't pass. inputArgs are the inputs, with their options and mapping.
+func runFFmpeg(m *MediaJob, inputArgs []string, outputFilepath string, opts ffmpeg.Options, customOpts CustomOptions) error {
+	args := append([]string{"-hide_banner", "-loglevel", "error"}, inputArgs...)
+	args = append(args, opts.GetStrArguments()...)
+	args = append(args, customOpts.GetStrArguments()...)
+	args = append(args, outputFilepath)
+
+	if output, err := exec.Command(m.FSConfig.FFmpegPath, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed for %s: %s: %s", outputFilepath, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Segment encodes a rendition into HLS segments, writing its media playlist. If rendition is
+// nil, only the source's audio is segmented.
+func (v *VideoGotranscoder) Segment(m *MediaJob, rendition *VideoConfiguration, options SegmentOptions) (err error) {
+	opts, customOpts := getSegmentParams(rendition, options)
+	if options.Audio != nil {
+		source, _ := m.Probe()
+		getAudioParams(&opts, options.Audio, source)
+	}
+
+	return transcodeVideo(m, options.PlaylistPath, opts, customOpts)
+}
+
 /*
 getH264Params provides ffmpeg parameters for h264 encoding.
 https://trac.ffmpeg.org/wiki/Encode/H.264
@@ -162,6 +272,7 @@ https://trac.ffmpeg.org/wiki/Encode/H.265
 
 	* 1-pass encoding
 	* Preset can be selected (default 'slow')
+	* x265 settings profiles select a tuning, e.g. to retain film grain
 */
 func getH265Params(c *VideoConfiguration) (opts ffmpeg.Options, optsCustom CustomOptions, twoPass bool) {
 	videoCodec := "libx265"
@@ -180,10 +291,16 @@ func getH265Params(c *VideoConfiguration) (opts ffmpeg.Options, optsCustom Custo
 		// Crf:          &crf, // Currently not working
 	}
 
+	if tune := x265Tune[c.Encoder]; tune != "" {
+		opts.Tune = &tune
+	}
+
 	crf := c.Quality
+	videoTag := "hvc1" // Apple platforms only play HEVC tagged as hvc1, rather than ffmpeg's default hev1
 
 	optsCustom = CustomOptions{
-		Crf: &crf,
+		Crf:      &crf,
+		VideoTag: &videoTag,
 	}
 
 	return opts, optsCustom, false
@@ -196,7 +313,7 @@ https://trac.ffmpeg.org/wiki/Encode/VP9
 	* 2-pass encoding recommended
 	* Does -b:v 0 need to be set?
 */
-func getVp9Params(m *MediaJob, c *VideoConfiguration, pass int) (opts ffmpeg.Options, customOpts CustomOptions, twoPass bool) {
+func getVp9Params(c *VideoConfiguration, pass int, passLogFile string) (opts ffmpeg.Options, customOpts CustomOptions, twoPass bool) {
 	videoCodec := "libvpx-vp9"
 	overwrite := true
 	videoFilter := fmt.Sprintf("scale=%d:-2", c.MaxWidth)
@@ -213,7 +330,6 @@ func getVp9Params(m *MediaJob, c *VideoConfiguration, pass int) (opts ffmpeg.Opt
 		}
 
 		pass := 1
-		passLogFile := m.OutputPath(c) + ".log"
 
 		customOpts = CustomOptions{
 			Pass:        &pass,
@@ -229,7 +345,6 @@ func getVp9Params(m *MediaJob, c *VideoConfiguration, pass int) (opts ffmpeg.Opt
 		}
 
 		pass := 2
-		passLogFile := m.OutputPath(c) + ".log"
 
 		customOpts = CustomOptions{
 			Pass:        &pass,
@@ -244,16 +359,14 @@ func getVp9Params(m *MediaJob, c *VideoConfiguration, pass int) (opts ffmpeg.Opt
 }
 
 /*
-getAv1Params provides ffmpeg parameters for AV1 encoding.
+getAv1Params provides ffmpeg parameters for AV1 encoding with libaom.
 https://trac.ffmpeg.org/wiki/Encode/AV1
 
 	* Performs 2-pass encoding as this may help encoding efficiency - need to verify
-	* -cpu-used 8 minimises CPU load at the slight expense of quality; worth it as AV1 is expensive
-	* libopus audio codec
+	* The preset sets -cpu-used (default 8), which minimises CPU load at the slight expense of quality; worth it as AV1 is expensive
 */
-func getAv1Params(m *MediaJob, c *VideoConfiguration, pass int) (opts ffmpeg.Options, customOpts CustomOptions, twoPass bool) {
+func getAv1Params(c *VideoConfiguration, pass int, passLogFile string) (opts ffmpeg.Options, customOpts CustomOptions, twoPass bool) {
 	videoCodec := "libaom-av1"
-	audioCodec := "libopus"
 	overwrite := true
 	videoFilter := fmt.Sprintf("scale=%d:-2", c.MaxWidth)
 
@@ -269,8 +382,7 @@ func getAv1Params(m *MediaJob, c *VideoConfiguration, pass int) (opts ffmpeg.Opt
 		}
 
 		pass := 1
-		passLogFile := m.OutputPath(c) + ".log"
-		cpuUsed := 8
+		cpuUsed, _ := strconv.Atoi(c.Preset)
 
 		customOpts = CustomOptions{
 			Pass:        &pass,
@@ -282,14 +394,12 @@ func getAv1Params(m *MediaJob, c *VideoConfiguration, pass int) (opts ffmpeg.Opt
 		// Second pass
 		opts = ffmpeg.Options{
 			VideoCodec:  &videoCodec,
-			AudioCodec:  &audioCodec,
 			Overwrite:   &overwrite,
 			VideoFilter: &videoFilter,
 		}
 
 		pass := 2
-		passLogFile := m.OutputPath(c) + ".log"
-		cpuUsed := 8 // Fastest encoding; still very slow
+		cpuUsed, _ := strconv.Atoi(c.Preset)
 
 		customOpts = CustomOptions{
 			Pass:        &pass,
@@ -304,13 +414,323 @@ func getAv1Params(m *MediaJob, c *VideoConfiguration, pass int) (opts ffmpeg.Opt
 	return opts, customOpts, true
 }
 
+/*
+getSvtAv1Params provides ffmpeg parameters for AV1 encoding with SVT-AV1.
+https://gitlab.com/AOMediaCodec/SVT-AV1/-/blob/master/Docs/Ffmpeg.md
+
+	* 1-pass encoding, as SVT-AV1 is efficient without a second pass
+	* Preset can be selected, 0 (slowest) to 13 (default 8)
+	* Film grain synthesis removes grain before encoding and resynthesises it on playback, saving bitrate
+*/
+func getSvtAv1Params(c *VideoConfiguration) (opts ffmpeg.Options, customOpts CustomOptions, twoPass bool) {
+	videoCodec := "libsvtav1"
+	overwrite := true
+	videoFilter := fmt.Sprintf("scale=%d:-2", c.MaxWidth)
+
+	opts = ffmpeg.Options{
+		VideoCodec:  &videoCodec,
+		Overwrite:   &overwrite,
+		VideoFilter: &videoFilter,
+		Preset:      &c.Preset,
+	}
+
+	customOpts = CustomOptions{
+		Crf: &c.Quality,
+	}
+	if c.FilmGrain != 0 {
+		svtAv1Params := fmt.Sprintf("film-grain=%d", c.FilmGrain)
+		customOpts.SvtAv1Params = &svtAv1Params
+	}
+
+	return opts, customOpts, false
+}
+
+/*
+getRav1eParams provides ffmpeg parameters for AV1 encoding with rav1e.
+https://github.com/xiph/rav1e
+
+	* 1-pass encoding
+	* rav1e has no CRF mode, so a constant quantizer is used, scaled from the 0-63 CRF range to 0-255
+	* The preset sets -speed, 0 (slowest) to 10 (default 6)
+*/
+func getRav1eParams(c *VideoConfiguration) (opts ffmpeg.Options, customOpts CustomOptions, twoPass bool) {
+	videoCodec := "librav1e"
+	overwrite := true
+	videoFilter := fmt.Sprintf("scale=%d:-2", c.MaxWidth)
+
+	opts = ffmpeg.Options{
+		VideoCodec:  &videoCodec,
+		Overwrite:   &overwrite,
+		VideoFilter: &videoFilter,
+	}
+
+	qp := rav1eQuantizer(c.Quality)
+	speed, _ := strconv.Atoi(c.Preset)
+
+	customOpts = CustomOptions{
+		Qp:    &qp,
+		Speed: &speed,
+	}
+
+	return opts, customOpts, false
+}
+
+// rav1eQuantizer scales a CRF quality, 0-63, to a rav1e quantizer, 0-255
+func rav1eQuantizer(quality int) int {
+	qp := quality * 255 / 63
+	if qp > 255 {
+		return 255
+	}
+	return qp
+}
+
+/*
+getSegmentParams provides ffmpeg parameters for encoding a rendition into HLS segments.
+https://ffmpeg.org/ffmpeg-formats.html#hls-2
+
+	* 1-pass encoding, so that renditions can be segmented as they're encoded
+	* Keyframes are forced at every segment boundary, so that segments align across renditions
+	* 8-bit 4:2:0 video, which every HLS and DASH player supports
+	* fMP4 segments are fragmented for DASH, so can also be listed in a DASH manifest
+*/
+func getSegmentParams(c *VideoConfiguration, options SegmentOptions) (opts ffmpeg.Options, customOpts CustomOptions) {
+	name := strings.TrimSuffix(filepath.Base(options.PlaylistPath), ".m3u8")
+
+	overwrite := true
+	outputFormat := "hls"
+	playlistType := "vod"
+	segmentDuration := options.SegmentDuration
+
+	opts = ffmpeg.Options{
+		Overwrite:          &overwrite,
+		OutputFormat:       &outputFormat,
+		HlsPlaylistType:    &playlistType,
+		HlsSegmentDuration: &segmentDuration,
+	}
+
+	hlsFlags := "independent_segments"
+	customOpts = CustomOptions{
+		HLSFlags: &hlsFlags,
+	}
+
+	if c != nil {
+		videoFilter := fmt.Sprintf("scale=%d:-2", c.MaxWidth)
+		pixFmt := "yuv420p"
+		opts.VideoFilter = &videoFilter
+		opts.PixFmt = &pixFmt
+
+		forceKeyFrames := fmt.Sprintf("expr:gte(t,n_forced*%d)", options.SegmentDuration)
+		customOpts.ForceKeyFrames = &forceKeyFrames
+
+		if c.Encoder == EncoderRav1e {
+			qp := rav1eQuantizer(c.Quality)
+			customOpts.Qp = &qp
+		} else {
+			crf := c.Quality
+			customOpts.Crf = &crf
+		}
+
+		// Variable frame rate sources would otherwise leave renditions with differing frame timings
+		if options.FrameRate > 0 {
+			frameRate := strconv.FormatFloat(options.FrameRate, 'f', -1, 64)
+			customOpts.FrameRate = &frameRate
+		}
+
+		videoCodec := videoEncoderFFmpeg[c.Encoder]
+		switch c.Encoder {
+		case EncoderX264:
+			opts.Preset = &c.Preset
+		case EncoderX265, EncoderX265Grain, EncoderX265Animation:
+			opts.Preset = &c.Preset
+			if tune := x265Tune[c.Encoder]; tune != "" {
+				opts.Tune = &tune
+			}
+			videoTag := "hvc1"
+			customOpts.VideoTag = &videoTag
+		case EncoderVPX:
+			videoBitRate := "0" // Constant quality
+			opts.VideoBitRate = &videoBitRate
+		case EncoderAOM:
+			videoBitRate := "0" // Constant quality
+			opts.VideoBitRate = &videoBitRate
+			cpuUsed, _ := strconv.Atoi(c.Preset)
+			customOpts.CpuUsed = &cpuUsed
+		case EncoderSVTAV1:
+			opts.Preset = &c.Preset
+			if c.FilmGrain != 0 {
+				svtAv1Params := fmt.Sprintf("film-grain=%d", c.FilmGrain)
+				customOpts.SvtAv1Params = &svtAv1Params
+			}
+		case EncoderRav1e:
+			speed, _ := strconv.Atoi(c.Preset)
+			customOpts.Speed = &speed
+		}
+		opts.VideoCodec = &videoCodec
+	} else {
+		skipVideo := true
+		opts.SkipVideo = &skipVideo
+	}
+
+	// Audio parameters are set by getAudioParams, which needs the source's probe
+	if options.Audio == nil {
+		skipAudio := true
+		opts.SkipAudio = &skipAudio
+	}
+
+	segmentType := "mpegts"
+	segmentExt := ".ts"
+	if options.SegmentType == HLSfMP4 {
+		segmentType = "fmp4"
+		segmentExt = ".m4s"
+		initFilename := name + "-init.mp4" // Relative to the playlist
+		customOpts.HLSInitFilename = &initFilename
+	}
+	segmentFilename := filepath.Join(filepath.Dir(options.PlaylistPath), name+"-%03d"+segmentExt)
+	opts.HlsSegmentFilename = &segmentFilename
+	customOpts.HLSSegmentType = &segmentType
+
+	return opts, customOpts
+}
+
+/*
+getPreviewParams provides ffmpeg parameters for animated previews, which are silent and loop forever.
+
+	* Each clip is read as a separate input, seeking to its start, and the clips are joined with a filter
+	* WebP uses libwebp, with Quality from 0 to 100 as for images
+	* AVIF uses libaom-av1 at its fastest speed, with Quality scaled to the 0-63 CRF range
+	* GIF ignores Quality, as its palette is generated from the frames instead
+*/
+func getPreviewParams(c *VideoConfiguration, clips []PreviewClip) (opts ffmpeg.Options, customOpts CustomOptions) {
+	videoCodec := thumbnailEncoder[c.FileType]
+	overwrite := true
+	skipAudio := true
+	duration := fmt.Sprintf("%.3f", previewLength(clips))
+
+	opts = ffmpeg.Options{
+		VideoCodec: &videoCodec,
+		Overwrite:  &overwrite,
+		SkipAudio:  &skipAudio,
+		Duration:   &duration,
+	}
+
+	filter := previewFilter(c, clips)
+	outputMap := "[preview]"
+	loop := 0
+	customOpts = CustomOptions{
+		FilterComplex: &filter,
+		Map:           &outputMap,
+		Loop:          &loop,
+	}
+	switch c.FileType {
+	case WebP:
+		customOpts.Quality = &c.Quality
+	case AVIF:
+		crf := (100 - c.Quality) * 63 / 100
+		cpuUsed := numberedPresetMax[EncoderAOM]
+		customOpts.Crf = &crf
+		customOpts.CpuUsed = &cpuUsed
+	}
+
+	return opts, customOpts
+}
+
+/*
+getSpriteParams provides ffmpeg parameters for scrubbing sprite sheets.
+https://ffmpeg.org/ffmpeg-filters.html#tile
+
+	* Frames are sampled at the grid's interval, scaled to the exact tile size used in the WebVTT track, and tiled
+	* The number of sheets is capped, so the sheets always match the WebVTT track
+	* Quality sets -qscale:v, as for thumbnails
+*/
+func getSpriteParams(c *VideoConfiguration, grid SpriteGrid) (opts ffmpeg.Options, customOpts CustomOptions) {
+	overwrite := true
+	skipAudio := true
+	videoFilter := fmt.Sprintf(
+		"fps=1/%g,scale=%d:%d,tile=%dx%d",
+		grid.Interval, grid.Width, grid.Height, grid.Columns, grid.Rows,
+	)
+
+	opts = ffmpeg.Options{
+		Overwrite:   &overwrite,
+		SkipAudio:   &skipAudio,
+		VideoFilter: &videoFilter,
+		Vframes:     &grid.Sheets,
+	}
+	customOpts = CustomOptions{
+		QScaleVideo: &c.Quality,
+	}
+
+	return opts, customOpts
+}
+
+/*
+getAudioParams sets ffmpeg parameters for encoding a video's audio.
+https://trac.ffmpeg.org/wiki/Encode/AAC
+https://ffmpeg.org/ffmpeg-filters.html#loudnorm
+
+	* Audio is stripped if the codec is none, or the probed source has no audio
+	* Loudness normalisation uses single-pass loudnorm, to a true peak of -1 dBTP
+	* loudnorm resamples to 192kHz, so the source's sample rate is restored afterwards
+*/
+func getAudioParams(opts *ffmpeg.Options, a *AudioConfiguration, source *pixelio.Probe) {
+	if a == nil || a.Codec == AudioNone || (source != nil && !source.HasAudio()) {
+		skipAudio := true
+		opts.SkipAudio = &skipAudio
+		return
+	}
+
+	audioCodec := audioCodecEncoder[a.Codec]
+	audioBitrate := fmt.Sprintf("%dk", a.Bitrate)
+	opts.AudioCodec = &audioCodec
+	opts.AudioBitrate = &audioBitrate
+	if a.Channels != 0 {
+		channels := a.Channels
+		opts.AudioChannels = &channels
+	}
+
+	sampleRate := a.SampleRate
+	if a.Normalise {
+		audioFilter := fmt.Sprintf("loudnorm=I=%g:TP=-1:LRA=11", a.Loudness)
+		opts.AudioFilter = &audioFilter
+
+		if sampleRate == 0 {
+			sampleRate = 48000
+			if a.Codec != Opus && source != nil && source.AudioTracks[0].SampleRate != 0 {
+				sampleRate = source.AudioTracks[0].SampleRate
+			}
+		}
+	}
+	if sampleRate != 0 {
+		opts.AudioRate = &sampleRate
+	}
+}
+
 // TODO: Submit PR
 type CustomOptions struct {
-	Pass        *int    `flag:"-pass"`
-	PassLogFile *string `flag:"-passlogfile"`
-	Crf         *int    `flag:"-crf"`      // Work around bug with *uint32 in ffmpeg.Options
-	CpuUsed     *int    `flag:"-cpu-used"` // Used with AV1 codec
-	QScaleVideo *int    `flag:"-qscale:v"` // Used for thumbnails
+	Pass            *int    `flag:"-pass"`
+	PassLogFile     *string `flag:"-passlogfile"`
+	Crf             *int    `flag:"-crf"`                    // Work around bug with *uint32 in ffmpeg.Options
+	CpuUsed         *int    `flag:"-cpu-used"`               // Used with AV1 codec
+	QScaleVideo     *int    `flag:"-qscale:v"`               // Used for thumbnails
+	VideoTag        *string `flag:"-tag:v"`                  // Used with H.265 codec
+	ForceKeyFrames  *string `flag:"-force_key_frames"`       // Used to align HLS segments
+	HLSSegmentType  *string `flag:"-hls_segment_type"`       // Used with HLS and CMAF
+	HLSInitFilename *string `flag:"-hls_fmp4_init_filename"` // Used with fMP4 segments
+	HLSFlags        *string `flag:"-hls_flags"`              // Used with HLS and CMAF
+	FrameRate       *string `flag:"-r"`                      // Work around *int frame rates in ffmpeg.Options
+	Speed           *int    `flag:"-speed"`                  // Used with rav1e
+	Qp              *int    `flag:"-qp"`                     // Used with rav1e, which has no CRF mode
+	SvtAv1Params    *string `flag:"-svtav1-params"`          // Used with SVT-AV1 film grain synthesis
+	Quality         *int    `flag:"-quality"`                // Used with libwebp previews
+	Loop            *int    `flag:"-loop"`                   // Used with animated previews
+	FilterComplex   *string `flag:"-filter_complex"`         // Used to join the clips of animated previews
+	Map             *string `flag:"-map"`                    // Selects the output of FilterComplex
+}
+
+// x265Tune is the x265 tuning applied by each x265 settings profile
+var x265Tune = map[VideoEncoder]string{
+	EncoderX265Grain:     "grain",
+	EncoderX265Animation: "animation",
 }
 
 func (opts CustomOptions) GetStrArguments() []string {
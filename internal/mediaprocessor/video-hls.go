@@ -0,0 +1,357 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// SegmentOptions describes how a VideoProcessor should encode a rendition into HLS segments
+type SegmentOptions struct {
+	PlaylistPath    string // Path of the rendition's media playlist. Segments are named after the playlist
+	SegmentType     HLSSegmentType
+	SegmentDuration int                 // Target segment length in seconds. Keyframes are forced at each segment boundary
+	Audio           *AudioConfiguration // How to encode the source's audio. nil leaves it out
+	FrameRate       float64             // Constant output frame rate, usually the source's average. 0 keeps the source's timing
+}
+
+// segmentedLadder is a set of renditions segmented into a single dir, for adaptive streaming
+type segmentedLadder struct {
+	dir             string
+	segmentType     HLSSegmentType
+	segmentDuration int
+	renditions      []*VideoConfiguration
+	separateAudio   bool // Segment audio as its own track, as CMAF requires, rather than within each rendition
+	dash            bool // Also write a DASH manifest, sharing the same segments
+}
+
+// renditionPath returns the path of a rendition's media playlist
+// e.g. output/subdir1/sunset-hls/720-h264.m3u8
+func (l *segmentedLadder) renditionPath(rendition *VideoConfiguration) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%d-%s.m3u8", rendition.MaxWidth, rendition.Codec))
+}
+
+// audioPath returns the path of the media playlist of a ladder's separate audio track
+func (l *segmentedLadder) audioPath() string {
+	return filepath.Join(l.dir, "audio.m3u8")
+}
+
+// hlsRendition describes an encoded rendition, read from its HLS media playlist
+type hlsRendition struct {
+	playlist         string    // Path of the rendition's media playlist
+	init             string    // Path of the fMP4 init segment, if any
+	segments         []string  // Paths of the rendition's segments
+	durations        []float64 // Duration of each segment, in seconds
+	bandwidth        int       // Peak segment bitrate, in bits per second
+	averageBandwidth int       // Average bitrate, in bits per second
+	width            int
+	height           int
+	codec            VideoCodec // Empty for audio tracks
+	codecs           string     // RFC 6381 codecs, including any audio
+}
+
+// files returns the paths of every file written for a rendition
+func (r *hlsRendition) files() []string {
+	files := []string{r.playlist}
+	if r.init != "" {
+		files = append(files, r.init)
+	}
+	return append(files, r.segments...)
+}
+
+// duration returns the total duration of a rendition, in seconds
+func (r *hlsRendition) duration() (total float64) {
+	for _, d := range r.durations {
+		total += d
+	}
+	return
+}
+
+// HLSDir returns the output dir of a job's HLS playlists and segments
+// e.g. output/subdir1/sunset-hls
+func (m *MediaJob) HLSDir() string {
+	return pixelio.GetFileOutputPath(m.FSConfig.OutputDir, m.InputFile, "-hls")
+}
+
+// CMAFDir returns the output dir of a job's CMAF segments, and their DASH and HLS manifests
+// e.g. output/subdir1/sunset-cmaf
+func (m *MediaJob) CMAFDir() string {
+	return pixelio.GetFileOutputPath(m.FSConfig.OutputDir, m.InputFile, "-cmaf")
+}
+
+// ProcessHLS encodes a job's configured HLS ladder, with audio muxed into each rendition.
+// Returns the paths of every playlist and segment written.
+func (m *MediaJob) ProcessHLS() (filenames []string, errs error) {
+	hls := m.MediaConfig.HLS
+	return m.processLadder(&segmentedLadder{
+		dir:             m.HLSDir(),
+		segmentType:     hls.SegmentType,
+		segmentDuration: hls.SegmentDuration,
+		renditions:      hls.Renditions,
+	})
+}
+
+// ProcessCMAF encodes a job's cmaf VideoConfigurations as a ladder of CMAF renditions, with a
+// separate audio track. A single set of segments is listed in both a DASH manifest and an HLS
+// master playlist. Returns the paths of every manifest, playlist and segment written.
+func (m *MediaJob) ProcessCMAF(renditions []*VideoConfiguration) (filenames []string, errs error) {
+	return m.processLadder(&segmentedLadder{
+		dir:             m.CMAFDir(),
+		segmentType:     HLSfMP4,
+		segmentDuration: renditions[0].SegmentDuration,
+		renditions:      renditions,
+		separateAudio:   true,
+		dash:            true,
+	})
+}
+
+// processLadder encodes each rendition of a segmentedLadder using the configured VideoProcessor,
+// and writes the manifests listing them
+func (m *MediaJob) processLadder(l *segmentedLadder) (filenames []string, errs error) {
+	if err := pixelio.EnsureDirExists(l.dir); err != nil {
+		return nil, err
+	}
+
+	source, err := m.Probe()
+	if err != nil {
+		return nil, err
+	}
+	hasAudio := source.HasAudio()
+
+	renditionConfigs := l.renditions
+	if m.MediaConfig.Upscale != UpscaleAllow {
+		renditionConfigs = m.planVideoVariants(renditionConfigs, source.Width, l.renditionPath)
+	}
+	if len(renditionConfigs) == 0 {
+		return
+	}
+
+	var renditions []*hlsRendition
+	for _, renditionConfig := range renditionConfigs {
+		options := SegmentOptions{
+			PlaylistPath:    l.renditionPath(renditionConfig),
+			SegmentType:     l.segmentType,
+			SegmentDuration: l.segmentDuration,
+			FrameRate:       source.FrameRate,
+		}
+		if hasAudio && !l.separateAudio && renditionConfig.Audio.Codec != AudioNone {
+			options.Audio = renditionConfig.Audio
+		}
+
+		encodeStartTime := time.Now()
+		err := m.MediaProcessor.Video.Segment(m, renditionConfig, options)
+		fmt.Printf("Encoding took %.2fs\n", time.Since(encodeStartTime).Seconds())
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		rendition, err := readHLSRendition(options.PlaylistPath)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		stream, err := pixelio.ProbeVideo(rendition.playlist, m.FSConfig.FFprobePath)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		rendition.width, rendition.height = stream.Width, stream.Height
+		rendition.codec = renditionConfig.Codec
+		rendition.codecs = codecString(renditionConfig.Codec, stream)
+		if options.Audio != nil {
+			rendition.codecs += "," + aacCodecString
+		}
+
+		renditions = append(renditions, rendition)
+		filenames = append(filenames, rendition.files()...)
+	}
+	if len(renditions) == 0 {
+		return
+	}
+
+	// Every cmaf configuration has the same audio settings
+	var audio *hlsRendition
+	if audioConfig := l.renditions[0].Audio; hasAudio && l.separateAudio && audioConfig.Codec != AudioNone {
+		options := SegmentOptions{
+			PlaylistPath:    l.audioPath(),
+			SegmentType:     l.segmentType,
+			SegmentDuration: l.segmentDuration,
+			Audio:           audioConfig,
+		}
+		if err := m.MediaProcessor.Video.Segment(m, nil, options); err != nil {
+			return filenames, multierror.Append(errs, err)
+		}
+		if audio, err = readHLSRendition(options.PlaylistPath); err != nil {
+			return filenames, multierror.Append(errs, err)
+		}
+		audio.codecs = aacCodecString
+		filenames = append(filenames, audio.files()...)
+	}
+
+	// Players start with the first rendition listed, so list renditions from the lowest bitrate
+	sort.SliceStable(renditions, func(i, j int) bool { return renditions[i].bandwidth < renditions[j].bandwidth })
+
+	masterPath := filepath.Join(l.dir, "master.m3u8")
+	if err := writeHLSMasterPlaylist(masterPath, renditions, audio); err != nil {
+		return filenames, multierror.Append(errs, err)
+	}
+	filenames = append(filenames, masterPath)
+	m.addLadderVariant(masterPath, M3U8, renditions)
+
+	if l.dash {
+		dashPath := filepath.Join(l.dir, "manifest.mpd")
+		if err := writeDASHManifest(dashPath, l.segmentDuration, renditions, audio); err != nil {
+			return filenames, multierror.Append(errs, err)
+		}
+		filenames = append(filenames, dashPath)
+		m.addLadderVariant(dashPath, MPD, renditions)
+	}
+
+	return
+}
+
+// addLadderVariant records a ladder's manifest as a variant, at the size of its largest rendition
+func (m *MediaJob) addLadderVariant(manifestPath string, format FileOutputType, renditions []*hlsRendition) {
+	variant := &Variant{Path: manifestPath, Format: format}
+	for _, r := range renditions {
+		if r.width > variant.Width {
+			variant.Width, variant.Height = r.width, r.height
+		}
+	}
+	m.Variants = append(m.Variants, variant)
+}
+
+// readHLSRendition reads an HLS media playlist written by ffmpeg, listing its files and measuring
+// its bitrate from the size of its segments
+func readHLSRendition(playlistPath string) (*hlsRendition, error) {
+	data, err := ioutil.ReadFile(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rendition := &hlsRendition{playlist: playlistPath}
+	dir := filepath.Dir(playlistPath)
+
+	var segmentDuration, totalBits, totalDuration float64
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			// fMP4 init segment, e.g. #EXT-X-MAP:URI="720-h264-init.mp4"
+			uri := line[strings.Index(line, "URI=")+len("URI="):]
+			uri = strings.Trim(strings.SplitN(uri, ",", 2)[0], `"`)
+			rendition.init = filepath.Join(dir, uri)
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// Duration of the next segment, e.g. #EXTINF:6.006000,
+			duration := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0]
+			if segmentDuration, err = strconv.ParseFloat(duration, 64); err != nil {
+				return nil, fmt.Errorf("invalid segment duration in %s: %s", playlistPath, line)
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		default:
+			segmentPath := filepath.Join(dir, line)
+			info, err := os.Stat(segmentPath)
+			if err != nil {
+				return nil, err
+			}
+			rendition.segments = append(rendition.segments, segmentPath)
+			rendition.durations = append(rendition.durations, segmentDuration)
+
+			bits := float64(info.Size() * 8)
+			totalBits += bits
+			totalDuration += segmentDuration
+			if segmentDuration > 0 {
+				rendition.bandwidth = maxInt(rendition.bandwidth, int(math.Ceil(bits/segmentDuration)))
+			}
+		}
+	}
+
+	if len(rendition.segments) == 0 {
+		return nil, fmt.Errorf("no segments found in %s", playlistPath)
+	}
+	if totalDuration > 0 {
+		rendition.averageBandwidth = int(math.Ceil(totalBits / totalDuration))
+	}
+	return rendition, nil
+}
+
+// writeHLSMasterPlaylist writes a master playlist listing HLS renditions, and their separate
+// audio track if there is one
+func writeHLSMasterPlaylist(masterPath string, renditions []*hlsRendition, audio *hlsRendition) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if audio != nil {
+		fmt.Fprintf(
+			&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"Audio\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s\"\n",
+			filepath.Base(audio.playlist),
+		)
+	}
+
+	for _, r := range renditions {
+		bandwidth, averageBandwidth, codecs, audioGroup := r.bandwidth, r.averageBandwidth, r.codecs, ""
+		if audio != nil {
+			// Bandwidths include the audio track, which is played alongside every rendition
+			bandwidth += audio.bandwidth
+			averageBandwidth += audio.averageBandwidth
+			codecs += "," + audio.codecs
+			audioGroup = `,AUDIO="audio"`
+		}
+		fmt.Fprintf(
+			&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"%s\n%s\n",
+			bandwidth, averageBandwidth, r.width, r.height, codecs, audioGroup, filepath.Base(r.playlist),
+		)
+	}
+
+	return ioutil.WriteFile(masterPath, []byte(b.String()), 0644)
+}
+
+// aacCodecString is the RFC 6381 codec string of AAC-LC audio
+const aacCodecString = "mp4a.40.2"
+
+// codecString returns the RFC 6381 codec string of an encoded video stream, as used by HLS and
+// MIME types. Falls back to a generic codec string if the stream's profile isn't recognised.
+func codecString(codec VideoCodec, stream *pixelio.Probe) string {
+	if stream.VideoLevel <= 0 {
+		return videoCodecParameter[codec]
+	}
+
+	switch codec {
+	case H264:
+		// Profile and constraint flags, then level, in hex
+		profiles := map[string]string{"Constrained Baseline": "42E0", "Baseline": "4200", "Main": "4D40", "High": "6400"}
+		if profile, ok := profiles[stream.VideoProfile]; ok {
+			return fmt.Sprintf("avc1.%s%02X", profile, stream.VideoLevel)
+		}
+	case H265:
+		// Profile space and number, compatibility flags, tier and level, then constraint flags
+		profiles := map[string]string{"Main": "1.6", "Main 10": "2.4"}
+		if profile, ok := profiles[stream.VideoProfile]; ok {
+			return fmt.Sprintf("hvc1.%s.L%d.B0", profile, stream.VideoLevel)
+		}
+	case VP9:
+		// Profile, level, then bit depth
+		if stream.VideoProfile == "Profile 0" {
+			return fmt.Sprintf("vp09.00.%02d.08", stream.VideoLevel)
+		}
+	case AV1:
+		// Profile, level and tier, then bit depth
+		if stream.VideoProfile == "Main" {
+			return fmt.Sprintf("av01.0.%02dM.08", stream.VideoLevel)
+		}
+	}
+
+	return videoCodecParameter[codec]
+}
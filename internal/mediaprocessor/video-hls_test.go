@@ -0,0 +1,158 @@
+package mediaprocessor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+func TestReadHLSRendition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Segments of 1000 and 3000 bytes
+	for name, size := range map[string]int{"720-h264-000.m4s": 1000, "720-h264-001.m4s": 3000, "720-h264-000.ts": 1000} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		playlist string
+		want     *hlsRendition
+		wantErr  bool
+	}{
+		{
+			"fmp4 segments with an init segment",
+			"#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:4\n#EXT-X-MAP:URI=\"720-h264-init.mp4\"\n" +
+				"#EXTINF:2.000000,\n720-h264-000.m4s\n#EXTINF:4.000000,\n720-h264-001.m4s\n#EXT-X-ENDLIST\n",
+			&hlsRendition{
+				init:             filepath.Join(dir, "720-h264-init.mp4"),
+				segments:         []string{filepath.Join(dir, "720-h264-000.m4s"), filepath.Join(dir, "720-h264-001.m4s")},
+				durations:        []float64{2, 4},
+				bandwidth:        6000, // 3000 bytes over 4s
+				averageBandwidth: 5334, // 4000 bytes over 6s
+			},
+			false,
+		},
+		{
+			"ts segments",
+			"#EXTM3U\n#EXTINF:2.000000,\n720-h264-000.ts\n#EXT-X-ENDLIST\n",
+			&hlsRendition{
+				segments:         []string{filepath.Join(dir, "720-h264-000.ts")},
+				durations:        []float64{2},
+				bandwidth:        4000,
+				averageBandwidth: 4000,
+			},
+			false,
+		},
+		{"no segments", "#EXTM3U\n#EXT-X-ENDLIST\n", nil, true},
+		{"missing segment", "#EXTM3U\n#EXTINF:2.000000,\n720-h264-002.m4s\n", nil, true},
+		{"invalid duration", "#EXTM3U\n#EXTINF:two,\n720-h264-000.m4s\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "720-h264.m3u8")
+			if err := ioutil.WriteFile(path, []byte(tt.playlist), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil {
+				tt.want.playlist = path
+			}
+
+			got, err := readHLSRendition(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readHLSRendition() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readHLSRendition() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteHLSMasterPlaylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	renditions := []*hlsRendition{
+		{playlist: filepath.Join(dir, "640-h264.m3u8"), bandwidth: 1000000, averageBandwidth: 800000, width: 640, height: 360, codecs: "avc1.64001E"},
+		{playlist: filepath.Join(dir, "1280-h264.m3u8"), bandwidth: 3000000, averageBandwidth: 2500000, width: 1280, height: 720, codecs: "avc1.64001F"},
+	}
+	audio := &hlsRendition{playlist: filepath.Join(dir, "audio.m3u8"), bandwidth: 130000, averageBandwidth: 128000, codecs: aacCodecString}
+
+	tests := []struct {
+		name  string
+		audio *hlsRendition
+		want  string
+	}{
+		{
+			"audio muxed into renditions", nil,
+			"#EXTM3U\n#EXT-X-INDEPENDENT-SEGMENTS\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=1000000,AVERAGE-BANDWIDTH=800000,RESOLUTION=640x360,CODECS=\"avc1.64001E\"\n640-h264.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=3000000,AVERAGE-BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS=\"avc1.64001F\"\n1280-h264.m3u8\n",
+		},
+		{
+			"separate audio track", audio,
+			"#EXTM3U\n#EXT-X-INDEPENDENT-SEGMENTS\n" +
+				"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"Audio\",DEFAULT=YES,AUTOSELECT=YES,URI=\"audio.m3u8\"\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=1130000,AVERAGE-BANDWIDTH=928000,RESOLUTION=640x360,CODECS=\"avc1.64001E,mp4a.40.2\",AUDIO=\"audio\"\n640-h264.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=3130000,AVERAGE-BANDWIDTH=2628000,RESOLUTION=1280x720,CODECS=\"avc1.64001F,mp4a.40.2\",AUDIO=\"audio\"\n1280-h264.m3u8\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "master.m3u8")
+			if err := writeHLSMasterPlaylist(path, renditions, tt.audio); err != nil {
+				t.Fatalf("writeHLSMasterPlaylist() error = %v", err)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("writeHLSMasterPlaylist() wrote\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodecString(t *testing.T) {
+	tests := []struct {
+		name    string
+		codec   VideoCodec
+		profile string
+		level   int
+		want    string
+	}{
+		{"h264 high", H264, "High", 31, "avc1.64001F"},
+		{"h264 constrained baseline", H264, "Constrained Baseline", 30, "avc1.42E01E"},
+		{"h265 main 10", H265, "Main 10", 120, "hvc1.2.4.L120.B0"},
+		{"vp9 profile 0", VP9, "Profile 0", 31, "vp09.00.31.08"},
+		{"av1 main", AV1, "Main", 8, "av01.0.08M.08"},
+		{"unrecognised profile", H264, "High 4:4:4 Predictive", 40, "avc1.640028"},
+		{"no level", H265, "Main", 0, "hvc1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &pixelio.Probe{VideoProfile: tt.profile, VideoLevel: tt.level}
+			if got := codecString(tt.codec, stream); got != tt.want {
+				t.Errorf("codecString() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
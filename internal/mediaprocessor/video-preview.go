@@ -0,0 +1,105 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// Cutting animated previews from videos. The clips are chosen here, and joined with a filter, so
+// that a VideoProcessor only needs to read each clip from the source and encode the result.
+
+// PreviewClip is a section of a video included in an animated preview, in seconds
+type PreviewClip struct {
+	Start    float64
+	Duration float64
+}
+
+// previewClips returns the clips of a video included in its animated preview. A single clip
+// starts at Start. Several clips are spread evenly from Start to the end of the video, each in
+// the middle of an equal part of it. Videos too short to hold the preview are used whole.
+func (p *PreviewConfiguration) previewClips(duration float64) []PreviewClip {
+	start := math.Min(p.Start, math.Max(0, duration-p.Duration))
+	if p.Segments <= 1 || duration-start <= p.Duration {
+		return []PreviewClip{{Start: start, Duration: math.Min(p.Duration, duration-start)}}
+	}
+
+	clipDuration := p.Duration / float64(p.Segments)
+	clips := make([]PreviewClip, p.Segments)
+	for i, middle := range evenlySpacedTimes(duration-start, p.Segments) {
+		clips[i] = PreviewClip{Start: start + middle - clipDuration/2, Duration: clipDuration}
+	}
+	return clips
+}
+
+// previewFilter returns the ffmpeg filtergraph which joins an animated preview's clips, labelled
+// [preview]. Each clip is a separate input, already seeked to its start, which is trimmed to the
+// clip's duration and dropped to the preview's frame rate, then the clips are concatenated.
+// GIFs are given a palette generated from the clips' frames, as they're limited to 256 colours.
+func previewFilter(c *VideoConfiguration, clips []PreviewClip) string {
+	var filters []string
+	var joined string
+	for n, clip := range clips {
+		filters = append(filters, fmt.Sprintf(
+			"[%d:v]trim=duration=%.3f,setpts=PTS-STARTPTS,fps=%g,scale=%d:-2[clip%d]",
+			n, clip.Duration, c.Preview.FrameRate, c.MaxWidth, n,
+		))
+		joined += fmt.Sprintf("[clip%d]", n)
+	}
+
+	filter := strings.Join(filters, ";") + fmt.Sprintf(";%sconcat=n=%d:v=1:a=0", joined, len(clips))
+	switch c.FileType {
+	case GIF:
+		filter += ",split[frames][sample];[sample]palettegen=stats_mode=diff[palette];[frames][palette]paletteuse=dither=bayer:bayer_scale=5"
+	case AVIF:
+		filter += ",format=yuv420p"
+	}
+	return filter + "[preview]"
+}
+
+// previewInputArgs returns the ffmpeg input arguments which read each of an animated preview's
+// clips from a video as a separate input, seeking to its start, so that only the clips are decoded
+func previewInputArgs(inputPath string, clips []PreviewClip) (args []string) {
+	for _, clip := range clips {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", clip.Start), "-t", fmt.Sprintf("%.3f", clip.Duration), "-i", inputPath)
+	}
+	return
+}
+
+// previewLength returns the total length of an animated preview's clips, in seconds
+func previewLength(clips []PreviewClip) (length float64) {
+	for _, clip := range clips {
+		length += clip.Duration
+	}
+	return
+}
+
+// processPreview outputs an animated preview for an image-typed VideoConfiguration
+func (m *MediaJob) processPreview(videoConfig *VideoConfiguration) ([]videoOutput, error) {
+	source, err := m.Probe()
+	if err != nil {
+		return nil, err
+	}
+
+	clips := videoConfig.Preview.previewClips(source.Duration)
+	fmt.Printf("Preview of '%s' from %d clips, %.2fs long\n", m.InputFile.Filename, len(clips), previewLength(clips))
+	if err := m.MediaProcessor.Video.Preview(m, videoConfig, clips); err != nil {
+		return nil, err
+	}
+
+	// Animated WebP can't be probed by every ffmpeg build, so the size is calculated instead
+	width, height := previewSize(source, videoConfig.MaxWidth)
+	return []videoOutput{{Path: m.OutputPath(videoConfig), Sized: true, Width: width, Height: height}}, nil
+}
+
+// previewSize calculates the size of a video scaled to a width, with its height rounded to an
+// even number, as by ffmpeg's scale=width:-2
+func previewSize(source *pixelio.Probe, width int) (int, int) {
+	if source.Width == 0 {
+		return 0, 0
+	}
+	height := int(math.Round(float64(width)*float64(source.Height)/float64(source.Width)/2)) * 2
+	return width, height
+}
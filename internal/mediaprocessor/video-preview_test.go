@@ -0,0 +1,80 @@
+package mediaprocessor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPreviewClips(t *testing.T) {
+	tests := []struct {
+		name     string
+		preview  PreviewConfiguration
+		duration float64
+		want     []PreviewClip
+	}{
+		{"single clip", PreviewConfiguration{Start: 2, Duration: 3, Segments: 1}, 60, []PreviewClip{{2, 3}}},
+		{"single clip moved back from the end", PreviewConfiguration{Start: 58, Duration: 3, Segments: 1}, 60, []PreviewClip{{57, 3}}},
+		{"short video used whole", PreviewConfiguration{Start: 0, Duration: 3, Segments: 3}, 2, []PreviewClip{{0, 2}}},
+		{"segments spread evenly", PreviewConfiguration{Start: 0, Duration: 3, Segments: 3}, 60, []PreviewClip{{9.5, 1}, {29.5, 1}, {49.5, 1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.preview.previewClips(tt.duration); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("previewClips() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviewFilter(t *testing.T) {
+	clips := []PreviewClip{{Start: 9.5, Duration: 1}, {Start: 29.5, Duration: 1.25}}
+
+	tests := []struct {
+		name     string
+		fileType FileOutputType
+		clips    []PreviewClip
+		want     string
+	}{
+		{
+			name:     "webp",
+			fileType: WebP,
+			clips:    clips[:1],
+			want:     "[0:v]trim=duration=1.000,setpts=PTS-STARTPTS,fps=10,scale=320:-2[clip0];[clip0]concat=n=1:v=1:a=0[preview]",
+		},
+		{
+			name:     "avif clips",
+			fileType: AVIF,
+			clips:    clips,
+			want: "[0:v]trim=duration=1.000,setpts=PTS-STARTPTS,fps=10,scale=320:-2[clip0];" +
+				"[1:v]trim=duration=1.250,setpts=PTS-STARTPTS,fps=10,scale=320:-2[clip1];" +
+				"[clip0][clip1]concat=n=2:v=1:a=0,format=yuv420p[preview]",
+		},
+		{
+			name:     "gif palette from the clips",
+			fileType: GIF,
+			clips:    clips,
+			want: "[0:v]trim=duration=1.000,setpts=PTS-STARTPTS,fps=10,scale=320:-2[clip0];" +
+				"[1:v]trim=duration=1.250,setpts=PTS-STARTPTS,fps=10,scale=320:-2[clip1];" +
+				"[clip0][clip1]concat=n=2:v=1:a=0," +
+				"split[frames][sample];[sample]palettegen=stats_mode=diff[palette];[frames][palette]paletteuse=dither=bayer:bayer_scale=5[preview]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &VideoConfiguration{MaxWidth: 320, FileType: tt.fileType, Preview: &PreviewConfiguration{FrameRate: 10}}
+			if got := previewFilter(c, tt.clips); got != tt.want {
+				t.Errorf("previewFilter() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviewInputArgs(t *testing.T) {
+	clips := []PreviewClip{{Start: 9.5, Duration: 1}, {Start: 29.5, Duration: 1.25}}
+	want := []string{"-ss", "9.500", "-t", "1.000", "-i", "clip.mp4", "-ss", "29.500", "-t", "1.250", "-i", "clip.mp4"}
+	if got := previewInputArgs("clip.mp4", clips); !reflect.DeepEqual(got, want) {
+		t.Errorf("previewInputArgs() = %v, want %v", got, want)
+	}
+}
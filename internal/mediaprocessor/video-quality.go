@@ -0,0 +1,127 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// Target-quality searches for videos. Sample segments of the video are encoded at each CRF tried,
+// and scored against the source with ffmpeg's libvmaf filter. The samples are encoded as chunks,
+// so a VideoProcessor which can encode chunks needs nothing more.
+
+// targetVideoQuality searches for the highest CRF at which a video's sample segments meet its
+// VideoConfiguration's VMAF target, on average. Returns a copy of the configuration which encodes
+// at the chosen CRF, recording its score.
+func (m *MediaJob) targetVideoQuality(c *VideoConfiguration) (*VideoConfiguration, error) {
+	source, err := m.Probe()
+	if err != nil {
+		return nil, err
+	}
+	samples, err := c.TargetQuality.qualitySamples(source)
+	if err != nil {
+		return nil, err
+	}
+
+	// Samples are written beside the output, as chunks are
+	outputPath := m.OutputPath(c)
+	sampleDir, err := ioutil.TempDir(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+"-samples-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(sampleDir)
+
+	fmt.Printf("Searching for the CRF of '%s' at width %d which meets vmaf %g\n", m.InputFile.Filename, c.MaxWidth, c.TargetQuality.Target)
+	t := c.TargetQuality
+	measured, crf, err := t.searchQuality(t.Max, t.Min, func(crf int) (float64, error) {
+		candidate := *c
+		candidate.Quality = crf
+
+		var total float64
+		for _, sample := range samples {
+			sample.Config = &candidate
+			sample.OutputPath = filepath.Join(sampleDir, fmt.Sprintf("sample-%d-crf%d.mkv", sample.Index, crf))
+			if err := m.MediaProcessor.Video.TranscodeChunk(m, sample); err != nil {
+				return 0, err
+			}
+			score, err := m.vmafScore(sample, c.MaxWidth)
+			if err != nil {
+				return 0, err
+			}
+			total += score
+			os.Remove(sample.OutputPath)
+		}
+		return total / float64(len(samples)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	chosen := *c
+	chosen.Quality = crf
+	chosen.measured = measured
+	fmt.Printf("Chose CRF %d for '%s' at width %d, scoring vmaf %.2f\n", crf, m.InputFile.Filename, c.MaxWidth, measured.Value)
+	return &chosen, nil
+}
+
+// qualitySamples plans the segments of a video scored by a target-quality search, each in the
+// middle of an equal part of the video. Videos too short to hold every sample are scored whole.
+func (t *TargetQualityConfiguration) qualitySamples(source *pixelio.Probe) ([]*VideoChunk, error) {
+	if source.Duration <= float64(t.Samples)*t.SampleDuration {
+		return []*VideoChunk{{}}, nil
+	}
+	if source.FrameRate <= 0 {
+		return nil, fmt.Errorf("unable to sample a video without its frame rate")
+	}
+
+	frames := int(math.Round(t.SampleDuration * source.FrameRate))
+	samples := make([]*VideoChunk, t.Samples)
+	for i, middle := range evenlySpacedTimes(source.Duration, t.Samples) {
+		samples[i] = &VideoChunk{Index: i, Start: middle - t.SampleDuration/2, Frames: frames}
+	}
+	return samples, nil
+}
+
+// vmafScore scores an encoded sample with ffmpeg's libvmaf filter, against the same frames of the
+// source scaled to the sample's width. Both are converted to 8-bit 4:2:0, as libvmaf needs them
+// in the same pixel format.
+func (m *MediaJob) vmafScore(sample *VideoChunk, width int) (float64, error) {
+	reference := fmt.Sprintf("scale=%d:-2", width)
+	if sample.Frames > 0 {
+		reference = fmt.Sprintf("trim=end_frame=%d,%s", sample.Frames, reference)
+	}
+	filter := fmt.Sprintf(
+		"[0:v]setpts=PTS-STARTPTS,format=yuv420p[distorted];[1:v]%s,setpts=PTS-STARTPTS,format=yuv420p[reference];[distorted][reference]libvmaf",
+		reference,
+	)
+
+	// The source is seeked exactly as it was for the sample's encode, so that the frames line up
+	output, err := exec.Command(
+		m.FSConfig.FFmpegPath, "-hide_banner", "-nostats", "-i", sample.OutputPath,
+		"-seek_timestamp", "1", "-ss", fmt.Sprintf("%.6f", sample.Start), "-i", m.InputFile.Path,
+		"-lavfi", filter, "-f", "null", "-",
+	).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("vmaf scoring failed for %s: %s: %s", m.InputFile.Path, err, strings.TrimSpace(string(output)))
+	}
+
+	// The mean score is logged once every frame has been scored, e.g.
+	// [Parsed_libvmaf_4 @ 0x55d0c8c0a2c0] VMAF score: 94.712390
+	const prefix = "VMAF score: "
+	index := strings.LastIndex(string(output), prefix)
+	if index < 0 {
+		return 0, fmt.Errorf("libvmaf output no score for %s", m.InputFile.Path)
+	}
+	fields := strings.Fields(string(output)[index+len(prefix):])
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("libvmaf output no score for %s", m.InputFile.Path)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
@@ -0,0 +1,129 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// Scrubbing sprite sheets, and the WebVTT track which maps each part of a video to its tile.
+// The layout is planned here, so that a VideoProcessor only needs to tile the frames.
+// e.g. clip-sprite.vtt:
+//
+//	WEBVTT
+//
+//	00:00:00.000 --> 00:00:05.000
+//	clip-sprite-1.jpg#xywh=0,0,160,90
+
+// SpriteGrid describes the layout of a video's sprite sheets
+type SpriteGrid struct {
+	Interval      float64 // Seconds between frames
+	Columns, Rows int     // Tiles per row, and rows per sheet
+	Width, Height int     // Size of each tile
+	Tiles         int     // Number of tiles across every sheet
+	Sheets        int
+}
+
+// spriteGrid plans the sprite sheets for a video. Sheets are only as large as their tiles need, so
+// a short video gets a single sheet with fewer rows, or columns.
+func (s *SpriteConfiguration) spriteGrid(source *pixelio.Probe, width int) SpriteGrid {
+	grid := SpriteGrid{
+		Interval: s.Interval,
+		Columns:  s.Columns,
+		Rows:     s.Rows,
+		Tiles:    int(math.Max(1, math.Ceil(source.Duration/s.Interval))),
+	}
+	grid.Width, grid.Height = previewSize(source, width)
+
+	if grid.Tiles < grid.Columns {
+		grid.Columns = grid.Tiles
+	}
+	if rows := int(math.Ceil(float64(grid.Tiles) / float64(grid.Columns))); rows < grid.Rows {
+		grid.Rows = rows
+	}
+	grid.Sheets = int(math.Ceil(float64(grid.Tiles) / float64(grid.Columns*grid.Rows)))
+	return grid
+}
+
+// numberedOutputPath inserts a number before an output path's extension, e.g. sunset-1.jpg
+func numberedOutputPath(path string, number string) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), number, ext)
+}
+
+// processSprite outputs the sprite sheets for an image-typed VideoConfiguration, numbered from 1,
+// e.g. output/subdir1/clip-sprite-1.jpg, and their WebVTT track, e.g. output/subdir1/clip-sprite.vtt
+func (m *MediaJob) processSprite(videoConfig *VideoConfiguration) ([]videoOutput, error) {
+	source, err := m.Probe()
+	if err != nil {
+		return nil, err
+	}
+	if source.Width == 0 {
+		return nil, fmt.Errorf("unable to plan sprite sheets for %s without its dimensions", m.InputFile.Path)
+	}
+
+	grid := videoConfig.Sprite.spriteGrid(source, videoConfig.MaxWidth)
+	outputPath := m.OutputPath(videoConfig)
+	fmt.Printf("Sprite of '%s' with %d tiles on %d sheets\n", m.InputFile.Filename, grid.Tiles, grid.Sheets)
+	if err := m.MediaProcessor.Video.Sprite(m, videoConfig, grid, numberedOutputPath(outputPath, "%d")); err != nil {
+		return nil, err
+	}
+
+	var outputs []videoOutput
+	var sheets []string
+	for sheet := 1; sheet <= grid.Sheets; sheet++ {
+		sheetPath := numberedOutputPath(outputPath, strconv.Itoa(sheet))
+		if _, err := os.Stat(sheetPath); err != nil {
+			return outputs, fmt.Errorf("sprite sheet %s wasn't output: %s", sheetPath, err)
+		}
+		sheets = append(sheets, sheetPath)
+		outputs = append(outputs, videoOutput{
+			Path:   sheetPath,
+			Sized:  true,
+			Width:  grid.Columns * grid.Width,
+			Height: grid.Rows * grid.Height,
+		})
+	}
+
+	vttPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".vtt"
+	if err := ioutil.WriteFile(vttPath, []byte(spriteVTT(grid, sheets, source.Duration)), 0644); err != nil {
+		return outputs, err
+	}
+	return append(outputs, videoOutput{Path: vttPath, Sized: true, Format: VTT}), nil
+}
+
+// spriteVTT writes a WebVTT track with a cue for each tile, pointing to its region of its sheet
+// with a media fragment. Sheets are referenced relative to the track, which is beside them.
+func spriteVTT(grid SpriteGrid, sheets []string, duration float64) string {
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+
+	perSheet := grid.Columns * grid.Rows
+	for tile := 0; tile < grid.Tiles; tile++ {
+		start := float64(tile) * grid.Interval
+		end := math.Min(start+grid.Interval, math.Max(duration, start+0.001))
+		position := tile % perSheet
+		fmt.Fprintf(
+			&vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), filepath.Base(sheets[tile/perSheet]),
+			position%grid.Columns*grid.Width, position/grid.Columns*grid.Height, grid.Width, grid.Height,
+		)
+	}
+	return vtt.String()
+}
+
+// vttTimestamp formats a time in seconds as a WebVTT timestamp, e.g. 00:01:05.250
+func vttTimestamp(seconds float64) string {
+	t := time.Duration(math.Round(seconds*1000)) * time.Millisecond
+	return fmt.Sprintf(
+		"%02d:%02d:%02d.%03d",
+		int(t.Hours()), int(t.Minutes())%60, int(t.Seconds())%60, t.Milliseconds()%1000,
+	)
+}
@@ -0,0 +1,108 @@
+package mediaprocessor
+
+import (
+	"testing"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+func TestSpriteGrid(t *testing.T) {
+	sprite := &SpriteConfiguration{Interval: 5, Columns: 10, Rows: 10}
+
+	tests := []struct {
+		name   string
+		source pixelio.Probe
+		width  int
+		want   SpriteGrid
+	}{
+		{"several sheets", pixelio.Probe{Width: 1920, Height: 1080, Duration: 600}, 160, SpriteGrid{5, 10, 10, 160, 90, 120, 2}},
+		{"partial last sheet", pixelio.Probe{Width: 1920, Height: 1080, Duration: 501}, 160, SpriteGrid{5, 10, 10, 160, 90, 101, 2}},
+		{"fewer rows for a short video", pixelio.Probe{Width: 1920, Height: 1080, Duration: 100}, 160, SpriteGrid{5, 10, 2, 160, 90, 20, 1}},
+		{"fewer columns for a very short video", pixelio.Probe{Width: 1920, Height: 1080, Duration: 12}, 160, SpriteGrid{5, 3, 1, 160, 90, 3, 1}},
+		{"at least one tile", pixelio.Probe{Width: 1920, Height: 1080, Duration: 0}, 160, SpriteGrid{5, 1, 1, 160, 90, 1, 1}},
+		{"tile height rounded to even", pixelio.Probe{Width: 1920, Height: 1080, Duration: 600}, 100, SpriteGrid{5, 10, 10, 100, 56, 120, 2}},
+		{"portrait video", pixelio.Probe{Width: 1080, Height: 1920, Duration: 600}, 90, SpriteGrid{5, 10, 10, 90, 160, 120, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sprite.spriteGrid(&tt.source, tt.width); got != tt.want {
+				t.Errorf("spriteGrid() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpriteVTT(t *testing.T) {
+	sheets := []string{"output/clip-sprite-1.jpg", "output/clip-sprite-2.jpg"}
+
+	tests := []struct {
+		name     string
+		grid     SpriteGrid
+		duration float64
+		want     string
+	}{
+		{
+			name:     "tiles continue on the next sheet",
+			grid:     SpriteGrid{Interval: 5, Columns: 2, Rows: 1, Width: 160, Height: 90, Tiles: 3, Sheets: 2},
+			duration: 12,
+			want: "WEBVTT\n" +
+				"\n00:00:00.000 --> 00:00:05.000\nclip-sprite-1.jpg#xywh=0,0,160,90\n" +
+				"\n00:00:05.000 --> 00:00:10.000\nclip-sprite-1.jpg#xywh=160,0,160,90\n" +
+				"\n00:00:10.000 --> 00:00:12.000\nclip-sprite-2.jpg#xywh=0,0,160,90\n",
+		},
+		{
+			name:     "tiles continue on the next row",
+			grid:     SpriteGrid{Interval: 5, Columns: 2, Rows: 2, Width: 160, Height: 90, Tiles: 3, Sheets: 1},
+			duration: 15,
+			want: "WEBVTT\n" +
+				"\n00:00:00.000 --> 00:00:05.000\nclip-sprite-1.jpg#xywh=0,0,160,90\n" +
+				"\n00:00:05.000 --> 00:00:10.000\nclip-sprite-1.jpg#xywh=160,0,160,90\n" +
+				"\n00:00:10.000 --> 00:00:15.000\nclip-sprite-1.jpg#xywh=0,90,160,90\n",
+		},
+		{
+			name:     "cue ends after it starts for a video without a duration",
+			grid:     SpriteGrid{Interval: 5, Columns: 1, Rows: 1, Width: 160, Height: 90, Tiles: 1, Sheets: 1},
+			duration: 0,
+			want:     "WEBVTT\n\n00:00:00.000 --> 00:00:00.001\nclip-sprite-1.jpg#xywh=0,0,160,90\n",
+		},
+		{
+			name:     "timestamps over an hour",
+			grid:     SpriteGrid{Interval: 3600, Columns: 2, Rows: 1, Width: 160, Height: 90, Tiles: 2, Sheets: 1},
+			duration: 5400.25,
+			want: "WEBVTT\n" +
+				"\n00:00:00.000 --> 01:00:00.000\nclip-sprite-1.jpg#xywh=0,0,160,90\n" +
+				"\n01:00:00.000 --> 01:30:00.250\nclip-sprite-1.jpg#xywh=160,0,160,90\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := spriteVTT(tt.grid, sheets, tt.duration); got != tt.want {
+				t.Errorf("spriteVTT() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVTTTimestamp(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "00:00:00.000"},
+		{65.25, "00:01:05.250"},
+		{59.9996, "00:01:00.000"},
+		{3725.5, "01:02:05.500"},
+		{36000, "10:00:00.000"},
+		{360000.001, "100:00:00.001"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := vttTimestamp(tt.seconds); got != tt.want {
+				t.Errorf("vttTimestamp(%g) = %s, want %s", tt.seconds, got, tt.want)
+			}
+		})
+	}
+}
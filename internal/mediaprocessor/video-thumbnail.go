@@ -0,0 +1,209 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/willdollman/pixel-slicer/internal/pixelio"
+)
+
+// Choosing which frames of a video are output as thumbnails. Frames are chosen here, so that
+// every VideoProcessor only needs to extract a frame at a given time.
+
+// sceneChangeThreshold is the ffmpeg scene score, from 0 to 1, above which a frame is treated as
+// the start of a new shot
+const sceneChangeThreshold = 0.3
+
+// sharpnessCandidates is the number of evenly spaced frames compared by the sharpness mode
+const sharpnessCandidates = 10
+
+// videoOutput is an output file produced from a video
+type videoOutput struct {
+	Path          string
+	Format        FileOutputType // Set if the output's format differs from its configuration's
+	Sized         bool           // Set if Width and Height are known without probing the output
+	Width, Height int
+	Timestamp     *float64 // Position of a thumbnail's frame in the source, in seconds
+}
+
+// processThumbnails outputs the thumbnails for an image-typed VideoConfiguration, at the frames
+// chosen by its ThumbnailConfiguration. The count mode outputs numbered thumbnails,
+// e.g. output/subdir1/sunset-1.jpg. Returns the thumbnails which were output.
+func (m *MediaJob) processThumbnails(videoConfig *VideoConfiguration) (outputs []videoOutput, err error) {
+	thumbnail := videoConfig.Thumbnail
+	if thumbnail == nil {
+		thumbnail = &ThumbnailConfiguration{Mode: ThumbnailTime}
+	}
+
+	times, err := m.thumbnailTimes(thumbnail)
+	if err != nil {
+		return nil, err
+	}
+
+	outputPath := m.OutputPath(videoConfig)
+	for i := range times {
+		timestamp := times[i]
+		path := outputPath
+		if thumbnail.Mode == ThumbnailCount {
+			path = numberedOutputPath(outputPath, strconv.Itoa(i+1))
+		}
+
+		fmt.Printf("Thumbnail of '%s' at %.2fs (%s)\n", m.InputFile.Filename, timestamp, thumbnail.Mode)
+		if err = m.MediaProcessor.Video.Thumbnail(m, videoConfig, timestamp, path); err != nil {
+			return outputs, err
+		}
+		outputs = append(outputs, videoOutput{Path: path, Timestamp: &timestamp})
+	}
+	return outputs, nil
+}
+
+// thumbnailTimes chooses the timestamps of the frames output as thumbnails, in seconds
+func (m *MediaJob) thumbnailTimes(t *ThumbnailConfiguration) ([]float64, error) {
+	source, err := m.Probe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Seeking to the very end of a video produces no frame, so stop a frame short of it
+	last := source.Duration
+	if source.FrameRate > 0 {
+		last -= 1 / source.FrameRate
+	}
+	last = math.Max(0, last)
+
+	switch t.Mode {
+	case ThumbnailTime:
+		return []float64{math.Min(t.Time, last)}, nil
+	case ThumbnailPercent:
+		return []float64{math.Min(source.Duration*t.Percent/100, last)}, nil
+	case ThumbnailCount:
+		return evenlySpacedTimes(source.Duration, t.Count), nil
+	case ThumbnailScene:
+		timestamp, err := m.longestShotMiddle(source)
+		if err != nil {
+			return nil, err
+		}
+		return []float64{math.Min(timestamp, last)}, nil
+	case ThumbnailSharpness:
+		timestamp, err := m.sharpestFrame(evenlySpacedTimes(source.Duration, sharpnessCandidates))
+		if err != nil {
+			return nil, err
+		}
+		return []float64{timestamp}, nil
+	}
+	return nil, fmt.Errorf("unknown thumbnail mode '%s'", t.Mode)
+}
+
+// evenlySpacedTimes returns the timestamps of count frames spread evenly through a video, each in
+// the middle of an equal part of it, so that the first and last frames are avoided
+func evenlySpacedTimes(duration float64, count int) []float64 {
+	times := make([]float64, count)
+	for i := range times {
+		times[i] = duration * (float64(i) + 0.5) / float64(count)
+	}
+	return times
+}
+
+// longestShotMiddle finds the video's shots using ffmpeg's scene change detection, and returns
+// the timestamp of the middle of the longest one. This avoids fades and transitions, and favours
+// the shot which is most representative of the video. A video without any scene changes is
+// treated as a single shot.
+func (m *MediaJob) longestShotMiddle(source *pixelio.Probe) (float64, error) {
+	// The video is scaled down first, as the scene score doesn't need detail and is slow to compute
+	filter := fmt.Sprintf("scale=160:-2,select='gt(scene,%g)',metadata=print:file=-", sceneChangeThreshold)
+	output, err := exec.Command(
+		m.FSConfig.FFmpegPath, "-hide_banner", "-v", "error", "-i", m.InputFile.Path, "-an", "-vf", filter, "-f", "null", "-",
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("scene detection failed for %s: %s", m.InputFile.Path, err)
+	}
+
+	// Each scene change is printed with its timestamp, e.g.
+	// frame:0    pts:95095   pts_time:3.17317
+	// lavfi.scene_score=0.412589
+	shotStarts := []float64{0}
+	for _, field := range strings.Fields(string(output)) {
+		if !strings.HasPrefix(field, "pts_time:") {
+			continue
+		}
+		if start, err := strconv.ParseFloat(strings.TrimPrefix(field, "pts_time:"), 64); err == nil {
+			shotStarts = append(shotStarts, start)
+		}
+	}
+
+	var start, length float64
+	for i, shotStart := range shotStarts {
+		shotEnd := source.Duration
+		if i+1 < len(shotStarts) {
+			shotEnd = shotStarts[i+1]
+		}
+		if shotEnd-shotStart > length {
+			start, length = shotStart, shotEnd-shotStart
+		}
+	}
+	return start + length/2, nil
+}
+
+// sharpestFrame returns whichever of the timestamps has the sharpest frame
+func (m *MediaJob) sharpestFrame(times []float64) (float64, error) {
+	var sharpestTime, sharpest float64
+	for i, timestamp := range times {
+		sharpness, err := m.frameSharpness(timestamp)
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 || sharpness > sharpest {
+			sharpestTime, sharpest = timestamp, sharpness
+		}
+	}
+	return sharpestTime, nil
+}
+
+// frameSharpness measures the sharpness of the video's frame at a timestamp, as the variance of
+// the Laplacian of its luma. Blurred, faded and black frames have little edge detail, so score low.
+func (m *MediaJob) frameSharpness(timestamp float64) (float64, error) {
+	output, err := exec.Command(
+		m.FSConfig.FFmpegPath, "-hide_banner", "-v", "error", "-ss", fmt.Sprintf("%.3f", timestamp), "-i", m.InputFile.Path,
+		"-frames:v", "1", "-vf", "scale=320:-2,format=gray", "-f", "image2pipe", "-c:v", "png", "-",
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("unable to extract frame at %.2fs from %s: %s", timestamp, m.InputFile.Path, err)
+	}
+
+	frame, err := png.Decode(bytes.NewReader(output))
+	if err != nil {
+		return 0, fmt.Errorf("unable to decode frame at %.2fs from %s: %s", timestamp, m.InputFile.Path, err)
+	}
+	return laplacianVariance(frame), nil
+}
+
+// laplacianVariance returns the variance of an image's Laplacian, a measure of its edge detail
+func laplacianVariance(img image.Image) float64 {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+
+	var sum, sumSquares, n float64
+	for y := bounds.Min.Y + 1; y < bounds.Max.Y-1; y++ {
+		for x := bounds.Min.X + 1; x < bounds.Max.X-1; x++ {
+			laplacian := 4*float64(gray.GrayAt(x, y).Y) -
+				float64(gray.GrayAt(x-1, y).Y) - float64(gray.GrayAt(x+1, y).Y) -
+				float64(gray.GrayAt(x, y-1).Y) - float64(gray.GrayAt(x, y+1).Y)
+			sum += laplacian
+			sumSquares += laplacian * laplacian
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	mean := sum / n
+	return sumSquares/n - mean*mean
+}
@@ -0,0 +1,55 @@
+package mediaprocessor
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestEvenlySpacedTimes(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration float64
+		count    int
+		want     []float64
+	}{
+		{"single frame in the middle", 10, 1, []float64{5}},
+		{"frames in the middle of each part", 60, 3, []float64{10, 30, 50}},
+		{"first and last frames avoided", 4, 4, []float64{0.5, 1.5, 2.5, 3.5}},
+		{"no frames", 10, 0, []float64{}},
+		{"zero duration", 0, 2, []float64{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := evenlySpacedTimes(tt.duration, tt.count); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("evenlySpacedTimes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLaplacianVariance(t *testing.T) {
+	checkerboard := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if (x+y)%2 == 0 {
+				checkerboard.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+			} else {
+				checkerboard.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 255})
+			}
+		}
+	}
+
+	solid := laplacianVariance(testSolid(16, 16, color.NRGBA{128, 128, 128, 255}))
+	if solid != 0 {
+		t.Errorf("laplacianVariance() of a solid image = %f, want 0", solid)
+	}
+	if tiny := laplacianVariance(testGradient(2, 2)); tiny != 0 {
+		t.Errorf("laplacianVariance() of an image without inner pixels = %f, want 0", tiny)
+	}
+	if smooth, sharp := laplacianVariance(testGradient(16, 16)), laplacianVariance(checkerboard); sharp <= smooth {
+		t.Errorf("laplacianVariance() of a checkerboard = %f, want more than a gradient's %f", sharp, smooth)
+	}
+}
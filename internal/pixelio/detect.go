@@ -0,0 +1,245 @@
+package pixelio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Media type detection from file contents, for files with missing or incorrect extensions
+
+// DetectionMode selects whether a file's extension or its contents determine its media type
+type DetectionMode string
+
+const (
+	DetectExtension DetectionMode = "extension" // Trust the file extension
+	DetectContent   DetectionMode = "content"   // Trust the file contents
+)
+
+func (d DetectionMode) Validate() error {
+	switch d {
+	case DetectExtension, DetectContent:
+		return nil
+	default:
+		return fmt.Errorf("unknown type detection mode '%s'", d)
+	}
+}
+
+// unknownMediaType is the MediaType of files which DetectMediaType couldn't identify
+const unknownMediaType = "unknown"
+
+// formatMediaType maps each supported input format to its media type
+var formatMediaType = map[string]string{
+	"jpeg": "image",
+	"png":  "image",
+	"tiff": "image",
+	"heif": "image",
+	"cr2":  "image",
+	"nef":  "image",
+	"arw":  "image",
+	"dng":  "image",
+	"mp4":  "video",
+	"mov":  "video",
+}
+
+// extensionFormat maps file extensions to format names, where they differ
+var extensionFormat = map[string]string{
+	"jpg":  "jpeg",
+	"tif":  "tiff",
+	"heic": "heif",
+}
+
+// DetectMediaTypes calls DetectMediaType for each file, reporting any errors
+func DetectMediaTypes(files []*InputFile, mode DetectionMode, ffprobePath string) {
+	for _, file := range files {
+		if err := DetectMediaType(file, mode, ffprobePath); err != nil {
+			fmt.Printf("Unable to detect media type of '%s': %s\n", file.Path, err)
+		}
+	}
+}
+
+// DetectMediaType sniffs a file's contents to fill in its MediaType and Format. If the contents
+// don't match the file's extension the mismatch is reported, and the mode decides which is used.
+// Containers which may hold only audio are checked for a video stream using ffprobePath.
+// In extension mode, a file whose contents can't be read falls back to its extension, with a
+// warning, so only content mode returns an error.
+func DetectMediaType(file *InputFile, mode DetectionMode, ffprobePath string) error {
+	extFormat := ExtensionFormat(file.Path)
+	contentFormat, err := detectContentFormat(file.Path, extFormat, ffprobePath)
+	if err != nil {
+		if mode == DetectContent {
+			return err
+		}
+		fmt.Printf("Warning: unable to detect the contents of '%s', using its extension: %s\n", file.Path, err)
+	} else {
+		reportFormatMismatch(file.Path, extFormat, contentFormat)
+	}
+
+	switch mode {
+	case DetectContent:
+		file.Format = contentFormat
+		file.MediaType = formatMediaType[contentFormat]
+	default:
+		file.Format = extFormat
+		file.MediaType = formatMediaType[extFormat]
+		// Record the real format, as long as it's still the same type of media
+		if contentFormat != "" && formatMediaType[contentFormat] == file.MediaType {
+			file.Format = contentFormat
+		}
+	}
+
+	// Record that detection has happened, so the extension isn't used as a fallback
+	if file.MediaType == "" {
+		file.MediaType = unknownMediaType
+	}
+
+	return nil
+}
+
+// reportFormatMismatch warns when a file's contents don't match its extension, including when
+// a file has a supported extension or none, but its contents aren't recognised
+func reportFormatMismatch(path string, extFormat string, contentFormat string) {
+	switch {
+	case contentFormat == "" && extFormat == "":
+		fmt.Printf("Warning: '%s' has no extension, and its contents aren't a recognised format\n", path)
+	case contentFormat == "" && formatMediaType[extFormat] != "":
+		fmt.Printf("Warning: '%s' has a .%s extension, but its contents aren't a recognised format\n", path, extFormat)
+	case contentFormat != "" && contentFormat != extFormat && extFormat == "":
+		fmt.Printf("Warning: '%s' has no extension, but its contents are %s\n", path, contentFormat)
+	case contentFormat != "" && contentFormat != extFormat:
+		fmt.Printf("Warning: '%s' has a .%s extension, but its contents are %s\n", path, extFormat, contentFormat)
+	}
+}
+
+// detectContentFormat detects a file's format from its contents, using its extension to tell
+// RAW formats apart. Returns an empty string if the format isn't recognised.
+func detectContentFormat(path string, extFormat string, ffprobePath string) (string, error) {
+	format, err := sniffFormat(path)
+	if err != nil {
+		return "", err
+	}
+
+	// RAW formats are TIFF containers, so can only be told apart by their extension
+	if format == "tiff" && isRawFormat(extFormat) {
+		format = extFormat
+	}
+
+	// Containers may hold only audio, so check that there's a video stream to encode
+	if formatMediaType[format] == "video" {
+		hasVideo, err := hasVideoStream(path, ffprobePath)
+		if err != nil {
+			return "", err
+		}
+		if !hasVideo {
+			format = "audio-only " + format
+		}
+	}
+
+	return format, nil
+}
+
+// ExtensionFormat returns the format name implied by a file's extension, e.g. 'jpeg' for .JPG
+func ExtensionFormat(path string) string {
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if f, ok := extensionFormat[format]; ok {
+		return f
+	}
+	return format
+}
+
+// sniffFormat detects a file's format from its magic bytes. Returns an empty string if the
+// format isn't recognised.
+func sniffFormat(path string) (format string, err error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+
+	header := make([]byte, 16)
+	n, err := io.ReadFull(fh, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg", nil
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "png", nil
+	case bytes.HasPrefix(header, []byte("GIF8")):
+		return "gif", nil
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		if len(header) >= 10 && string(header[8:10]) == "CR" {
+			return "cr2", nil
+		}
+		return "tiff", nil
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return "webp", nil
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "matroska", nil
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		return isoBrandFormat(string(header[8:12])), nil
+	case len(header) >= 8 && isQuickTimeAtom(string(header[4:8])):
+		return "mov", nil
+	}
+
+	return "", nil
+}
+
+// isoBrandFormat maps the major brand of an ISO base media file to a format
+func isoBrandFormat(brand string) string {
+	switch brand {
+	case "heic", "heix", "heim", "heis", "mif1", "msf1":
+		return "heif"
+	case "avif", "avis":
+		return "avif"
+	case "qt  ":
+		return "mov"
+	case "M4A ", "M4B ":
+		return "m4a"
+	default:
+		return "mp4"
+	}
+}
+
+// isQuickTimeAtom returns true for top-level atoms which older QuickTime files may start with
+func isQuickTimeAtom(atom string) bool {
+	switch atom {
+	case "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
+
+// hasVideoStream uses ffprobe to check whether a container holds a video stream
+func hasVideoStream(path string, ffprobePath string) (bool, error) {
+	out, err := exec.Command(
+		ffprobePath, "-v", "error", "-show_entries", "stream=codec_type", "-of", "csv=p=0", path,
+	).Output()
+	if err != nil {
+		return false, fmt.Errorf("ffprobe failed: %s", err)
+	}
+
+	for _, codecType := range strings.Fields(string(out)) {
+		if codecType == "video" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isRawFormat returns true if a format is a camera RAW format
+func isRawFormat(format string) bool {
+	for _, rawExtension := range RawExtensions() {
+		if format == strings.TrimPrefix(rawExtension, ".") {
+			return true
+		}
+	}
+	return false
+}
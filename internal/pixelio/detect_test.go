@@ -0,0 +1,88 @@
+package pixelio
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSniffFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixelio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"jpeg", "\xFF\xD8\xFF\xE0\x00\x10JFIF\x00", "jpeg"},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", "png"},
+		{"gif", "GIF89a", "gif"},
+		{"tiff", "II*\x00\x08\x00\x00\x00\x10\x00", "tiff"},
+		{"big-endian tiff", "MM\x00*\x00\x00\x00\x08", "tiff"},
+		{"cr2", "II*\x00\x10\x00\x00\x00CR\x02\x00", "cr2"},
+		{"webp", "RIFF\x24\x00\x00\x00WEBPVP8 ", "webp"},
+		{"matroska", "\x1A\x45\xDF\xA3\x9f\x42\x86\x81", "matroska"},
+		{"heif", "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00", "heif"},
+		{"avif", "\x00\x00\x00\x1cftypavif\x00\x00\x00\x00", "avif"},
+		{"quicktime brand", "\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00", "mov"},
+		{"m4a", "\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00", "m4a"},
+		{"mp4", "\x00\x00\x00\x20ftypisom\x00\x00\x02\x00", "mp4"},
+		{"quicktime atom", "\x00\x00\x00\x08wide\x00\x00\x00\x00mdat", "mov"},
+		{"unrecognised", "hello, world", ""},
+		{"empty file", "", ""},
+		{"truncated jpeg", "\xFF\xD8", ""},
+		{"truncated tiff", "II*\x00", "tiff"},
+		{"truncated cr2", "II*\x00\x10\x00\x00\x00C", "tiff"},
+		{"truncated webp", "RIFF\x24\x00\x00\x00WE", ""},
+		{"truncated ftyp", "\x00\x00\x00\x18ftyphe", ""},
+		{"truncated quicktime atom", "\x00\x00\x00\x08mo", ""},
+	}
+
+	for n, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+n)))
+			if err := ioutil.WriteFile(path, []byte(tt.header), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := sniffFormat(path)
+			if err != nil {
+				t.Fatalf("sniffFormat() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("sniffFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := sniffFormat(filepath.Join(dir, "missing")); err == nil {
+		t.Error("sniffFormat() of a missing file didn't return an error")
+	}
+}
+
+func TestExtensionFormat(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"photo.JPG", "jpeg"},
+		{"photo.jpeg", "jpeg"},
+		{"scan.tif", "tiff"},
+		{"phone.HEIC", "heif"},
+		{"clip.mp4", "mp4"},
+		{"archive.tar.gz", "gz"},
+		{"README", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := ExtensionFormat(tt.path); got != tt.want {
+				t.Errorf("ExtensionFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -12,9 +12,13 @@ import (
 
 // InputFile represents an input file processed by the system
 type InputFile struct {
-	Path     string // Absolute filesystem path to file
-	Filename string // Name of file with extension
-	Subdir   string // Subdirectory relative to input directory
+	Path      string // Absolute filesystem path to file
+	Filename  string // Name of file with extension
+	Subdir    string // Subdirectory relative to input directory
+	MediaType string // Media type - image, video, etc. Set by DetectMediaType, otherwise based on extension
+	Format    string // Real file format, e.g. jpeg. Set by DetectMediaType
+	Sidecar   string // Absolute filesystem path to the file's sidecar settings file, if it has one
+	Probe     *Probe // Media properties such as dimensions and duration. Set by ProbeInputFile
 }
 
 // InputFileFromFullPath creates an InputFile from the input directory and the full path of a file
@@ -39,6 +43,7 @@ func InputFileFromFullPath(dir string, fullpath string) (inputFile *InputFile, e
 		Path:     fullpath,
 		Filename: filename,
 		Subdir:   subdir,
+		Sidecar:  findSidecar(fullpath),
 	}
 
 	return
@@ -83,17 +88,77 @@ func EnumerateDirContents(dir string) (files []*InputFile, err error) {
 		files = append(files, file)
 		return nil
 	})
+	return attachSidecars(files), err
+}
+
+// SidecarExtensions lists the extensions of sidecar files, which are appended to the
+// filename of the file they describe. e.g. sunset.jpg.yaml
+func SidecarExtensions() []string {
+	return []string{".yaml", ".yml", ".json"}
+}
+
+// attachSidecars attaches sidecar files to the InputFiles they describe, removing them from the
+// list of files
+func attachSidecars(files []*InputFile) (remainingFiles []*InputFile) {
+	filesByPath := make(map[string]*InputFile)
+	for _, file := range files {
+		filesByPath[file.Path] = file
+	}
+
+	for _, file := range files {
+		sidecarExt := filepath.Ext(file.Path)
+		if isSidecarExtension(sidecarExt) {
+			if describedFile, ok := filesByPath[strings.TrimSuffix(file.Path, sidecarExt)]; ok {
+				describedFile.Sidecar = file.Path
+				continue
+			}
+		}
+		remainingFiles = append(remainingFiles, file)
+	}
 	return
 }
 
+// findSidecar returns the path of a file's sidecar, or an empty string if it doesn't have one
+func findSidecar(path string) string {
+	for _, sidecarExt := range SidecarExtensions() {
+		if info, err := os.Stat(path + sidecarExt); err == nil && !info.IsDir() {
+			return path + sidecarExt
+		}
+	}
+	return ""
+}
+
+func isSidecarExtension(ext string) bool {
+	for _, sidecarExt := range SidecarExtensions() {
+		if strings.ToLower(ext) == sidecarExt {
+			return true
+		}
+	}
+	return false
+}
+
 // TypeExtension is a map from media types to associated file extensions
 func TypeExtension() map[string][]string {
 	return map[string][]string{
-		"image": {".jpg", ".jpeg", ".png", ".tiff"},
+		"image": append([]string{".jpg", ".jpeg", ".png", ".tiff", ".heic", ".heif"}, RawExtensions()...),
 		"video": {".mp4", ".mov"},
 	}
 }
 
+// RawExtensions lists the file extensions of supported camera RAW formats
+func RawExtensions() []string {
+	return []string{".cr2", ".nef", ".arw", ".dng"}
+}
+
+// IsRawImage detects whether a file is a camera RAW image from its detected format, or its
+// extension if it hasn't been detected
+func IsRawImage(file *InputFile) bool {
+	if file.Format != "" {
+		return isRawFormat(file.Format)
+	}
+	return isRawFormat(ExtensionFormat(file.Path))
+}
+
 // ExtensionType inverts TypeExtension to simplify file extension lookups
 func ExtensionType() map[string]string {
 	et := make(map[string]string)
@@ -105,23 +170,50 @@ func ExtensionType() map[string]string {
 	return et
 }
 
-// GetMediaType detects media type from a file's extension.
+// GetMediaType returns a file's media type, as set by DetectMediaType, or otherwise from its extension.
 // Returns the corresponding key from TypeExtension()
 func GetMediaType(file *InputFile) (MediaType string) {
-	fileExt := strings.ToLower(filepath.Ext(file.Path))
-	mediaType, ok := ExtensionType()[fileExt]
-	if !ok {
+	mediaType := fileMediaType(file)
+	if mediaType == "" {
 		fmt.Println("Invalid media type for", file.Path)
-		return
 	}
 	return mediaType
 }
 
+// fileMediaType returns a file's detected media type, falling back to its extension's media type
+func fileMediaType(file *InputFile) string {
+	if file.MediaType == unknownMediaType {
+		return ""
+	}
+	if file.MediaType != "" {
+		return file.MediaType
+	}
+	return ExtensionType()[strings.ToLower(filepath.Ext(file.Path))]
+}
+
+// extraMimeTypes contains MIME types for output formats which may be missing from the stdlib
+// mime package or the system's mime.types file
+var extraMimeTypes = map[string]string{
+	".avif": "image/avif",
+	".jxl":  "image/jxl",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".m4s":  "video/iso.segment",
+	".ts":   "video/mp2t",
+	".vtt":  "text/vtt",
+}
+
 // ExtensionMimeType returns the mime time given a file's extension.
-// Uses the stdlib mime package
+// Uses extraMimeTypes, falling back to the stdlib mime package
 func ExtensionMimeType(filename string) (mimeType string) {
 	fileExt := strings.ToLower(filepath.Ext(filename))
 
+	if mimeType, ok := extraMimeTypes[fileExt]; ok {
+		return mimeType
+	}
+
 	mimeType = mime.TypeByExtension(fileExt)
 	if mimeType == "" {
 		fmt.Printf("Unknown MIME type for extension %s\n", fileExt)
@@ -142,18 +234,13 @@ func FilterValidFiles(files []*InputFile) (filteredFiles []*InputFile) {
 
 // FilterFileType filters lists of files by type - image, video, etc
 func FilterFileType(files []*InputFile, fileType string) (filteredFiles []*InputFile) {
-	validExtensions, ok := TypeExtension()[fileType]
-	if ok == false {
+	if _, ok := TypeExtension()[fileType]; ok == false {
 		log.Fatalf("No file type '%s'", fileType)
 	}
 
-FILE:
 	for _, file := range files {
-		for _, validExtension := range validExtensions {
-			if strings.ToLower(filepath.Ext(file.Path)) == validExtension {
-				filteredFiles = append(filteredFiles, file)
-				continue FILE
-			}
+		if fileMediaType(file) == fileType {
+			filteredFiles = append(filteredFiles, file)
 		}
 	}
 	return
@@ -177,6 +264,13 @@ func GetFileOutputPath(parentOutputDir string, f *InputFile, fileExt string) (ou
 	return
 }
 
+// GetSourceOutputPath returns the path of a file describing a given file, such as its manifest.
+// The file's extension is kept, so that files with the same name but different formats don't
+// share an output path, e.g. output/subdir1/sunset.jpg.json
+func GetSourceOutputPath(parentOutputDir string, f *InputFile, fileExt string) string {
+	return filepath.Join(parentOutputDir, f.Subdir, f.Filename+fileExt)
+}
+
 // EnsureOutputDirExists ensures that the configured output dir, or subdirectory thereof, exists
 func EnsureOutputDirExists(parentOutputDir string, subdir string) error {
 	fullDir := filepath.Join(parentOutputDir, subdir)
@@ -236,5 +330,13 @@ func MoveOriginal(file *InputFile, moveDir string) (err error) {
 		return err
 	}
 
+	// Move the input file's sidecar along with it
+	if file.Sidecar != "" {
+		movedSidecarName := filepath.Join(fullMoveDir, filepath.Base(file.Sidecar))
+		if err = os.Rename(file.Sidecar, movedSidecarName); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
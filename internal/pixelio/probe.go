@@ -0,0 +1,187 @@
+package pixelio
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Probe describes an input file's media, inspected before it's encoded
+type Probe struct {
+	Width        int          `json:"width"`  // Display width, after rotation
+	Height       int          `json:"height"` // Display height, after rotation
+	Rotation     int          `json:"rotation,omitempty"`
+	HasAlpha     bool         `json:"hasAlpha,omitempty"`
+	Duration     float64      `json:"duration,omitempty"`  // Seconds, for videos
+	FrameRate    float64      `json:"frameRate,omitempty"` // Average frames per second, for videos
+	Bitrate      int          `json:"bitrate,omitempty"`   // Bits per second, for videos
+	VideoCodec   string       `json:"videoCodec,omitempty"`
+	VideoProfile string       `json:"videoProfile,omitempty"`
+	VideoLevel   int          `json:"videoLevel,omitempty"`
+	AudioTracks  []AudioTrack `json:"audioTracks,omitempty"`
+}
+
+// AudioTrack describes an audio stream in a video
+type AudioTrack struct {
+	Codec      string `json:"codec"`
+	Channels   int    `json:"channels"`
+	SampleRate int    `json:"sampleRate"`
+	Language   string `json:"language,omitempty"`
+}
+
+// HasAudio reports whether a probed video has any audio tracks
+func (p *Probe) HasAudio() bool {
+	return len(p.AudioTracks) > 0
+}
+
+// Frames estimates the number of frames in a probed video
+func (p *Probe) Frames() int {
+	return int(math.Ceil(p.Duration * p.FrameRate))
+}
+
+// ProbeVideo inspects a video using the ffprobe at ffprobePath. The width and height are swapped
+// for videos which are stored rotated, as ffmpeg rotates them on output.
+func ProbeVideo(path string, ffprobePath string) (*Probe, error) {
+	output, err := exec.Command(
+		ffprobePath, "-v", "error", "-show_format", "-show_streams", "-of", "json", path,
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed for %s: %s", path, err)
+	}
+
+	var ffprobe struct {
+		Format struct {
+			Duration string `json:"duration"`
+			BitRate  string `json:"bit_rate"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType    string `json:"codec_type"`
+			CodecName    string `json:"codec_name"`
+			Profile      string `json:"profile"`
+			Level        int    `json:"level"`
+			Width        int    `json:"width"`
+			Height       int    `json:"height"`
+			AvgFrameRate string `json:"avg_frame_rate"`
+			Channels     int    `json:"channels"`
+			SampleRate   string `json:"sample_rate"`
+			Tags         struct {
+				Rotate   string `json:"rotate"`
+				Language string `json:"language"`
+			} `json:"tags"`
+			SideData []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &ffprobe); err != nil {
+		return nil, fmt.Errorf("unable to parse ffprobe output for %s: %s", path, err)
+	}
+
+	probe := &Probe{}
+	probe.Duration, _ = strconv.ParseFloat(ffprobe.Format.Duration, 64)
+	probe.Bitrate, _ = strconv.Atoi(ffprobe.Format.BitRate)
+
+	hasVideo := false
+	for _, stream := range ffprobe.Streams {
+		switch stream.CodecType {
+		case "video":
+			// Only use the first video stream. Cover art is also reported as a video stream
+			if hasVideo {
+				continue
+			}
+			hasVideo = true
+
+			probe.Width, probe.Height = stream.Width, stream.Height
+			probe.VideoCodec = stream.CodecName
+			probe.VideoProfile = stream.Profile
+			probe.VideoLevel = stream.Level
+			probe.FrameRate = parseFrameRate(stream.AvgFrameRate)
+
+			// The rotate tag is clockwise, and the display matrix side data anticlockwise
+			rotation, _ := strconv.Atoi(stream.Tags.Rotate)
+			for _, sideData := range stream.SideData {
+				if sideData.Rotation != 0 {
+					rotation = -int(math.Round(sideData.Rotation))
+				}
+			}
+			probe.Rotation = (rotation%360 + 360) % 360
+			if probe.Rotation%180 == 90 {
+				probe.Width, probe.Height = stream.Height, stream.Width
+			}
+		case "audio":
+			sampleRate, _ := strconv.Atoi(stream.SampleRate)
+			probe.AudioTracks = append(probe.AudioTracks, AudioTrack{
+				Codec:      stream.CodecName,
+				Channels:   stream.Channels,
+				SampleRate: sampleRate,
+				Language:   stream.Tags.Language,
+			})
+		}
+	}
+	if !hasVideo {
+		return nil, fmt.Errorf("no video stream found in %s", path)
+	}
+
+	return probe, nil
+}
+
+// Frame is a frame of a video, listed by ProbeFrames
+type Frame struct {
+	Time     float64 // Presentation timestamp in seconds
+	Keyframe bool
+}
+
+// ProbeFrames lists the frames of a video's first video stream in presentation order, using the
+// ffprobe at ffprobePath. Packets are listed without being decoded, so this is fast even for
+// long videos.
+func ProbeFrames(path string, ffprobePath string) ([]Frame, error) {
+	output, err := exec.Command(
+		ffprobePath, "-v", "error", "-select_streams", "v:0", "-show_entries", "packet=pts_time,flags", "-of", "csv=p=0", path,
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed for %s: %s", path, err)
+	}
+
+	// Each packet is listed with its timestamp and flags, e.g. 4.004000,K__ for a keyframe
+	var frames []Frame
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 2 {
+			continue
+		}
+		time, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			// Packets without a timestamp are listed as N/A
+			continue
+		}
+		frames = append(frames, Frame{Time: time, Keyframe: strings.HasPrefix(fields[1], "K")})
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no video frames found in %s", path)
+	}
+
+	// Packets are listed in decoding order, which differs from presentation order with B-frames
+	sort.Slice(frames, func(i, j int) bool { return frames[i].Time < frames[j].Time })
+	return frames, nil
+}
+
+// parseFrameRate parses an ffprobe frame rate, e.g. 30000/1001. Returns 0 if it's unknown.
+func parseFrameRate(rate string) float64 {
+	parts := strings.SplitN(rate, "/", 2)
+	numerator, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0
+	}
+	if len(parts) == 1 {
+		return numerator
+	}
+	denominator, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || denominator == 0 {
+		return 0
+	}
+	return numerator / denominator
+}
@@ -0,0 +1,51 @@
+package pixelio
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseFrameRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want float64
+	}{
+		{"30000/1001", 30000.0 / 1001},
+		{"25/1", 25},
+		{"25", 25},
+		{"0/0", 0},
+		{"25/0", 0},
+		{"", 0},
+		{"N/A", 0},
+		{"30/x", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rate, func(t *testing.T) {
+			if got := parseFrameRate(tt.rate); math.Abs(got-tt.want) > 1e-9 || math.IsNaN(got) {
+				t.Errorf("parseFrameRate() = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrameCount(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe Probe
+		want  int
+	}{
+		{"whole frames", Probe{Duration: 10, FrameRate: 25}, 250},
+		{"partial frame rounded up", Probe{Duration: 10.01, FrameRate: 25}, 251},
+		{"ntsc frame rate", Probe{Duration: 10.01, FrameRate: 30000.0 / 1001}, 300},
+		{"unknown frame rate", Probe{Duration: 10, FrameRate: parseFrameRate("0/0")}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.probe.Frames(); got != tt.want {
+				t.Errorf("Frames() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -10,4 +10,6 @@ type PixelSlicer struct {
 	FSConfig       *mediaprocessor.FSConfig
 	MediaConfig    *mediaprocessor.MediaConfig
 	MediaProcessor *mediaprocessor.MediaProcessor
+	RunManifest    *mediaprocessor.RunManifest
+	ChunkPool      *ChunkPool // Distributes the chunks of long videos between workers, if chunking is enabled
 }
@@ -18,15 +18,22 @@ import (
 func (p *PixelSlicer) ProcessFiles(conf config.ReadableConfig) {
 	jobQueue := make(chan mediaprocessor.MediaJob, 2048)
 
-	// Always queue any files which are already in the directory
-	numInitialJobs := p.processOneShot(jobQueue) // TODO: multiply by number of render types?
-	// fmt.Printf("\nProcessing %d jobs in initial directory...\n\n", numInitialJobs)
-	bar := progressbar.New(numInitialJobs)
+	if p.FSConfig.RunManifest != "" {
+		p.RunManifest = mediaprocessor.NewRunManifest()
+	}
+
+	// Chunk jobs are only queued for videos if chunking is enabled, but every worker takes part
+	p.ChunkPool = NewChunkPool(conf.Workers)
+
+	// Always queue any files which are already in the directory. The progress bar tracks the
+	// estimated work of each job, rather than the number of jobs, as videos take far longer
+	initialWork := p.processOneShot(jobQueue)
+	bar := progressbar.New(initialWork)
 
 	errc := make(chan error)
 	completion := make(chan bool)
 	for w := 1; w <= conf.Workers; w++ {
-		go WorkerProcessMedia(jobQueue, errc, completion, bar)
+		go WorkerProcessMedia(jobQueue, p.ChunkPool, errc, completion, bar)
 	}
 
 	// We need to be careful that we don't try and process the same file twice - otherwise the workers will fight over it.
@@ -36,7 +43,7 @@ func (p *PixelSlicer) ProcessFiles(conf config.ReadableConfig) {
 
 	if conf.Watch {
 		fmt.Println("Continuing to monitor input directory for new files...")
-		p.processWatchDir(jobQueue)
+		p.processWatchDir(jobQueue, bar)
 	} else {
 		// Not monitoring inputDir - we're only interested in the files already in the input directory,
 		// so close jobs to signal we have no further tasks
@@ -59,13 +66,19 @@ func (p *PixelSlicer) ProcessFiles(conf config.ReadableConfig) {
 		fmt.Printf("Error processing job: %s\n", err)
 	}
 
+	if p.RunManifest != nil {
+		if err := writeRunManifest(p.RunManifest, p.FSConfig, p.S3Client); err != nil {
+			fmt.Printf("Error writing run manifest: %s\n", err)
+		}
+	}
+
 	// TODO: Have a way to exit cleanly in the middle of a batch - ie workers should finish their current jobs, and then
 	// call completion
 }
 
 // processWatchDir watches the input directory for newly added media files. If a new file is found,
-// it is added to the jobQueue.
-func (p *PixelSlicer) processWatchDir(jobQueue chan<- mediaprocessor.MediaJob) {
+// it is added to the jobQueue, and its estimated work is added to the progress bar.
+func (p *PixelSlicer) processWatchDir(jobQueue chan<- mediaprocessor.MediaJob, bar *progressbar.ProgressBar) {
 	w := watcher.New()
 
 	w.FilterOps(watcher.Create)
@@ -86,6 +99,11 @@ func (p *PixelSlicer) processWatchDir(jobQueue chan<- mediaprocessor.MediaJob) {
 					}
 					fmt.Printf("Created inputfile from event: %+v\n", inputFile)
 
+					if err := pixelio.DetectMediaType(inputFile, p.FSConfig.TypeDetection, p.FSConfig.FFprobePath); err != nil {
+						log.Printf("Unable to detect media type: %s\n", err)
+						continue
+					}
+
 					// Check if inputFile is a valid file type
 					validInputFiles := pixelio.FilterValidFiles([]*pixelio.InputFile{inputFile})
 					if len(validInputFiles) == 0 {
@@ -93,7 +111,12 @@ func (p *PixelSlicer) processWatchDir(jobQueue chan<- mediaprocessor.MediaJob) {
 						continue
 					}
 
+					if err := mediaprocessor.ProbeInputFile(inputFile, p.FSConfig.FFprobePath, p.FSConfig.DcrawPath); err != nil {
+						log.Printf("Unable to probe input file: %s\n", err)
+					}
+
 					job := p.CreateJob(inputFile)
+					bar.ChangeMax(bar.GetMax() + job.EstimatedWork())
 					jobQueue <- job
 				}
 			case err := <-w.Error:
@@ -116,12 +139,13 @@ func (p *PixelSlicer) processWatchDir(jobQueue chan<- mediaprocessor.MediaJob) {
 }
 
 // processOneShot crawls a directory tree looking for files of the correct type. Any matching
-// files are added to the jobQueue.
+// files are probed and added to the jobQueue. Returns the estimated work of the queued jobs.
 func (p *PixelSlicer) processOneShot(jobQueue chan<- mediaprocessor.MediaJob) int {
 	files, err := pixelio.EnumerateDirContents(p.FSConfig.InputDir)
 	if err != nil {
 		log.Fatal("Cannot enumerate supplied directory", p.FSConfig.InputDir)
 	}
+	pixelio.DetectMediaTypes(files, p.FSConfig.TypeDetection, p.FSConfig.FFprobePath)
 
 	// Filter out valid file types
 	filteredFiles := pixelio.FilterValidFiles(files)
@@ -130,25 +154,42 @@ func (p *PixelSlicer) processOneShot(jobQueue chan<- mediaprocessor.MediaJob) in
 	for mediaType, _ := range pixelio.TypeExtension() {
 		mediaFiles[mediaType] = pixelio.FilterFileType(files, mediaType)
 	}
-	fmt.Printf("Found %d images and %d videos in '%s'\n\n", len(mediaFiles["image"]), len(mediaFiles["video"]), p.FSConfig.InputDir)
+	mediaprocessor.ProbeInputFiles(filteredFiles, p.FSConfig.FFprobePath, p.FSConfig.DcrawPath)
+	var videoDuration float64
+	for _, file := range mediaFiles["video"] {
+		if file.Probe != nil {
+			videoDuration += file.Probe.Duration
+		}
+	}
+	fmt.Printf(
+		"Found %d images and %d videos (%s) in '%s'\n\n", len(mediaFiles["image"]), len(mediaFiles["video"]),
+		time.Duration(videoDuration*float64(time.Second)).Round(time.Second), p.FSConfig.InputDir,
+	)
 
+	work := 0
 	for _, file := range filteredFiles {
 		// fmt.Printf("Queued '%s' (%d/%d)\n", file.Filename, i+1, len(filteredFiles)) // TODO: verbose
 		// Multithreaded image processing
 		job := p.CreateJob(file)
+		work += job.EstimatedWork()
 		jobQueue <- job
 	}
 
-	return len(filteredFiles)
+	return work
 }
 
 // CreateJob creates a mediaprocessor.MediaJob for a given input file
 func (p *PixelSlicer) CreateJob(file *pixelio.InputFile) mediaprocessor.MediaJob {
-	return mediaprocessor.MediaJob{
+	job := mediaprocessor.MediaJob{
 		FSConfig:       p.FSConfig,
 		MediaConfig:    p.MediaConfig,
 		MediaProcessor: p.MediaProcessor,
 		S3Client:       p.S3Client,
 		InputFile:      file,
+		RunManifest:    p.RunManifest,
+	}
+	if p.ChunkPool != nil && p.FSConfig.ChunkDuration > 0 {
+		job.ChunkQueue = p.ChunkPool.Queue
 	}
+	return job
 }
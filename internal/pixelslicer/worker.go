@@ -1,60 +1,124 @@
 package pixelslicer
 
 import (
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/schollz/progressbar/v3"
 	"github.com/willdollman/pixel-slicer/internal/mediaprocessor"
 	"github.com/willdollman/pixel-slicer/internal/pixelio"
+	"github.com/willdollman/pixel-slicer/internal/s3"
 )
 
 // WorkerProcessMedia is a worker in a worker pool. It reads media jobs from the queue, and reports success/failure.
 // This is fine for a one-shot thing where you have a fixed number of jobs, but how
 // should it work with an unknown # jobs (and unknown delay between jobs)?
 // Also doesn't allow us to pass errors back up the caller.
-// func WorkerProcessMedia(jobs <-chan mediaprocessor.MediaJob, errc chan<- error, completion chan<- bool) {
-func WorkerProcessMedia(jobs <-chan mediaprocessor.MediaJob, errc chan<- error, completion chan<- bool, progress *progressbar.ProgressBar) {
-	for j := range jobs {
-		mediaType := pixelio.GetMediaType(j.InputFile)
+// Chunk jobs from the ChunkPool are taken before new jobs, as their parent job is waiting for them.
+func WorkerProcessMedia(jobs <-chan mediaprocessor.MediaJob, chunks *ChunkPool, errc chan<- error, completion chan<- bool, progress *progressbar.ProgressBar) {
+	for {
+		select {
+		case chunkJob := <-chunks.Queue:
+			chunkJob.ProcessChunk()
+			continue
+		default:
+		}
 
-		var filenames []string
-		var err error
-		startTime := time.Now()
+		select {
+		case chunkJob := <-chunks.Queue:
+			chunkJob.ProcessChunk()
+		case j, ok := <-jobs:
+			if !ok {
+				// When jobs is closed, help with any remaining chunks, then signal completion to
+				// indicate this worker is finished
+				chunks.Drain()
+				completion <- true
+				return
+			}
+			processJob(j, errc, progress)
+		}
+	}
+}
 
-		// TODO: Here, or in the ProcessX methods, we should check the file still exists
+// processJob processes a media job, reporting any errors, and adds its work to the progress bar
+func processJob(j mediaprocessor.MediaJob, errc chan<- error, progress *progressbar.ProgressBar) {
+	mediaType := pixelio.GetMediaType(j.InputFile)
+	// Estimated before processing, as sidecars can change the job's configuration
+	work := j.EstimatedWork()
 
-		switch mediaType {
-		case "image":
-			filenames, err = j.ProcessImage()
-			if err != nil {
-				errc <- errors.Wrap(err, "Error processing image")
-				continue
-			}
-		case "video":
-			filenames, err = j.ProcessVideo()
-			if err != nil {
-				errc <- errors.Wrap(err, "Error processing video")
-				continue
-			}
-		default:
-			errc <- errors.Wrapf(err, "Unable to process media, unknown media type '%s'", mediaType)
-			continue
+	var filenames []string
+	var err error
+	startTime := time.Now()
+
+	// TODO: Here, or in the ProcessX methods, we should check the file still exists
+
+	switch mediaType {
+	case "image":
+		filenames, err = j.ProcessImage()
+		if err != nil {
+			errc <- errors.Wrap(err, "Error processing image")
+			return
 		}
-		_ = startTime
-		// fmt.Printf("Encoding '%s' took %.2fs\n", j.InputFile.Filename, time.Since(startTime).Seconds())
+	case "video":
+		filenames, err = j.ProcessVideo()
+		if err != nil {
+			errc <- errors.Wrap(err, "Error processing video")
+			return
+		}
+	default:
+		errc <- errors.Wrapf(err, "Unable to process media, unknown media type '%s'", mediaType)
+		return
+	}
+	_ = startTime
+	// fmt.Printf("Encoding '%s' took %.2fs\n", j.InputFile.Filename, time.Since(startTime).Seconds())
 
-		postProcessStart := time.Now()
-		if err := jobPostProcess(j, filenames); err != nil {
-			errc <- errors.Wrap(err, "Error post-processing job")
-			continue
+	postProcessStart := time.Now()
+	if err := jobPostProcess(j, filenames); err != nil {
+		errc <- errors.Wrap(err, "Error post-processing job")
+		return
+	}
+	_ = postProcessStart
+	// fmt.Printf("Post-processing '%s' took %.2fs\n", j.InputFile.Filename, time.Since(postProcessStart).Seconds())
+	progress.Add(work)
+}
+
+// ChunkPool distributes chunk jobs, which each encode a section of a long video, between the
+// workers. Workers keep taking chunk jobs until every worker has run out of jobs, as a job still
+// being processed may queue more chunks.
+type ChunkPool struct {
+	Queue    chan mediaprocessor.MediaJob
+	drained  sync.WaitGroup
+	finished chan struct{}
+}
+
+// NewChunkPool creates a ChunkPool shared by a number of workers
+func NewChunkPool(workers int) *ChunkPool {
+	c := &ChunkPool{
+		Queue:    make(chan mediaprocessor.MediaJob, 2048),
+		finished: make(chan struct{}),
+	}
+	c.drained.Add(workers)
+	go func() {
+		c.drained.Wait()
+		close(c.finished)
+	}()
+	return c
+}
+
+// Drain is called by a worker once it has run out of jobs. It processes chunk jobs until every
+// worker has run out of jobs, when no more chunks can be queued.
+func (c *ChunkPool) Drain() {
+	c.drained.Done()
+	for {
+		select {
+		case chunkJob := <-c.Queue:
+			chunkJob.ProcessChunk()
+		case <-c.finished:
+			return
 		}
-		_ = postProcessStart
-		// fmt.Printf("Post-processing '%s' took %.2fs\n", j.InputFile.Filename, time.Since(postProcessStart).Seconds())
-		progress.Add(1)
 	}
-	// When jobs is closed, signal completion to indicate this worker is finished
-	completion <- true
 }
 
 // Perform any post-processing tasks after a job has been processed
@@ -72,6 +136,17 @@ func jobPostProcess(job mediaprocessor.MediaJob, filenames []string) error {
 		}
 	}
 
+	// Add the job to the run manifest. When watching for new files the run never ends, so the run
+	// manifest is rewritten after every job instead of once all jobs are complete.
+	if job.RunManifest != nil && job.Manifest != nil {
+		job.RunManifest.Add(job.Manifest)
+		if job.FSConfig.Watch {
+			if err := writeRunManifest(job.RunManifest, job.FSConfig, job.S3Client); err != nil {
+				return errors.Wrap(err, "Unable to write run manifest")
+			}
+		}
+	}
+
 	if job.FSConfig.MoveProcessed {
 		// Move file to output dir
 		if err := pixelio.MoveOriginal(job.InputFile, job.FSConfig.ProcessedDir); err != nil {
@@ -80,3 +155,25 @@ func jobPostProcess(job mediaprocessor.MediaJob, filenames []string) error {
 	}
 	return nil
 }
+
+// runManifestMu prevents workers from uploading the run manifest while it's being rewritten
+var runManifestMu sync.Mutex
+
+// writeRunManifest writes the run manifest to the output dir, and uploads it to S3 if enabled
+func writeRunManifest(runManifest *mediaprocessor.RunManifest, fsConfig *mediaprocessor.FSConfig, s3Client *s3.S3Client) error {
+	runManifestMu.Lock()
+	defer runManifestMu.Unlock()
+
+	filename := filepath.Join(fsConfig.OutputDir, fsConfig.RunManifest)
+	if err := runManifest.Write(filename); err != nil {
+		return err
+	}
+
+	if s3Client.Config.Enabled {
+		filekey := pixelio.StripFileOutputDir(fsConfig.OutputDir, filename)
+		if err := s3Client.UploadFile(filename, filekey); err != nil {
+			return errors.Wrap(err, "Unable to upload run manifest to S3")
+		}
+	}
+	return nil
+}